@@ -96,6 +96,7 @@ func newApp(name string) *cli.App {
 	// Register all commands.
 	registerCommand(serverCmd)
 	registerCommand(proxyCmd)
+	registerCommand(proxyStatCmd)
 /*	registerCommand(gatewayCmd)
 	registerCommand(updateCmd)
 	registerCommand(versionCmd)
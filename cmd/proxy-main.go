@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/minio/cli"
 	"github.com/minio/minio/cmd/logger"
+	"github.com/minio/minio/cmd/logger/target/console"
+	"github.com/minio/minio/cmd/logger/target/http"
 	proxy "github.com/marmotcai/xagent/proxy"
 	"os"
 	"os/exec"
@@ -66,6 +68,10 @@ ENVIRONMENT VARIABLES:
      XAgent_PUBLIC_IPS: To enable bucket DNS requests, set this value to list of XAgent host public IP(s) delimited by ",".
      XAgent_ETCD_ENDPOINTS: To enable bucket DNS requests, set this value to list of etcd endpoints delimited by ",".
 
+  PROXY:
+     XAGENT_LOGGER_HTTP_ENDPOINT: To ship proxy errors, set this value to the http endpoint receiving json log entries.
+     XAGENT_PROXY_ACCESS_LOG_HTTP_ENDPOINT: To ship proxy access log, set this value to the http endpoint receiving json entries.
+
    KMS:
      XAgent_SSE_VAULT_ENDPOINT: To enable Vault as KMS,set this value to Vault endpoint.
      XAgent_SSE_VAULT_APPROLE_ID: To enable Vault as KMS,set this value to Vault AppRole ID.
@@ -149,5 +155,17 @@ func proxyMain(ctx *cli.Context) {
 
 	globalXAgentHost, globalXAgentPort = mustSplitHostPort(globalXAgentAddr)
 
+	// Proxy doesn't load server config, so set up logger targets here.
+	logger.Init(GOPATH, GOROOT)
+	if endpoint, ok := os.LookupEnv("XAGENT_LOGGER_HTTP_ENDPOINT"); ok {
+		logger.AddTarget(http.New(endpoint, NewCustomHTTPTransport()))
+	}
+	logger.AddTarget(console.New())
+	proxy.UseServerLogger()
+
+	if endpoint, ok := os.LookupEnv("XAGENT_PROXY_ACCESS_LOG_HTTP_ENDPOINT"); ok {
+		// Ship proxy access log through http logger target.
+		proxy.AddAccessLogTarget(http.New(endpoint, NewCustomHTTPTransport()))
+	}
 	proxy.Main()
 }
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"time"
+
+	proxy "github.com/marmotcai/xagent/proxy"
+	"github.com/minio/cli"
+	"github.com/minio/minio/cmd/logger"
+)
+
+var proxyStatFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "rc",
+		Usage: "proxy config file, defaults to $HOME/.cow/rc",
+	},
+	cli.DurationFlag{
+		Name:  "since",
+		Value: 7 * 24 * time.Hour,
+		Usage: "only show site events within this duration",
+	},
+	cli.StringFlag{
+		Name:  "event",
+		Usage: "only show events of type: direct, blocked or temp_blocked",
+	},
+	cli.StringFlag{
+		Name:  "host",
+		Usage: "only show events of the host or domain",
+	},
+	cli.StringFlag{
+		Name:  "format",
+		Value: "text",
+		Usage: "output format: text, csv or json",
+	},
+}
+
+var proxyStatCmd = cli.Command{
+	Name:   "proxy-stat",
+	Usage:  "query site history recorded by agent proxy",
+	Flags:  proxyStatFlags,
+	Action: proxyStatMain,
+	CustomHelpTemplate: `NAME:
+  {{.HelpName}} - {{.Usage}}
+
+USAGE:
+  {{.HelpName}} {{if .VisibleFlags}}[FLAGS]{{end}}
+{{if .VisibleFlags}}
+FLAGS:
+  {{range .VisibleFlags}}{{.}}
+  {{end}}{{end}}
+NOTE:
+  Site history is only recorded with "statBackend = log" in proxy config.
+
+EXAMPLES:
+  1. Show sites which became blocked this week.
+     $ {{.HelpName}} --event blocked
+
+  2. Export history of the last 30 days as CSV.
+     $ {{.HelpName}} --since 720h --format csv > history.csv
+`,
+}
+
+func proxyStatMain(ctx *cli.Context) {
+	q := proxy.StatQuery{
+		RcFile: ctx.String("rc"),
+		Since:  ctx.Duration("since"),
+		Event:  ctx.String("event"),
+		Host:   ctx.String("host"),
+		Format: ctx.String("format"),
+	}
+	logger.FatalIf(proxy.QuerySiteStat(q, os.Stdout), "Unable to query proxy site stat")
+}
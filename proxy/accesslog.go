@@ -0,0 +1,316 @@
+// Access log records each proxied request or tunnel.
+//
+//	accessLog = ~/.cow/access.log
+//	accessLogFormat = json         # json, common or combined
+//	accessLogMaxSize = 100M        # rotate when file exceeds size
+//	accessLogRotate = 24h          # rotate periodically
+//	accessLogBackups = 7           # number of rotated files to keep
+//
+// Entries can also be shipped to targets added with AddAccessLogTarget, e.g.
+// the http logger target of the server.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+
+	defaultAccessLogBackups = 7
+
+	routeDirect = "direct"
+	routeParent = "parent"
+	routeNone   = "none" // failed before connecting to server
+	routeCache  = "cache"
+)
+
+// AccessLogTarget receives access log entries. It has the same method as the
+// server's logger.Target, so those targets can be used directly.
+type AccessLogTarget interface {
+	Send(entry interface{}) error
+}
+
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"` // host:port
+	Path      string    `json:"path,omitempty"`
+	TLS       bool      `json:"tls,omitempty"` // intercepted TLS request
+	Route     string    `json:"route"`
+	Parent    string    `json:"parent,omitempty"`
+	Status    int       `json:"status"`
+	Sent      int64     `json:"sent"` // bytes sent to server
+	Recv      int64     `json:"recv"` // bytes received from server
+	Duration  int64     `json:"duration_ms"`
+	Retry     int       `json:"retry"`
+	Error     string    `json:"error,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+var accessLog struct {
+	sync.Mutex
+	w       io.Writer // nil if not logging to file
+	format  string
+	targets []AccessLogTarget
+}
+
+// AddAccessLogTarget ships access log entries to t. Should be called before
+// Main.
+func AddAccessLogTarget(t AccessLogTarget) {
+	accessLog.targets = append(accessLog.targets, t)
+}
+
+func initAccessLog() {
+	accessLog.format = config.AccessLogFormat
+	if config.AccessLog == "" {
+		return
+	}
+	w, err := newRotateWriter(config.AccessLog, config.AccessLogMaxSize,
+		config.AccessLogRotate, config.AccessLogBackups)
+	if err != nil {
+		Fatal("open access log:", err)
+	}
+	accessLog.w = w
+}
+
+func accessLogEnabled() bool {
+	return accessLog.w != nil || len(accessLog.targets) != 0
+}
+
+// logAccess records a finished request. sv and lc are nil if failed to
+// connect to server. start is when the request is parsed, so the duration
+// includes retries.
+func logAccess(c *clientConn, r *Request, rp *Response, sv *serverConn, lc *liveConn,
+	start time.Time, err error) {
+	r.capture.finish(r, rp, sv, err)
+	if !accessLogEnabled() {
+		return
+	}
+	e := &accessEntry{
+		Time:      start,
+		Client:    c.RemoteAddr().String(),
+		User:      c.user,
+		Method:    r.Method,
+		Host:      r.URL.HostPort,
+		Path:      r.URL.Path,
+		TLS:       r.mitm,
+		Duration:  int64(time.Since(start) / time.Millisecond),
+		Retry:     int(r.tryCnt) - 1,
+		Referer:   r.Referer,
+		UserAgent: r.UserAgent,
+	}
+	e.Route, e.Parent = requestRoute(r, sv)
+	if lc != nil {
+		e.Sent, e.Recv = atomic.LoadInt64(&lc.Sent), atomic.LoadInt64(&lc.Recv)
+	}
+	e.Status = responseStatus(r, rp, sv, err)
+	if err != nil && err != errPageSent {
+		e.Error = err.Error()
+	}
+	writeAccessEntry(e)
+}
+
+// logTunnelAccess records a finished SOCKS tunnel or UDP relay session. e
+// should have all fields except duration and error filled, Time is when the
+// tunnel or session starts.
+func logTunnelAccess(e *accessEntry, err error) {
+	if !accessLogEnabled() {
+		return
+	}
+	e.Duration = int64(time.Since(e.Time) / time.Millisecond)
+	if err != nil && err != io.EOF {
+		e.Error = err.Error()
+	}
+	writeAccessEntry(e)
+}
+
+// requestRoute returns how request is served, and parent proxy if used.
+func requestRoute(r *Request, sv *serverConn) (route, parent string) {
+	switch {
+	case r.blocked != "":
+		return routeBlocked, ""
+	case r.cache != nil && r.cache.hit:
+		return routeCache, ""
+	case sv == nil:
+		return routeNone, ""
+	case sv.isDirect():
+		return routeDirect, ""
+	}
+	return routeParent, fmt.Sprint(sv.Conn)
+}
+
+// responseStatus returns status sent to client, 0 if unknown.
+func responseStatus(r *Request, rp *Response, sv *serverConn, err error) int {
+	switch {
+	case r.blocked != "" && !r.isConnect:
+		return blockStatus
+	case r.isConnect && sv != nil:
+		return 200
+	case r.state >= rsRecvBody:
+		return rp.Status
+	case err == errPageSent:
+		return 502
+	}
+	return 0
+}
+
+func writeAccessEntry(e *accessEntry) {
+	for _, t := range accessLog.targets {
+		if err := t.Send(e); err != nil {
+			debug.Println("send access log:", err)
+		}
+	}
+	if accessLog.w == nil {
+		return
+	}
+	var b []byte
+	switch accessLog.format {
+	case accessLogCommon, accessLogCombined:
+		b = formatCLF(e, accessLog.format == accessLogCombined)
+	default:
+		var err error
+		if b, err = json.Marshal(e); err != nil {
+			errl.Println("marshal access log:", err)
+			return
+		}
+		b = append(b, '\n')
+	}
+	accessLog.Lock()
+	_, err := accessLog.w.Write(b)
+	accessLog.Unlock()
+	if err != nil {
+		errl.Println("write access log:", err)
+	}
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatCLF formats entry in Common or Combined Log Format.
+func formatCLF(e *accessEntry, combined bool) []byte {
+	host, _, err := net.SplitHostPort(e.Client)
+	if err != nil {
+		host = e.Client
+	}
+	target := e.Host
+	if e.TLS {
+		target = "https://" + e.Host + e.Path
+	} else if e.Method != "CONNECT" {
+		target = "http://" + e.Host + e.Path
+	}
+	status, size := "-", "-"
+	if e.Status != 0 {
+		status = strconv.Itoa(e.Status)
+	}
+	if e.Recv != 0 {
+		size = strconv.FormatInt(e.Recv, 10)
+	}
+	b := []byte(fmt.Sprintf("%s - %s [%s] \"%s %s HTTP/1.1\" %s %s",
+		host, clfField(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, target, status, size))
+	if combined {
+		b = append(b, fmt.Sprintf(" %q %q", clfField(e.Referer), clfField(e.UserAgent))...)
+	}
+	return append(b, '\n')
+}
+
+// rotateWriter writes to a file and rotates it by size or time. Rotated files
+// are named with the rotation time appended.
+type rotateWriter struct {
+	path     string
+	maxSize  int64         // 0 means no limit
+	interval time.Duration // 0 means no periodic rotation
+	backups  int
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func newRotateWriter(path string, maxSize int64, interval time.Duration, backups int) (*rotateWriter, error) {
+	w := &rotateWriter{path: path, maxSize: maxSize, interval: interval, backups: backups}
+	return w, w.open()
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size, w.created = f, fi.Size(), fi.ModTime()
+	if w.size == 0 {
+		w.created = time.Now()
+	}
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (n int, err error) {
+	if w.f == nil {
+		return 0, errors.New("access log not open")
+	}
+	if (w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize && w.size > 0) ||
+		(w.interval > 0 && time.Since(w.created) >= w.interval) {
+		if err = w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = w.f.Write(p)
+	w.size += int64(n)
+	return
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+	w.f = nil
+	backup := w.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(w.path, backup); err != nil {
+		errl.Println("rotate access log:", err)
+	} else {
+		w.removeOldBackups()
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) removeOldBackups() {
+	if w.backups <= 0 {
+		return
+	}
+	files, err := filepath.Glob(w.path + ".*")
+	if err != nil || len(files) <= w.backups {
+		return
+	}
+	// Time format in file name makes lexical order the same as time order.
+	sort.Strings(files)
+	for _, f := range files[:len(files)-w.backups] {
+		if err := os.Remove(f); err != nil {
+			errl.Println("remove old access log:", err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatCLF(t *testing.T) {
+	tm := time.Date(2019, 3, 8, 13, 55, 36, 0, time.FixedZone("", 8*3600))
+	e := &accessEntry{
+		Time:      tm,
+		Client:    "192.168.1.2:5678",
+		User:      "alice",
+		Method:    "GET",
+		Host:      "www.example.com:80",
+		Path:      "/index.html",
+		Status:    200,
+		Recv:      1234,
+		UserAgent: "curl/7.64",
+	}
+	common := `192.168.1.2 - alice [08/Mar/2019:13:55:36 +0800] "GET http://www.example.com:80/index.html HTTP/1.1" 200 1234` + "\n"
+	if s := string(formatCLF(e, false)); s != common {
+		t.Errorf("common log format got\n%s", s)
+	}
+	combined := strings.TrimSuffix(common, "\n") + ` "-" "curl/7.64"` + "\n"
+	if s := string(formatCLF(e, true)); s != combined {
+		t.Errorf("combined log format got\n%s", s)
+	}
+
+	e = &accessEntry{Time: tm, Client: "192.168.1.2:5678", Method: "CONNECT", Host: "www.example.com:443"}
+	connect := `192.168.1.2 - - [08/Mar/2019:13:55:36 +0800] "CONNECT www.example.com:443 HTTP/1.1" - -` + "\n"
+	if s := string(formatCLF(e, false)); s != connect {
+		t.Errorf("CONNECT log format got\n%s", s)
+	}
+}
+
+type recordTarget struct {
+	entry []interface{}
+}
+
+func (rt *recordTarget) Send(entry interface{}) error {
+	rt.entry = append(rt.entry, entry)
+	return nil
+}
+
+func TestWriteAccessEntry(t *testing.T) {
+	saved := accessLog.w
+	savedTargets := accessLog.targets
+	defer func() {
+		accessLog.w, accessLog.targets, accessLog.format = saved, savedTargets, ""
+	}()
+
+	var buf bytes.Buffer
+	rt := &recordTarget{}
+	accessLog.w = &buf
+	accessLog.targets = nil
+	accessLog.format = accessLogJSON
+	AddAccessLogTarget(rt)
+
+	e := &accessEntry{Client: "127.0.0.1:1234", Method: "GET", Host: "example.com:80",
+		Route: routeParent, Parent: "http parent", Status: 200, Retry: 1}
+	writeAccessEntry(e)
+	if len(rt.entry) != 1 {
+		t.Fatal("entry not sent to target")
+	}
+	var got accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal("json access log:", err)
+	}
+	if got.Route != routeParent || got.Parent != "http parent" || got.Retry != 1 {
+		t.Errorf("json access log got %+v", got)
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "access.log")
+
+	w, err := newRotateWriter(fpath, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		// Make backup names different.
+		time.Sleep(2 * time.Millisecond)
+	}
+	backups, _ := filepath.Glob(fpath + ".*")
+	if len(backups) != 2 {
+		t.Errorf("should keep 2 backups, got %d", len(backups))
+	}
+	if b, _ := ioutil.ReadFile(fpath); string(b) != "12345678\n" {
+		t.Errorf("current log content %q", b)
+	}
+
+	// Periodic rotation.
+	w.interval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	w.Write([]byte("a\n"))
+	if b, _ := ioutil.ReadFile(fpath); string(b) != "a\n" {
+		t.Errorf("log should be rotated by time, content %q", b)
+	}
+}
+
+func TestLogTunnelAccess(t *testing.T) {
+	savedTargets := accessLog.targets
+	defer func() { accessLog.targets = savedTargets }()
+	rt := &recordTarget{}
+	accessLog.targets = nil
+	AddAccessLogTarget(rt)
+
+	e := &accessEntry{Time: time.Now().Add(-time.Second), Client: "127.0.0.1:1234",
+		Method: "UDP", Host: "8.8.8.8:53", Route: routeDirect, Sent: 40, Recv: 80}
+	logTunnelAccess(e, io.EOF)
+	logTunnelAccess(&accessEntry{Method: "CONNECT", Route: routeNone}, errQuotaExceeded)
+	if len(rt.entry) != 2 {
+		t.Fatal("tunnel entries not sent to target")
+	}
+	if e.Duration < 1000 || e.Error != "" {
+		t.Errorf("tunnel entry should have duration and no error for EOF, got %+v", e)
+	}
+	if got := rt.entry[1].(*accessEntry); got.Error != errQuotaExceeded.Error() {
+		t.Errorf("tunnel entry error got %q", got.Error)
+	}
+}
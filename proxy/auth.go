@@ -28,11 +28,6 @@ const (
 `
 )
 
-type netAddr struct {
-	ip   net.IP
-	mask net.IPMask
-}
-
 type authUser struct {
 	// user name is the key to auth.user, no need to store here
 	passwd string
@@ -41,11 +36,15 @@ type authUser struct {
 }
 
 var auth struct {
-	required bool
+	required bool // some listener requires authentication
+	static   bool // userPasswd, userPasswdFile or allowedClient specified
 
 	user map[string]*authUser
 
-	allowedClient []netAddr
+	backend  map[string]authenticator // named backends from authBackend
+	listener map[string]authenticator // listen address -> backend
+
+	allowedClient []*net.IPNet
 
 	authed *TimeoutSet // cache authenticated users based on ip
 
@@ -89,31 +88,14 @@ func parseAllowedClient(val string) {
 		return
 	}
 	arr := strings.Split(val, ",")
-	auth.allowedClient = make([]netAddr, len(arr))
+	auth.allowedClient = make([]*net.IPNet, len(arr))
 	for i, v := range arr {
 		s := strings.TrimSpace(v)
-		ipAndMask := strings.Split(s, "/")
-		if len(ipAndMask) > 2 {
-			Fatal("allowedClient syntax error: client should be the form ip/nbitmask")
-		}
-		ip := net.ParseIP(ipAndMask[0])
-		if ip == nil {
-			Fatalf("allowedClient syntax error %s: ip address not valid\n", s)
-		}
-		var mask net.IPMask
-		if len(ipAndMask) == 2 {
-			nbit, err := strconv.Atoi(ipAndMask[1])
-			if err != nil {
-				Fatalf("allowedClient syntax error %s: %v\n", s, err)
-			}
-			if nbit > 32 {
-				Fatal("allowedClient error: mask number should <= 32")
-			}
-			mask = NewNbitIPv4Mask(nbit)
-		} else {
-			mask = NewNbitIPv4Mask(32)
+		ipnet, err := parseIPNet(s)
+		if err != nil {
+			Fatalf("allowedClient syntax error %s: client should be the form ip/nbitmask\n", s)
 		}
-		auth.allowedClient[i] = netAddr{ip.Mask(mask), mask}
+		auth.allowedClient[i] = ipnet
 	}
 }
 
@@ -132,6 +114,32 @@ func addUserPasswd(val string) {
 	auth.user[user] = au
 }
 
+func initAuthBackend() {
+	auth.backend = make(map[string]authenticator)
+	auth.listener = make(map[string]authenticator)
+	for _, val := range config.AuthBackend {
+		arr := strings.Fields(val)
+		if len(arr) != 2 {
+			Fatal("authBackend syntax wrong, should be <name> <backend>:", val)
+		}
+		if _, ok := auth.backend[arr[0]]; ok {
+			Fatal("duplicate authBackend:", arr[0])
+		}
+		auth.backend[arr[0]] = newAuthBackend(arr[1])
+	}
+	for _, val := range config.ListenAuth {
+		arr := strings.Fields(val)
+		if len(arr) != 2 {
+			Fatal("listenAuth syntax wrong, should be <listen address> <backend name>:", val)
+		}
+		a, ok := auth.backend[arr[1]]
+		if !ok {
+			Fatal("listenAuth: no such authBackend", arr[1])
+		}
+		auth.listener[arr[0]] = a
+	}
+}
+
 func loadUserPasswdFile(file string) {
 	if file == "" {
 		return
@@ -153,8 +161,10 @@ func initAuth() {
 	if config.UserPasswd != "" ||
 		config.UserPasswdFile != "" ||
 		config.AllowedClient != "" {
-		auth.required = true
-	} else {
+		auth.static = true
+	}
+	auth.required = auth.static || len(config.ListenAuth) != 0
+	if !auth.required {
 		return
 	}
 
@@ -163,8 +173,9 @@ func initAuth() {
 	addUserPasswd(config.UserPasswd)
 	loadUserPasswdFile(config.UserPasswdFile)
 	parseAllowedClient(config.AllowedClient)
+	initAuthBackend()
 
-	auth.authed = NewTimeoutSet(time.Duration(config.AuthTimeout) * time.Hour)
+	auth.authed = NewTimeoutSet(config.AuthTimeout)
 
 	rawTemplate := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
 		"Proxy-Authenticate: Digest realm=\"" + authRealm + "\", nonce=\"{{.Nonce}}\", qop=\"auth\"\r\n" +
@@ -179,22 +190,56 @@ func initAuth() {
 
 // Return err = nil if authentication succeed. nonce would be not empty if
 // authentication is needed, and should be passed back on subsequent call.
+//
+// In conn auth mode, the default, each client connection is authenticated
+// and the user is bound to the connection. Backend results are cached per
+// user by cachedAuth. In ip auth mode, the result is cached for the client
+// ip, so clients behind the same NAT share it without credentials.
 func Authenticate(conn *clientConn, r *Request) (err error) {
 	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	if auth.authed.has(clientIP) {
-		debug.Printf("%s has already authed\n", clientIP)
-		return
+	if config.AuthMode == authModeIP {
+		if user, ok := auth.authed.get(clientIP); ok {
+			debug.Printf("%s has already authed\n", clientIP)
+			conn.user = user
+			return
+		}
 	}
 	if authIP(clientIP) { // IP is allowed
 		return
 	}
 	err = authUserPasswd(conn, r)
 	if err == nil {
-		auth.authed.add(clientIP)
+		conn.authHeader = r.ProxyAuthorization
+		if config.AuthMode == authModeIP {
+			auth.authed.addValue(clientIP, conn.user)
+		}
 	}
 	return
 }
 
+// reauthenticate checks credential sent on subsequent requests of an
+// authenticated connection in conn auth mode. Credential of another user is
+// rejected as the user is bound to the connection.
+func reauthenticate(conn *clientConn, r *Request) error {
+	if r.ProxyAuthorization == "" || r.ProxyAuthorization == conn.authHeader {
+		return nil
+	}
+	user := conn.user
+	if err := authUserPasswd(conn, r); err != nil {
+		conn.user = user
+		return err
+	}
+	if conn.user != user {
+		newUser := conn.user
+		conn.user = user
+		sendErrorPage(conn, statusForbidden, "User changed",
+			"Please use a new connection for another user.")
+		return fmt.Errorf("auth: user %s changed to %s on the same connection", user, newUser)
+	}
+	conn.authHeader = r.ProxyAuthorization
+	return nil
+}
+
 // authIP checks whether the client ip address matches one in allowedClient.
 // It uses a sequential search.
 func authIP(clientIP string) bool {
@@ -204,7 +249,7 @@ func authIP(clientIP string) bool {
 	}
 
 	for _, na := range auth.allowedClient {
-		if ip.Mask(na.mask).Equal(na.ip) {
+		if na.Contains(ip) {
 			debug.Printf("client ip %s allowed\n", clientIP)
 			return true
 		}
@@ -240,13 +285,27 @@ func checkProxyAuthorization(conn *clientConn, r *Request) error {
 	if len(arr) != 2 {
 		return errors.New("auth: malformed ProxyAuthorization header: " + r.ProxyAuthorization)
 	}
+	a := authFor(conn.proxy)
+	_, isStatic := a.(staticAuth)
 	authMethod := strings.ToLower(strings.TrimSpace(arr[0]))
-	if authMethod == "digest" {
-		return authDigest(conn, r, arr[1])
-	} else if authMethod == "basic" {
-		return authBasic(conn, arr[1])
+	switch authMethod {
+	case "digest":
+		// Digest needs plain text password, only available for static users.
+		if isStatic {
+			return authDigest(conn, r, arr[1])
+		}
+	case "basic":
+		return authBasic(conn, a, arr[1])
+	case "bearer":
+		if ta, ok := a.(tokenAuthenticator); ok {
+			user, err := ta.checkToken(strings.TrimSpace(arr[1]))
+			if err == nil {
+				conn.user = user
+			}
+			return err
+		}
 	}
-	return errors.New("auth: method " + arr[0] + " unsupported, must use digest")
+	return errors.New("auth: method " + arr[0] + " unsupported for this listener")
 }
 
 func authPort(conn *clientConn, user string, au *authUser) error {
@@ -262,23 +321,27 @@ func authPort(conn *clientConn, user string, au *authUser) error {
 	return nil
 }
 
-func authBasic(conn *clientConn, userPasswd string) error {
+func authBasic(conn *clientConn, a authenticator, userPasswd string) error {
 	b64, err := base64.StdEncoding.DecodeString(userPasswd)
 	if err != nil {
 		return errors.New("auth:" + err.Error())
 	}
-	arr := strings.Split(string(b64), ":")
+	arr := strings.SplitN(string(b64), ":", 2)
 	if len(arr) != 2 {
 		return errors.New("auth: malformed basic auth user:passwd")
 	}
 	user := arr[0]
 	passwd := arr[1]
 
-	au, ok := auth.user[user]
-	if !ok || au.passwd != passwd {
-		return errAuthRequired
+	if err = a.checkPasswd(conn.Conn, user, passwd); err != nil {
+		if err != errAuthRequired {
+			errl.Printf("cli(%s) auth: user %s %v\n", conn.RemoteAddr(), user, err)
+			err = errAuthRequired
+		}
+		return err
 	}
-	return authPort(conn, user, au)
+	conn.user = user
+	return nil
 }
 
 func authDigest(conn *clientConn, r *Request, keyVal string) error {
@@ -320,6 +383,7 @@ func authDigest(conn *clientConn, r *Request, keyVal string) error {
 		errl.Printf("cli(%s) auth: digest not match, maybe password wrong", conn.RemoteAddr())
 		return errAuthRequired
 	}
+	conn.user = user
 	return nil
 }
 
@@ -336,6 +400,10 @@ func authUserPasswd(conn *clientConn, r *Request) (err error) {
 		// auth required to through the following
 	}
 
+	if _, ok := authFor(conn.proxy).(staticAuth); !ok {
+		return sendAuthChallenge(conn)
+	}
+
 	nonce := genNonce()
 	data := struct {
 		Nonce string
@@ -354,3 +422,21 @@ func authUserPasswd(conn *clientConn, r *Request) (err error) {
 	}
 	return errAuthRequired
 }
+
+// sendAuthChallenge asks client to use basic authentication (or bearer token)
+// for backends without plain text password.
+func sendAuthChallenge(conn *clientConn) error {
+	scheme := "Basic"
+	if _, ok := authFor(conn.proxy).(tokenAuthenticator); ok {
+		scheme = "Bearer"
+	}
+	resp := "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+		"Proxy-Authenticate: " + scheme + " realm=\"" + authRealm + "\"\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Content-Length: " + fmt.Sprintf("%d", len(authRawBodyTmpl)) + "\r\n\r\n" + authRawBodyTmpl
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return fmt.Errorf("send auth response error: %v", err)
+	}
+	return errAuthRequired
+}
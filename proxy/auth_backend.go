@@ -0,0 +1,587 @@
+// Authentication backends.
+//
+// Backends are defined with authBackend and selected for listeners with
+// listenAuth:
+//
+//	authBackend = files htpasswd:~/.cow/htpasswd
+//	authBackend = corp ldap://ldap.example.com:389/uid=%s,ou=people,dc=example,dc=com
+//	authBackend = api http://127.0.0.1:8080/auth
+//	authBackend = robots token:~/.cow/tokens
+//	listenAuth = 0.0.0.0:7777 corp
+//
+// Listeners without listenAuth use userPasswd and userPasswdFile.
+//
+//	authMode = conn   # default, authenticate each client connection
+//	authMode = ip     # trust client ip for authTimeout after authenticated
+//
+// Successful results of htpasswd, ldap and http backends are cached per user
+// for authTimeout, so backends are not queried for each new connection. The
+// ip mode lets any client behind the same NAT as an authenticated user in
+// without credentials, only use it when clients have their own address.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	// http is taken by http parent config parsing
+	nethttp "net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const authBackendTimeout = 5 * time.Second
+
+// authenticator verifies user name and password. It should return
+// errAuthRequired if user or password is wrong, other errors means the
+// backend has problem.
+type authenticator interface {
+	checkPasswd(conn net.Conn, user, passwd string) error
+}
+
+// Backends accepting bearer token in Proxy-Authorization also implement this.
+type tokenAuthenticator interface {
+	checkToken(token string) (user string, err error)
+}
+
+// authFor returns the authenticator for the listener, nil if the listener
+// does not require authentication.
+func authFor(p Proxy) authenticator {
+	if p != nil {
+		if a, ok := auth.listener[p.Addr()]; ok {
+			return a
+		}
+	}
+	if auth.static {
+		return staticAuth{}
+	}
+	return nil
+}
+
+func newAuthBackend(val string) authenticator {
+	switch {
+	case strings.HasPrefix(val, "htpasswd:"):
+		ha, err := newHtpasswdAuth(expandTilde(val[len("htpasswd:"):]))
+		if err != nil {
+			Fatal("authBackend htpasswd:", err)
+		}
+		return newCachedAuth(ha)
+	case strings.HasPrefix(val, "token:"):
+		ta, err := newTokenAuth(expandTilde(val[len("token:"):]))
+		if err != nil {
+			Fatal("authBackend token:", err)
+		}
+		return ta
+	case strings.HasPrefix(val, "ldap://"), strings.HasPrefix(val, "ldaps://"):
+		la, err := newLDAPAuth(val)
+		if err != nil {
+			Fatal("authBackend ldap:", err)
+		}
+		return newCachedAuth(la)
+	case strings.HasPrefix(val, "http://"), strings.HasPrefix(val, "https://"):
+		return newCachedAuth(&httpAuth{
+			url:    val,
+			client: &nethttp.Client{Timeout: authBackendTimeout},
+		})
+	}
+	Fatal("unknown authBackend", val)
+	return nil
+}
+
+// staticAuth uses users from userPasswd and userPasswdFile.
+type staticAuth struct{}
+
+func (staticAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	au, ok := auth.user[user]
+	if !ok || au.passwd != passwd {
+		return errAuthRequired
+	}
+	if au.port != 0 && !authLocalPort(conn, au.port) {
+		errl.Printf("cli(%s) auth: user %s port not match\n", conn.RemoteAddr(), user)
+		return errAuthRequired
+	}
+	return nil
+}
+
+// cachedAuth caches successful authentication result for each user, so
+// remote backends are not queried upon each new client.
+type cachedAuth struct {
+	authenticator
+	passed *TimeoutSet // user -> hash of password
+}
+
+func newCachedAuth(a authenticator) *cachedAuth {
+	return &cachedAuth{a, NewTimeoutSet(config.AuthTimeout)}
+}
+
+func passwdHash(passwd string) string {
+	h := sha256.Sum256([]byte(passwd))
+	return hex.EncodeToString(h[:])
+}
+
+func (ca *cachedAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	h := passwdHash(passwd)
+	if v, ok := ca.passed.get(user); ok && v == h {
+		return nil
+	}
+	if err := ca.authenticator.checkPasswd(conn, user, passwd); err != nil {
+		return err
+	}
+	ca.passed.addValue(user, h)
+	return nil
+}
+
+// htpasswdAuth supports bcrypt, SHA1, APR1 and plain text passwords
+// generated by Apache htpasswd. The file is reloaded when modified.
+type htpasswdAuth struct {
+	path string
+	sync.RWMutex
+	mtime time.Time
+	user  map[string]string
+}
+
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	ha := &htpasswdAuth{path: path}
+	return ha, ha.reload()
+}
+
+func (ha *htpasswdAuth) reload() error {
+	fi, err := os.Stat(ha.path)
+	if err != nil {
+		return err
+	}
+	ha.RLock()
+	modified := !fi.ModTime().Equal(ha.mtime)
+	ha.RUnlock()
+	if !modified {
+		return nil
+	}
+	f, err := os.Open(ha.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	user := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.SplitN(line, ":", 2)
+		if len(arr) != 2 {
+			continue
+		}
+		user[arr[0]] = arr[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	ha.Lock()
+	ha.user = user
+	ha.mtime = fi.ModTime()
+	ha.Unlock()
+	return nil
+}
+
+func (ha *htpasswdAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	if err := ha.reload(); err != nil {
+		errl.Println("reload htpasswd:", err)
+	}
+	ha.RLock()
+	hash, ok := ha.user[user]
+	ha.RUnlock()
+	if !ok || !checkHtpasswd(hash, passwd) {
+		return errAuthRequired
+	}
+	return nil
+}
+
+func checkHtpasswd(hash, passwd string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(passwd)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		h := sha1.Sum([]byte(passwd))
+		return secureEqual(hash[len("{SHA}"):], base64.StdEncoding.EncodeToString(h[:]))
+	case strings.HasPrefix(hash, "$apr1$"):
+		arr := strings.SplitN(hash[len("$apr1$"):], "$", 2)
+		if len(arr) != 2 {
+			return false
+		}
+		return secureEqual(hash, apr1Crypt(passwd, arr[0]))
+	}
+	// crypt(3) is not supported, treat as plain text.
+	return secureEqual(hash, passwd)
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1Crypt implements Apache's MD5 based password algorithm.
+func apr1Crypt(passwd, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(passwd)
+
+	alt := md5.Sum([]byte(passwd + salt + passwd))
+	h := md5.New()
+	h.Write([]byte(passwd + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 == 1 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 == 1 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(magic + salt + "$")
+	enc := func(a, b, c byte, n int) {
+		v := uint(a)<<16 | uint(b)<<8 | uint(c)
+		for ; n > 0; n-- {
+			buf.WriteByte(apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	enc(sum[0], sum[6], sum[12], 4)
+	enc(sum[1], sum[7], sum[13], 4)
+	enc(sum[2], sum[8], sum[14], 4)
+	enc(sum[3], sum[9], sum[15], 4)
+	enc(sum[4], sum[10], sum[5], 4)
+	enc(0, 0, sum[11], 2)
+	return buf.String()
+}
+
+// httpAuth asks an external HTTP service. The service gets a GET request with
+// the user's credential in basic Authorization header and client address in
+// X-Real-IP, and should respond 2xx to accept, 401 or 403 to reject.
+type httpAuth struct {
+	url    string
+	client *nethttp.Client
+}
+
+func (ha *httpAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	req, err := nethttp.NewRequest("GET", ha.url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(user, passwd)
+	if conn != nil {
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		req.Header.Set("X-Real-IP", clientIP)
+	}
+	resp, err := ha.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("auth: http backend %v", err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == nethttp.StatusUnauthorized || resp.StatusCode == nethttp.StatusForbidden:
+		return errAuthRequired
+	}
+	return fmt.Errorf("auth: http backend response %s", resp.Status)
+}
+
+// tokenAuth accepts static bearer tokens. Each line of the token file is
+// "token user".
+type tokenAuth struct {
+	token map[string]string
+}
+
+func newTokenAuth(path string) (*tokenAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ta := &tokenAuth{make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		arr := strings.Fields(scanner.Text())
+		if len(arr) == 0 || arr[0][0] == '#' {
+			continue
+		}
+		if len(arr) != 2 {
+			return nil, fmt.Errorf("token file %s: line should be \"token user\"", path)
+		}
+		ta.token[arr[0]] = arr[1]
+	}
+	return ta, scanner.Err()
+}
+
+func (ta *tokenAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	// Allow clients only supporting basic auth to send token as password.
+	if u, ok := ta.token[passwd]; ok && u == user {
+		return nil
+	}
+	return errAuthRequired
+}
+
+func (ta *tokenAuth) checkToken(token string) (string, error) {
+	if user, ok := ta.token[token]; ok {
+		return user, nil
+	}
+	return "", errAuthRequired
+}
+
+// ldapAuth does LDAP simple bind with the user's DN and password. Only the
+// bind operation is needed, so a minimal BER encoder is used instead of a
+// full LDAP client.
+type ldapAuth struct {
+	addr   string
+	useTLS bool
+	dnTmpl string // %s is replaced with escaped user name
+}
+
+func newLDAPAuth(val string) (*ldapAuth, error) {
+	la := &ldapAuth{}
+	// Don't use net/url as "%s" in DN is not valid escape.
+	if strings.HasPrefix(val, "ldaps://") {
+		la.useTLS = true
+		val = val[len("ldaps://"):]
+	} else {
+		val = val[len("ldap://"):]
+	}
+	i := strings.IndexByte(val, '/')
+	if i == -1 || !strings.Contains(val[i+1:], "%s") {
+		return nil, errors.New("should be ldap://host:port/<bind dn with %s as user>")
+	}
+	la.addr, la.dnTmpl = val[:i], val[i+1:]
+	if _, _, err := net.SplitHostPort(la.addr); err != nil {
+		port := "389"
+		if la.useTLS {
+			port = "636"
+		}
+		la.addr = net.JoinHostPort(la.addr, port)
+	}
+	return la, nil
+}
+
+// ldapEscapeDN escapes special characters in DN attribute value, RFC 4514.
+func ldapEscapeDN(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) != -1,
+			(c == '#' || c == ' ') && i == 0,
+			c == ' ' && i == len(s)-1:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < 0x20:
+			fmt.Fprintf(&buf, "\\%02x", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest  = 0x60 // [APPLICATION 0] constructed
+	ldapBindResponse = 0x61 // [APPLICATION 1] constructed
+	ldapUnbind       = 0x42 // [APPLICATION 2] primitive
+	ldapAuthSimple   = 0x80 // [0] primitive
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func berInt(tag byte, v int) []byte {
+	// Only small non-negative integers are used.
+	if v < 0x80 {
+		return berTLV(tag, []byte{byte(v)})
+	}
+	return berTLV(tag, []byte{0, byte(v >> 8), byte(v)})
+}
+
+// berRead reads a TLV from r.
+func berRead(r io.Reader) (tag byte, content []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	tag = hdr[0]
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		nb := n & 0x7f
+		if nb == 0 || nb > 3 {
+			return 0, nil, errors.New("ber: unsupported length")
+		}
+		lb := make([]byte, nb)
+		if _, err = io.ReadFull(r, lb); err != nil {
+			return
+		}
+		n = 0
+		for _, b := range lb {
+			n = n<<8 | int(b)
+		}
+	}
+	content = make([]byte, n)
+	_, err = io.ReadFull(r, content)
+	return
+}
+
+// berParse parses a TLV at the beginning of b.
+func berParse(b []byte) (tag byte, content, rest []byte, err error) {
+	rd := bytes.NewReader(b)
+	if tag, content, err = berRead(rd); err != nil {
+		return
+	}
+	return tag, content, b[len(b)-rd.Len():], nil
+}
+
+func berParseInt(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+func genLDAPBindRequest(msgID int, dn, passwd string) []byte {
+	bind := berInt(berInteger, 3) // version
+	bind = append(bind, berTLV(berOctetString, []byte(dn))...)
+	bind = append(bind, berTLV(ldapAuthSimple, []byte(passwd))...)
+	msg := berInt(berInteger, msgID)
+	msg = append(msg, berTLV(ldapBindRequest, bind)...)
+	return berTLV(berSequence, msg)
+}
+
+// parseLDAPBindResponse returns the result code and diagnostic message.
+func parseLDAPBindResponse(r io.Reader) (code int, msg string, err error) {
+	tag, content, err := berRead(r)
+	if err != nil {
+		return
+	}
+	if tag != berSequence {
+		return 0, "", errors.New("ldap: malformed response")
+	}
+	tag, _, rest, err := berParse(content) // message id
+	if err != nil || tag != berInteger {
+		return 0, "", errors.New("ldap: malformed message id")
+	}
+	if tag, content, _, err = berParse(rest); err != nil || tag != ldapBindResponse {
+		return 0, "", errors.New("ldap: not bind response")
+	}
+	tag, codeb, rest, err := berParse(content)
+	if err != nil || tag != berEnumerated {
+		return 0, "", errors.New("ldap: malformed result code")
+	}
+	code = berParseInt(codeb)
+	if _, _, rest, err = berParse(rest); err == nil { // matched dn
+		if _, diag, _, err := berParse(rest); err == nil {
+			msg = string(diag)
+		}
+	}
+	return code, msg, nil
+}
+
+func (la *ldapAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	// Empty password means unauthenticated bind, which always succeeds.
+	if user == "" || passwd == "" {
+		return errAuthRequired
+	}
+	var c net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: authBackendTimeout}
+	if la.useTLS {
+		host, _, _ := net.SplitHostPort(la.addr)
+		c, err = tls.DialWithDialer(dialer, "tcp", la.addr, &tls.Config{ServerName: host})
+	} else {
+		c, err = dialer.Dial("tcp", la.addr)
+	}
+	if err != nil {
+		return fmt.Errorf("auth: ldap %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(authBackendTimeout))
+
+	dn := strings.Replace(la.dnTmpl, "%s", ldapEscapeDN(user), -1)
+	if _, err = c.Write(genLDAPBindRequest(1, dn, passwd)); err != nil {
+		return fmt.Errorf("auth: ldap %v", err)
+	}
+	code, msg, err := parseLDAPBindResponse(c)
+	if err != nil {
+		return err
+	}
+	c.Write(berTLV(berSequence, append(berInt(berInteger, 2), ldapUnbind, 0)))
+	switch code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errAuthRequired
+	}
+	return fmt.Errorf("auth: ldap bind result %d %s", code, msg)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckHtpasswd(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("secret"))
+	sha := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+
+	testData := []struct {
+		hash   string
+		passwd string
+		ok     bool
+	}{
+		{string(bc), "secret", true},
+		{string(bc), "wrong", false},
+		{sha, "secret", true},
+		{sha, "wrong", false},
+		{"$apr1$rOioh4Wh$m5Xihq8Geii9fCC0S7.KC1", "secret", true},
+		{"$apr1$rOioh4Wh$m5Xihq8Geii9fCC0S7.KC1", "wrong", false},
+		{"secret", "secret", true},
+		{"secret", "secre", false},
+	}
+	for _, td := range testData {
+		if ok := checkHtpasswd(td.hash, td.passwd); ok != td.ok {
+			t.Errorf("checkHtpasswd(%q, %q) got %v", td.hash, td.passwd, ok)
+		}
+	}
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\nalice:$apr1$rOioh4Wh$m5Xihq8Geii9fCC0S7.KC1\nbob:plain\n")
+	f.Close()
+
+	ha, err := newHtpasswdAuth(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ha.checkPasswd(nil, "alice", "secret"); err != nil {
+		t.Error("alice should pass:", err)
+	}
+	if err := ha.checkPasswd(nil, "bob", "wrong"); err != errAuthRequired {
+		t.Error("bob with wrong password got", err)
+	}
+	if err := ha.checkPasswd(nil, "carol", "secret"); err != errAuthRequired {
+		t.Error("unknown user got", err)
+	}
+
+	// Modified file should be reloaded.
+	ioutil.WriteFile(f.Name(), []byte("carol:secret\n"), 0644)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(f.Name(), later, later)
+	if err := ha.checkPasswd(nil, "carol", "secret"); err != nil {
+		t.Error("carol should pass after reload:", err)
+	}
+	if err := ha.checkPasswd(nil, "alice", "secret"); err != errAuthRequired {
+		t.Error("alice should be removed after reload, got", err)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	f, err := ioutil.TempFile("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("abc123 alice\n\n# disabled\n")
+	f.Close()
+
+	ta, err := newTokenAuth(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := ta.checkToken("abc123"); err != nil || user != "alice" {
+		t.Errorf("checkToken got %s %v", user, err)
+	}
+	if _, err := ta.checkToken("xyz"); err != errAuthRequired {
+		t.Error("invalid token got", err)
+	}
+	if err := ta.checkPasswd(nil, "alice", "abc123"); err != nil {
+		t.Error("token as password should pass:", err)
+	}
+	if err := ta.checkPasswd(nil, "bob", "abc123"); err != errAuthRequired {
+		t.Error("token of other user got", err)
+	}
+}
+
+type countAuth struct {
+	n int
+}
+
+func (ca *countAuth) checkPasswd(conn net.Conn, user, passwd string) error {
+	ca.n++
+	if passwd != "secret" {
+		return errAuthRequired
+	}
+	return nil
+}
+
+func TestCachedAuth(t *testing.T) {
+	ca := &countAuth{}
+	a := &cachedAuth{ca, NewTimeoutSet(time.Minute)}
+	for i := 0; i < 3; i++ {
+		if err := a.checkPasswd(nil, "alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ca.n != 1 {
+		t.Errorf("backend should be called once, got %d", ca.n)
+	}
+	if err := a.checkPasswd(nil, "alice", "wrong"); err != errAuthRequired {
+		t.Error("wrong password should not use cache, got", err)
+	}
+	if ca.n != 2 {
+		t.Errorf("backend should be called for wrong password, got %d", ca.n)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	ts := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		user, passwd, ok := r.BasicAuth()
+		switch {
+		case !ok:
+			w.WriteHeader(nethttp.StatusBadRequest)
+		case user == "alice" && passwd == "secret":
+			w.WriteHeader(nethttp.StatusNoContent)
+		case user == "broken":
+			w.WriteHeader(nethttp.StatusInternalServerError)
+		default:
+			w.WriteHeader(nethttp.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	ha := &httpAuth{url: ts.URL, client: &nethttp.Client{Timeout: time.Second}}
+	if err := ha.checkPasswd(nil, "alice", "secret"); err != nil {
+		t.Error("alice should pass:", err)
+	}
+	if err := ha.checkPasswd(nil, "alice", "wrong"); err != errAuthRequired {
+		t.Error("wrong password got", err)
+	}
+	if err := ha.checkPasswd(nil, "broken", "x"); err == nil || err == errAuthRequired {
+		t.Error("server error should be reported, got", err)
+	}
+}
+
+// fakeLDAPServer accepts one bind per connection and responds with success
+// only for the expected DN and password.
+func fakeLDAPServer(t *testing.T, dn, passwd string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				_, msg, err := berRead(c)
+				if err != nil {
+					return
+				}
+				_, id, rest, _ := berParse(msg)
+				_, bind, _, _ := berParse(rest)
+				_, _, rest, _ = berParse(bind) // version
+				_, gotDN, rest, _ := berParse(rest)
+				_, gotPasswd, _, _ := berParse(rest)
+				code := ldapInvalidCredentials
+				if string(gotDN) == dn && string(gotPasswd) == passwd {
+					code = ldapSuccess
+				}
+				resp := berInt(berEnumerated, code)
+				resp = append(resp, berTLV(berOctetString, nil)...)
+				resp = append(resp, berTLV(berOctetString, []byte("diag"))...)
+				resp = append(berTLV(berInteger, id), berTLV(ldapBindResponse, resp)...)
+				c.Write(berTLV(berSequence, resp))
+			}(c)
+		}
+	}()
+	return ln
+}
+
+func TestLDAPAuth(t *testing.T) {
+	ln := fakeLDAPServer(t, `uid=alice\,x,ou=people,dc=example,dc=com`, "secret")
+	defer ln.Close()
+
+	la, err := newLDAPAuth("ldap://" + ln.Addr().String() + "/uid=%s,ou=people,dc=example,dc=com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := la.checkPasswd(nil, "alice,x", "secret"); err != nil {
+		t.Error("alice should pass:", err)
+	}
+	if err := la.checkPasswd(nil, "alice,x", "wrong"); err != errAuthRequired {
+		t.Error("wrong password got", err)
+	}
+	if err := la.checkPasswd(nil, "alice,x", ""); err != errAuthRequired {
+		t.Error("empty password got", err)
+	}
+
+	if _, err := newLDAPAuth("ldap://localhost/ou=people"); err == nil {
+		t.Error("DN without user placeholder should be rejected")
+	}
+	la, _ = newLDAPAuth("ldaps://ldap.example.com/uid=%s")
+	if la.addr != "ldap.example.com:636" || !la.useTLS {
+		t.Error("ldaps default port wrong:", la.addr)
+	}
+}
+
+func TestLDAPEscapeDN(t *testing.T) {
+	testData := []struct {
+		val    string
+		escape string
+	}{
+		{"alice", "alice"},
+		{"a,b+c", `a\,b\+c`},
+		{"#x ", `\#x\ `},
+		{" a b", `\ a b`},
+		{"a\x00", `a\00`},
+	}
+	for _, td := range testData {
+		if s := ldapEscapeDN(td.val); s != td.escape {
+			t.Errorf("ldapEscapeDN(%q) got %q, want %q", td.val, s, td.escape)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func basicAuthHeader(user, passwd string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+passwd))
+}
+
+func TestReauthenticate(t *testing.T) {
+	savedAuth, savedUserPasswd := auth, config.UserPasswd
+	defer func() {
+		auth, config.UserPasswd = savedAuth, savedUserPasswd
+	}()
+	config.UserPasswd = "alice:secret"
+	initAuth()
+	addUserPasswd("bob:secret")
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	// Discard error page and auth challenge.
+	go ioutil.ReadAll(cli)
+	c := newClientConn(srv, nil)
+	defer srv.Close()
+
+	var r Request
+	r.ProxyAuthorization = basicAuthHeader("alice", "secret")
+	if err := checkProxyAuthorization(c, &r); err != nil {
+		t.Fatal("alice should pass:", err)
+	}
+	c.authHeader = r.ProxyAuthorization
+
+	// Request without credential or with the same credential passes.
+	r.ProxyAuthorization = ""
+	if err := reauthenticate(c, &r); err != nil {
+		t.Error("request without credential got", err)
+	}
+	r.ProxyAuthorization = c.authHeader
+	if err := reauthenticate(c, &r); err != nil {
+		t.Error("same credential got", err)
+	}
+
+	r.ProxyAuthorization = basicAuthHeader("alice", "wrong")
+	if err := reauthenticate(c, &r); err != errAuthRequired {
+		t.Error("wrong password got", err)
+	}
+	if c.user != "alice" {
+		t.Error("user should not change after failed auth, got", c.user)
+	}
+
+	r.ProxyAuthorization = basicAuthHeader("bob", "secret")
+	if err := reauthenticate(c, &r); err == nil {
+		t.Error("changing user on the same connection should fail")
+	}
+	if c.user != "alice" {
+		t.Error("user should be bound to connection, got", c.user)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	savedAuth, savedUserPasswd, savedTimeout := auth, config.UserPasswd, config.AuthTimeout
+	defer func() {
+		auth, config.UserPasswd, config.AuthTimeout = savedAuth, savedUserPasswd, savedTimeout
+	}()
+	config.UserPasswd = "alice:secret"
+	config.AuthTimeout = 2 * time.Hour
+	initAuth()
+	if auth.authed.timeout != config.AuthTimeout {
+		t.Errorf("authed client should expire after %v, got %v", config.AuthTimeout, auth.authed.timeout)
+	}
+}
+
+// tcpClientConn returns client connection from 127.0.0.1, and the peer
+// connection of client.
+func tcpClientConn(t *testing.T) (*clientConn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cli, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newClientConn(srv, nil), cli
+}
+
+func TestAuthDefaultConnMode(t *testing.T) {
+	savedConfig, savedAuth := config, auth
+	defer func() {
+		config, auth = savedConfig, savedAuth
+	}()
+	initConfig("")
+	config.UserPasswd = "alice:secret"
+	initAuth()
+
+	c1, cli1 := tcpClientConn(t)
+	defer cli1.Close()
+	defer c1.Close()
+	var r Request
+	r.ProxyAuthorization = basicAuthHeader("alice", "secret")
+	if err := Authenticate(c1, &r); err != nil {
+		t.Fatal("alice should pass:", err)
+	}
+	if auth.authed.has("127.0.0.1") {
+		t.Error("client ip should not be cached by default")
+	}
+
+	// Another connection from the same ip without credential.
+	c2, cli2 := tcpClientConn(t)
+	defer cli2.Close()
+	resp := make(chan string, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(cli2)
+		resp <- string(b)
+	}()
+	r.ProxyAuthorization = ""
+	if err := Authenticate(c2, &r); err == nil {
+		t.Error("connection without credential should not pass")
+	}
+	c2.Close()
+	if s := <-resp; !strings.HasPrefix(s, "HTTP/1.1 407 ") {
+		t.Errorf("connection without credential should get 407, got %q", s)
+	}
+}
+
+func TestAuthModeConfig(t *testing.T) {
+	saved := config.AuthMode
+	defer func() { config.AuthMode = saved }()
+
+	var p configParser
+	p.ParseAuthMode("conn")
+	if config.AuthMode != authModeConn {
+		t.Error("authMode conn not parsed")
+	}
+	p.ParseAuthMode("ip")
+	if config.AuthMode != authModeIP {
+		t.Error("authMode ip not parsed")
+	}
+}
+
+func TestAllowedClient(t *testing.T) {
+	saved := auth.allowedClient
+	defer func() { auth.allowedClient = saved }()
+	parseAllowedClient("127.0.0.1, 192.168.1.0/24, 2001:db8::/32, fd00::1")
+
+	testData := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.2", false},
+		{"192.168.1.20", true},
+		{"::ffff:192.168.1.20", true},
+		{"192.168.2.1", false},
+		{"2001:db8:1::5", true},
+		{"2001:db9::1", false},
+		{"fd00::1", true},
+		{"fd00::2", false},
+	}
+	for _, td := range testData {
+		if authIP(td.ip) != td.allowed {
+			t.Errorf("%s allowed should be %v", td.ip, td.allowed)
+		}
+	}
+}
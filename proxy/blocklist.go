@@ -0,0 +1,404 @@
+// Blocklists reject requests to ad and tracker domains.
+//
+//	blockList = ads https://example.com/hosts 24h  # name, path or url, refresh
+//	blockList = local ~/.cow/block                  # reloaded every 24h by default
+//	blockResponse = 204                             # 403 (default) or 204
+//
+// Lists may be in hosts file ("0.0.0.0 ads.example.com"), AdBlock domain
+// ("||ads.example.com^", "@@||" for exceptions) or plain domain per line
+// format. A listed domain blocks its subdomains too. Matching HTTP requests
+// get the block response, CONNECT requests are reset. SOCKS CONNECT gets
+// "not allowed" reply, and UDP datagrams to blocked hosts are dropped.
+//
+// Downloaded lists are saved in the config directory, so they are still
+// available if downloading fails on the next start.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const (
+	defaultBlockListRefresh = 24 * time.Hour
+	blockListFetchTimeout   = time.Minute
+	blockListMaxSize        = 64 * 1024 * 1024
+
+	routeBlocked = "blocked"
+)
+
+var errBlockedReset = errors.New("connection to blocked site reset")
+
+// domainTrie stores domains by labels from the last one, so a lookup finds
+// whether any listed domain is a suffix of the host. The trie in
+// minio/pkg/trie only enumerates keys under a prefix, which doesn't answer
+// this.
+type domainTrie struct {
+	root domainNode
+	size int
+}
+
+type domainNode struct {
+	child  map[string]*domainNode
+	listed bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{}
+}
+
+func (t *domainTrie) insert(domain string) {
+	n := &t.root
+	for domain != "" {
+		var label string
+		if i := strings.LastIndexByte(domain, '.'); i == -1 {
+			label, domain = domain, ""
+		} else {
+			label, domain = domain[i+1:], domain[:i]
+		}
+		if n.listed {
+			// Parent domain already listed.
+			return
+		}
+		next := n.child[label]
+		if next == nil {
+			if n.child == nil {
+				n.child = make(map[string]*domainNode)
+			}
+			next = &domainNode{}
+			n.child[label] = next
+		}
+		n = next
+	}
+	if !n.listed {
+		n.listed = true
+		n.child = nil // subdomains are covered
+		t.size++
+	}
+}
+
+// match returns whether host or any of its parent domains is in the trie.
+func (t *domainTrie) match(host string) bool {
+	if t == nil {
+		return false
+	}
+	n := &t.root
+	for host != "" {
+		var label string
+		if i := strings.LastIndexByte(host, '.'); i == -1 {
+			label, host = host, ""
+		} else {
+			label, host = host[i+1:], host[:i]
+		}
+		if n = n.child[label]; n == nil {
+			return false
+		}
+		if n.listed {
+			return true
+		}
+	}
+	return false
+}
+
+type blockList struct {
+	name    string
+	src     string // path or url
+	refresh time.Duration
+	hits    int64 // updated atomically
+
+	sync.RWMutex
+	block   *domainTrie
+	allow   *domainTrie
+	updated time.Time
+	err     error // error of last update
+}
+
+func (bl *blockList) isURL() bool {
+	return strings.HasPrefix(bl.src, "http://") || strings.HasPrefix(bl.src, "https://")
+}
+
+func (bl *blockList) cachePath() string {
+	return filepath.Join(config.dir, "blocklist-"+bl.name)
+}
+
+var blockLists []*blockList
+
+// blockStatus is the status of response for blocked requests.
+var blockStatus = 403
+
+func parseBlockListConfig(val string) (*blockList, error) {
+	arr := strings.Fields(val)
+	if len(arr) != 2 && len(arr) != 3 {
+		return nil, errors.New("blockList syntax wrong, should be <name> <path or url> [refresh]")
+	}
+	bl := &blockList{name: arr[0], src: arr[1], refresh: defaultBlockListRefresh}
+	if !bl.isURL() {
+		bl.src = expandTilde(bl.src)
+	}
+	if len(arr) == 3 {
+		d, err := time.ParseDuration(arr[2])
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("blockList %s: invalid refresh %s", bl.name, arr[2])
+		}
+		bl.refresh = d
+	}
+	return bl, nil
+}
+
+func initBlockList() {
+	blockLists = nil
+	names := make(map[string]bool)
+	for _, val := range config.BlockList {
+		bl, err := parseBlockListConfig(val)
+		if err != nil {
+			Fatal(err)
+		}
+		if names[bl.name] {
+			Fatal("duplicate blockList", bl.name)
+		}
+		names[bl.name] = true
+		blockLists = append(blockLists, bl)
+	}
+	if config.BlockResponse != 0 {
+		blockStatus = config.BlockResponse
+	}
+	for _, bl := range blockLists {
+		if err := bl.update(); err != nil {
+			errl.Printf("blockList %s: %v\n", bl.name, err)
+			if bl.isURL() {
+				bl.loadCache()
+			}
+		}
+		go bl.refreshLoop()
+	}
+}
+
+func (bl *blockList) refreshLoop() {
+	for {
+		time.Sleep(bl.refresh)
+		if err := bl.update(); err != nil {
+			errl.Printf("blockList %s: %v\n", bl.name, err)
+		}
+	}
+}
+
+var blockListClient = &nethttp.Client{Timeout: blockListFetchTimeout}
+
+func (bl *blockList) fetch() ([]byte, error) {
+	if !bl.isURL() {
+		return ioutil.ReadFile(bl.src)
+	}
+	resp, err := blockListClient.Get(bl.src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return nil, errors.New("fetch " + bl.src + ": " + resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, blockListMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > blockListMaxSize {
+		return nil, errors.New("fetch " + bl.src + ": list too large")
+	}
+	if err = ioutil.WriteFile(bl.cachePath(), b, 0644); err != nil {
+		errl.Printf("blockList %s save: %v\n", bl.name, err)
+	}
+	return b, nil
+}
+
+func (bl *blockList) update() error {
+	b, err := bl.fetch()
+	if err == nil {
+		err = bl.set(b)
+	}
+	if err != nil {
+		bl.Lock()
+		bl.err = err
+		bl.Unlock()
+	}
+	return err
+}
+
+func (bl *blockList) loadCache() {
+	b, err := ioutil.ReadFile(bl.cachePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			errl.Printf("blockList %s load saved list: %v\n", bl.name, err)
+		}
+		return
+	}
+	if err = bl.set(b); err == nil {
+		info.Printf("blockList %s: using saved list\n", bl.name)
+	}
+}
+
+func (bl *blockList) set(b []byte) error {
+	block, allow, err := parseBlockList(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	bl.Lock()
+	bl.block, bl.allow = block, allow
+	bl.updated = time.Now()
+	bl.err = nil
+	bl.Unlock()
+	debug.Printf("blockList %s: %d domains, %d exceptions\n", bl.name, block.size, allow.size)
+	return nil
+}
+
+// parseBlockList parses list in hosts file, AdBlock or plain domain format.
+// AdBlock rules other than domain rules are ignored.
+func parseBlockList(r io.Reader) (block, allow *domainTrie, err error) {
+	block, allow = newDomainTrie(), newDomainTrie()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			t := block
+			if line[0] == '@' {
+				t, line = allow, line[2:]
+			}
+			// Only rules blocking whole domains, options such as
+			// $third-party restrict the rule and are skipped.
+			line = line[2:]
+			if !strings.HasSuffix(line, "^") || strings.ContainsAny(line, "/*$") {
+				continue
+			}
+			if d := normalizeBlockDomain(line[:len(line)-1]); d != "" {
+				t.insert(d)
+			}
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) > 1 && net.ParseIP(f[0]) != nil {
+			// hosts file
+			for _, h := range f[1:] {
+				if d := normalizeBlockDomain(h); d != "" && d != "localhost" &&
+					d != "broadcasthost" && d != "local" && net.ParseIP(d) == nil {
+					block.insert(d)
+				}
+			}
+			continue
+		}
+		if len(f) == 1 {
+			if d := normalizeBlockDomain(f[0]); d != "" {
+				block.insert(d)
+			}
+		}
+	}
+	return block, allow, scanner.Err()
+}
+
+func normalizeBlockDomain(d string) string {
+	d = strings.TrimSuffix(strings.ToLower(d), ".")
+	if d == "" || strings.ContainsAny(d, "/:*") {
+		return ""
+	}
+	return d
+}
+
+// blockedBy returns name of the list blocking host, or empty string if not
+// blocked.
+func blockedBy(host string) string {
+	if len(blockLists) == 0 {
+		return ""
+	}
+	host = strings.ToLower(host)
+	for _, bl := range blockLists {
+		bl.RLock()
+		blocked := bl.block.match(host) && !bl.allow.match(host)
+		bl.RUnlock()
+		if blocked {
+			atomic.AddInt64(&bl.hits, 1)
+			return bl.name
+		}
+	}
+	return ""
+}
+
+// rejectBlocked sends block response for request to blocked site. Returns
+// non nil error if client connection should be closed.
+func (c *clientConn) rejectBlocked(r *Request) error {
+	if debug {
+		debug.Printf("cli(%s) blocked by %s: %v\n", c.RemoteAddr(), r.blocked, r)
+	}
+	if r.isConnect {
+		conn := c.Conn
+		if pc, ok := conn.(*proxyProtoConn); ok {
+			conn = pc.Conn
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetLinger(0) // send RST on close
+		}
+		return errBlockedReset
+	}
+	if r.hasBody() {
+		sendBody(SinkWriter{}, c.bufRd, int(r.ContLen), r.Chunking)
+	}
+	if blockStatus == 204 {
+		conn := fullHeaderConnectionKeepAlive
+		if !r.ConnectionKeepAlive {
+			conn = fullHeaderConnectionClose
+		}
+		_, err := c.Write([]byte("HTTP/1.1 204 No Content\r\n" + conn + CRLF))
+		return err
+	}
+	sendErrorPage(c, statusForbidden, "Blocked",
+		genErrMsg(r, nil, "Site is in blockList "+r.blocked+"."))
+	return nil
+}
+
+type blockListInfo struct {
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Domains    int    `json:"domains"`
+	Exceptions int    `json:"exceptions"`
+	Hits       int64  `json:"hits"`
+	Updated    string `json:"updated,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func getBlockListInfo() []blockListInfo {
+	lst := make([]blockListInfo, 0, len(blockLists))
+	for _, bl := range blockLists {
+		bi := blockListInfo{
+			Name:   bl.name,
+			Source: bl.src,
+			Hits:   atomic.LoadInt64(&bl.hits),
+		}
+		bl.RLock()
+		if bl.block != nil {
+			bi.Domains, bi.Exceptions = bl.block.size, bl.allow.size
+			bi.Updated = bl.updated.Format(time.RFC3339)
+		}
+		if bl.err != nil {
+			bi.Error = bl.err.Error()
+		}
+		bl.RUnlock()
+		lst = append(lst, bi)
+	}
+	return lst
+}
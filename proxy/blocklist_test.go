@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"io/ioutil"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDomainTrie(t *testing.T) {
+	dt := newDomainTrie()
+	dt.insert("ads.example.com")
+	dt.insert("tracker.org")
+	dt.insert("x.tracker.org") // covered by tracker.org
+	if dt.size != 2 {
+		t.Errorf("trie size %d", dt.size)
+	}
+	testData := []struct {
+		host  string
+		match bool
+	}{
+		{"ads.example.com", true},
+		{"a.ads.example.com", true},
+		{"example.com", false},
+		{"badads.example.com", false},
+		{"tracker.org", true},
+		{"x.tracker.org", true},
+		{"org", false},
+	}
+	for _, td := range testData {
+		if dt.match(td.host) != td.match {
+			t.Errorf("%s match should be %v", td.host, td.match)
+		}
+	}
+	var nilTrie *domainTrie
+	if nilTrie.match("example.com") {
+		t.Error("nil trie should not match")
+	}
+}
+
+func TestParseBlockList(t *testing.T) {
+	const list = `# hosts
+0.0.0.0 ads.example.com tracker.example.com # comment
+127.0.0.1 localhost
+! AdBlock
+[Adblock Plus 2.0]
+||adblock.example.com^
+||thirdparty.example.com^$third-party
+||example.com/banner/*
+@@||good.adblock.example.com^
+plain.example.net.
+`
+	block, allow, err := parseBlockList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []string{"ads.example.com", "tracker.example.com", "adblock.example.com", "plain.example.net"} {
+		if !block.match(h) {
+			t.Errorf("%s should be blocked", h)
+		}
+	}
+	for _, h := range []string{"localhost", "thirdparty.example.com", "example.com"} {
+		if block.match(h) {
+			t.Errorf("%s should not be blocked", h)
+		}
+	}
+	if !allow.match("good.adblock.example.com") || allow.size != 1 {
+		t.Error("exception not parsed")
+	}
+}
+
+func TestBlockList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config
+	defer func() {
+		config = saved
+		blockLists = nil
+		blockStatus = 403
+	}()
+
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, _ *nethttp.Request) {
+		w.Write([]byte("||ads.example.com^\n@@||ok.ads.example.com^\n"))
+	}))
+	defer srv.Close()
+	local := dir + "/local"
+	if err = ioutil.WriteFile(local, []byte("tracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.dir = dir
+	config.BlockList = []string{"ads " + srv.URL + " 1h", "local " + local}
+	config.BlockResponse = 204
+	initBlockList()
+
+	if _, err = os.Stat(blockLists[0].cachePath()); err != nil {
+		t.Error("downloaded list not saved:", err)
+	}
+	if name := blockedBy("x.ADS.example.com"); name != "ads" {
+		t.Errorf("blocked by %q", name)
+	}
+	if name := blockedBy("ok.ads.example.com"); name != "" {
+		t.Errorf("exception blocked by %q", name)
+	}
+	if name := blockedBy("tracker.example.com"); name != "local" {
+		t.Errorf("blocked by %q", name)
+	}
+	info := getBlockListInfo()
+	if len(info) != 2 || info[0].Hits != 1 || info[1].Hits != 1 || info[0].Domains != 1 || info[0].Exceptions != 1 {
+		t.Errorf("blocklist info %+v", info)
+	}
+
+	fc := newFakeConn("GET http://ads.example.com/x.js HTTP/1.1\r\n\r\n")
+	c := newClientConn(fc, nil)
+	defer c.releaseBuf()
+	var r Request
+	if err = parseRequest(c, &r); err != nil {
+		t.Fatal(err)
+	}
+	r.blocked = blockedBy(r.URL.Host)
+	if err = c.rejectBlocked(&r); err != nil {
+		t.Fatal(err)
+	}
+	if s := fc.out.String(); !strings.HasPrefix(s, "HTTP/1.1 204 No Content\r\n") {
+		t.Errorf("block response %q", s)
+	}
+	r.isConnect = true
+	if err = c.rejectBlocked(&r); err != errBlockedReset {
+		t.Error("CONNECT should be reset")
+	}
+}
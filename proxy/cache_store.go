@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Object metadata key holding cache entry, without the "X-Amz-Meta-" prefix.
+const cacheEntryMeta = "Cache-Entry"
+
+// CacheStore stores cached responses as objects, so that multiple proxies can
+// share the cache hosted by the object storage server. Metadata keys don't
+// include the "X-Amz-Meta-" prefix.
+type CacheStore interface {
+	PutObject(name string, r io.Reader, size int64, meta map[string]string) error
+	// GetObject returns object data and metadata.
+	GetObject(name string) (io.ReadCloser, map[string]string, error)
+	StatObject(name string) (map[string]string, error)
+	DeleteObject(name string) error
+}
+
+// objectCache stores each response as an object named by the hash of URL and
+// the variant id. Object data is response header followed by body, and the
+// entry is encoded in object metadata.
+//
+// Variant id is the hash of URL and request header values selected by Vary,
+// so a response is found with a single stat. For responses with Vary, an
+// empty object named by the id without Vary records the header names, and
+// costs another stat.
+//
+// Eviction is left to the object store, e.g. expiry rules of the bucket. 304
+// responses are merged into stored header, which rewrites the object.
+type objectCache struct {
+	store CacheStore
+}
+
+func cacheObjectPrefix(key string) string {
+	h := sha1.Sum([]byte(key))
+	return hex.EncodeToString(h[:]) + "/"
+}
+
+func cacheObjectName(e *cacheEntry) string {
+	return cacheObjectPrefix(e.Key) + e.id
+}
+
+// encodeEntryMeta returns metadata for entry. Header and URL are not included
+// to keep metadata small.
+func encodeEntryMeta(e *cacheEntry) (map[string]string, error) {
+	c := *e
+	if c.Header != nil {
+		c.HeaderLen = len(c.Header)
+	}
+	c.Header, c.Key, c.elem = nil, "", nil
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{cacheEntryMeta: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+func decodeEntryMeta(key, name string, meta map[string]string) (*cacheEntry, error) {
+	var v string
+	for k, val := range meta {
+		if strings.EqualFold(k, cacheEntryMeta) {
+			v = val
+			break
+		}
+	}
+	if v == "" {
+		return nil, errors.New("cache: no entry in metadata of " + name)
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &cacheEntry{}
+	if err = json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	e.Key = key
+	e.id = path.Base(name)
+	return e, nil
+}
+
+func (oc *objectCache) find(key string, reqHeader []byte) *cacheEntry {
+	e := oc.stat(key, cacheEntryID(key, nil))
+	if e == nil || len(e.Vary) == 0 {
+		return e
+	}
+	// Vary names recorded, stat the variant selected by request.
+	vary := make(map[string]string, len(e.Vary))
+	for name := range e.Vary {
+		vary[name], _ = headerValue(reqHeader, name)
+	}
+	if e = oc.stat(key, cacheEntryID(key, vary)); e != nil && e.varyMatch(reqHeader) {
+		return e
+	}
+	return nil
+}
+
+func (oc *objectCache) stat(key, id string) *cacheEntry {
+	name := cacheObjectPrefix(key) + id
+	meta, err := oc.store.StatObject(name)
+	if err != nil {
+		return nil
+	}
+	e, err := decodeEntryMeta(key, name, meta)
+	if err != nil {
+		debug.Println("cache store:", err)
+		oc.store.DeleteObject(name)
+		return nil
+	}
+	return e
+}
+
+func (oc *objectCache) add(e *cacheEntry, tmp string) error {
+	defer os.Remove(tmp)
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if len(e.Vary) != 0 {
+		// Record Vary names for find.
+		names := &cacheEntry{Key: e.Key, Vary: make(map[string]string, len(e.Vary))}
+		for name := range e.Vary {
+			names.Vary[name] = ""
+		}
+		meta, err := encodeEntryMeta(names)
+		if err != nil {
+			return err
+		}
+		name := cacheObjectPrefix(e.Key) + cacheEntryID(e.Key, nil)
+		if err = oc.store.PutObject(name, bytes.NewReader(nil), 0, meta); err != nil {
+			return err
+		}
+	}
+	meta, err := encodeEntryMeta(e)
+	if err != nil {
+		return err
+	}
+	return oc.store.PutObject(cacheObjectName(e), io.MultiReader(bytes.NewReader(e.Header), f),
+		int64(len(e.Header))+e.Size, meta)
+}
+
+// open uses entry in object metadata as it may be updated by other proxies.
+func (oc *objectCache) open(e *cacheEntry) (hdr []byte, age time.Duration, body io.ReadCloser, err error) {
+	name := cacheObjectName(e)
+	body, meta, err := oc.store.GetObject(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	se, err := decodeEntryMeta(e.Key, name, meta)
+	if err != nil {
+		body.Close()
+		return nil, 0, nil, err
+	}
+	hdr = make([]byte, se.HeaderLen)
+	if _, err = io.ReadFull(body, hdr); err != nil {
+		body.Close()
+		return nil, 0, nil, err
+	}
+	return hdr, se.age(time.Now()), body, nil
+}
+
+// revalidated merges 304 response header into stored header as diskCache
+// does, object is rewritten as object data can't be updated in place.
+func (oc *objectCache) revalidated(e *cacheEntry, hdr []byte) {
+	name := cacheObjectName(e)
+	body, meta, err := oc.store.GetObject(name)
+	if err != nil {
+		debug.Println("cache store get:", err)
+		return
+	}
+	defer body.Close()
+	se, err := decodeEntryMeta(e.Key, name, meta)
+	if err != nil {
+		debug.Println("cache store:", err)
+		return
+	}
+	stored := make([]byte, se.HeaderLen)
+	if _, err = io.ReadFull(body, stored); err != nil {
+		debug.Println("cache store read:", err)
+		return
+	}
+	se.Header = mergeHeader(stored, hdr)
+	se.refresh(se.Header)
+	se.Header = removeHeader(se.Header, "age")
+	if meta, err = encodeEntryMeta(se); err == nil {
+		err = oc.store.PutObject(name, io.MultiReader(bytes.NewReader(se.Header), body),
+			int64(len(se.Header))+se.Size, meta)
+	}
+	if err != nil {
+		debug.Println("cache store update:", err)
+	}
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(`public, Max-Age=60, no-cache="Set-Cookie", private`)
+	if cc["max-age"] != "60" || cc["no-cache"] != "Set-Cookie" {
+		t.Errorf("parse cache control got %v", cc)
+	}
+	if _, ok := cc["private"]; !ok {
+		t.Error("private directive not found")
+	}
+	if d, ok := ccDuration(cc, "max-age"); !ok || d != time.Minute {
+		t.Errorf("max-age got %v", d)
+	}
+}
+
+func TestCacheHeaderHelpers(t *testing.T) {
+	hdr := []byte("HTTP/1.1 200 OK\r\nVary: Accept\r\nContent-Length: 2\r\nVary: Cookie\r\nAge: 3\r\n")
+	if v, ok := headerValue(hdr, "vary"); !ok || v != "Accept, Cookie" {
+		t.Errorf("header value got %q", v)
+	}
+	if _, ok := headerValue(hdr, "etag"); ok {
+		t.Error("header value should not find etag")
+	}
+	want := "HTTP/1.1 200 OK\r\nVary: Accept\r\nContent-Length: 2\r\nVary: Cookie\r\n"
+	if s := string(removeHeader(hdr, "age")); s != want {
+		t.Errorf("remove header got %q", s)
+	}
+
+	stored := []byte("HTTP/1.1 200 OK\r\nETag: \"a\"\r\nContent-Length: 2\r\n")
+	update := []byte("HTTP/1.1 304 Not Modified\r\nETag: \"b\"\r\nContent-Length: 0\r\n")
+	want = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nETag: \"b\"\r\n"
+	if s := string(mergeHeader(stored, update)); s != want {
+		t.Errorf("merge header got %q", s)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	date := now.Format(httpTimeFormats[0])
+	testData := []struct {
+		hdr      string
+		lifetime time.Duration
+	}{
+		{"Cache-Control: max-age=60, s-maxage=10\r\n", 10 * time.Second},
+		{"Cache-Control: max-age=60\r\nExpires: " + date + "\r\n", time.Minute},
+		{"Expires: " + now.Add(time.Hour).Format(httpTimeFormats[0]) + "\r\n", time.Hour},
+		{"Expires: 0\r\n", 0},
+		{"Last-Modified: " + now.Add(-10*time.Hour).Format(httpTimeFormats[0]) + "\r\n", time.Hour},
+		{"Last-Modified: " + now.Add(-1000*time.Hour).Format(httpTimeFormats[0]) + "\r\n", maxHeuristicFreshness},
+	}
+	for _, td := range testData {
+		hdr := []byte("HTTP/1.1 200 OK\r\nDate: " + date + "\r\n" + td.hdr)
+		e := &cacheEntry{Status: 200, RespTime: now}
+		e.LastModified, _ = headerValue(hdr, "last-modified")
+		cc, _ := headerValue(hdr, "cache-control")
+		e.setFreshness(hdr, parseCacheControl(cc))
+		if e.Lifetime != td.lifetime {
+			t.Errorf("%q lifetime got %v want %v", td.hdr, e.Lifetime, td.lifetime)
+		}
+	}
+
+	e := &cacheEntry{RespTime: now}
+	e.setFreshness([]byte("Age: 100\r\nDate: "+now.Add(-10*time.Second).Format(httpTimeFormats[0])+"\r\n"), nil)
+	if e.InitialAge != 100*time.Second {
+		t.Errorf("initial age got %v", e.InitialAge)
+	}
+}
+
+// fakeConn reads from rd and records written data.
+type fakeConn struct {
+	net.Conn
+	rd  *strings.Reader
+	out bytes.Buffer
+}
+
+func newFakeConn(s string) *fakeConn {
+	return &fakeConn{rd: strings.NewReader(s)}
+}
+
+func (fc *fakeConn) Read(b []byte) (int, error)         { return fc.rd.Read(b) }
+func (fc *fakeConn) Write(b []byte) (int, error)        { return fc.out.Write(b) }
+func (fc *fakeConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (fc *fakeConn) SetReadDeadline(time.Time) error    { return nil }
+func (fc *fakeConn) SetDeadline(time.Time) error        { return nil }
+func (fc *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testCacheFlow stores a response, serves it from cache, then revalidates it.
+func testCacheFlow(t *testing.T, backend cacheBackend, tmpDir string) {
+	respCache.cacheBackend, respCache.tmpDir, respCache.maxObject = backend, tmpDir, 1<<10
+	defer func() { respCache.cacheBackend = nil }()
+
+	const request = "GET http://www.example.com/a HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n"
+	const body = "hello"
+	lm := time.Now().Add(-time.Hour).UTC().Format(httpTimeFormats[0])
+
+	// do sends request and returns data sent to client and server. Server
+	// responds with resp, or is not contacted if resp is empty.
+	do := func(resp string) (cli, srv string, cr *cacheReq) {
+		cc := newFakeConn(request)
+		c := newClientConn(cc, nil)
+		defer c.releaseBuf()
+		var r Request
+		var rp Response
+		if err := parseRequest(c, &r); err != nil {
+			t.Fatal("parse request:", err)
+		}
+		served, err := c.tryCache(&r, &rp)
+		if err != nil {
+			t.Fatal("serve from cache:", err)
+		}
+		if served != (resp == "") {
+			t.Fatalf("served from cache %v, server response %q", served, resp)
+		}
+		if !served {
+			sc := newFakeConn(resp)
+			sv := newServerConn(sc, "www.example.com:80", nil)
+			sv.Write(r.rawRequest())
+			if err := c.readResponse(sv, &r, &rp); err != nil {
+				t.Fatal("read response:", err)
+			}
+			sv.releaseBuf()
+			srv = sc.out.String()
+		}
+		return cc.out.String(), srv, r.cache
+	}
+
+	cli, _, _ := do("HTTP/1.1 200 OK\r\nCache-Control: max-age=3600\r\nVary: Accept-Encoding\r\n" +
+		"Last-Modified: " + lm + "\r\nContent-Length: 5\r\n\r\n" + body)
+	if !strings.HasSuffix(cli, body) {
+		t.Fatalf("response to client %q", cli)
+	}
+
+	cli, _, cr := do("")
+	if !cr.hit || !strings.HasPrefix(cli, "HTTP/1.1 200 OK\r\n") ||
+		!strings.Contains(cli, "\r\nAge: 0\r\n") || !strings.HasSuffix(cli, body) {
+		t.Errorf("cached response %q", cli)
+	}
+
+	// Make the stored response stale, it should be revalidated.
+	e := backend.find(cr.key, []byte("Accept-Encoding: gzip\r\n"))
+	backend.revalidated(e, []byte("HTTP/1.1 304 Not Modified\r\nCache-Control: max-age=0\r\n"))
+	cli, srv, _ := do("HTTP/1.1 304 Not Modified\r\nCache-Control: max-age=60\r\nETag: \"v2\"\r\n\r\n")
+	if !strings.Contains(srv, "If-Modified-Since: "+lm+"\r\n") {
+		t.Errorf("conditional request %q", srv)
+	}
+	if !strings.HasPrefix(cli, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(cli, body) ||
+		!strings.Contains(cli, "ETag: \"v2\"\r\n") || !strings.Contains(cli, "max-age=60") {
+		t.Errorf("revalidated response should have header from 304 %q", cli)
+	}
+	if e = backend.find(cr.key, []byte("Accept-Encoding: gzip\r\n")); e == nil || e.Lifetime != time.Minute {
+		t.Errorf("entry after revalidation %+v", e)
+	}
+	if backend.find(cr.key, []byte("Accept-Encoding: br\r\n")) != nil {
+		t.Error("should not find response for different variant")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testCacheFlow(t, newDiskCache(dir, 1<<20), dir)
+
+	// Reload from disk.
+	dc := newDiskCache(dir, 1<<20)
+	if err := dc.load(); err != nil {
+		t.Fatal("load cache:", err)
+	}
+	if dc.find("http://www.example.com:80/a", []byte("Accept-Encoding: gzip\r\n")) == nil {
+		t.Error("stored response not loaded")
+	}
+
+	// Eviction.
+	dc.Lock()
+	dc.maxSize = 1
+	dc.evict()
+	dc.Unlock()
+	if dc.lru.Len() != 0 || dc.size != 0 {
+		t.Error("response not evicted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left after eviction", len(files))
+	}
+}
+
+type memObject struct {
+	data []byte
+	meta map[string]string
+}
+
+// memStore is a CacheStore in memory.
+type memStore map[string]*memObject
+
+func (ms memStore) PutObject(name string, r io.Reader, size int64, meta map[string]string) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	ms[name] = &memObject{b, meta}
+	return nil
+}
+
+func (ms memStore) GetObject(name string) (io.ReadCloser, map[string]string, error) {
+	o, ok := ms[name]
+	if !ok {
+		return nil, nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), o.meta, nil
+}
+
+func (ms memStore) StatObject(name string) (map[string]string, error) {
+	o, ok := ms[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return o.meta, nil
+}
+
+func (ms memStore) DeleteObject(name string) error {
+	delete(ms, name)
+	return nil
+}
+
+func TestObjectCache(t *testing.T) {
+	ms := memStore{}
+	testCacheFlow(t, &objectCache{store: ms}, os.TempDir())
+	// Variant response and the object recording Vary names.
+	if len(ms) != 2 {
+		t.Fatalf("store has %d objects", len(ms))
+	}
+	for name, o := range ms {
+		if !strings.HasPrefix(name, cacheObjectPrefix("http://www.example.com:80/a")) {
+			t.Errorf("object name %s", name)
+		}
+		e, err := decodeEntryMeta("", name, o.meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != "" || e.Header != nil || e.HeaderLen+int(e.Size) != len(o.data) {
+			t.Errorf("entry in metadata %+v", e)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+// Capture requests of selected hosts or clients for debugging, and export
+// them as HTTP Archive (HAR 1.2).
+//
+//	capture = example.com,example.org   # hosts to capture, * for all
+//	captureClient = 192.168.1.10/32     # clients to capture
+//	captureBodyLimit = 64K              # max body size kept for each direction
+//	captureMax = 200                    # number of recent requests kept
+//	captureFile = ~/.cow/capture.har    # file written on SIGUSR2
+//
+// If both capture and captureClient are given, request must match both.
+// Captured requests are returned by GET /api/har on the dashboard, or written
+// to captureFile on SIGUSR2.
+//
+// DNS time is measured with a lookup before connecting directly, the time for
+// the connection's own lookup is included in connect time if not cached.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCaptureBodyLimit = 64 * 1024
+	defaultCaptureMax       = 200
+	captureFname            = "capture.har"
+)
+
+var capture struct {
+	sync.Mutex
+	enabled   bool
+	domains   []string
+	clients   []*net.IPNet
+	bodyLimit int
+	entries   []*harEntry // ring buffer
+	next      int         // index for next entry
+}
+
+func initCapture() {
+	capture.domains = config.Capture
+	capture.bodyLimit = int(config.CaptureBodyLimit)
+	capture.entries = make([]*harEntry, 0, config.CaptureMax)
+	capture.clients = nil
+	for _, s := range config.CaptureClient {
+		for _, f := range strings.Split(s, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			ipnet, err := parseIPNet(f)
+			if err != nil {
+				Fatal("captureClient:", err)
+			}
+			capture.clients = append(capture.clients, ipnet)
+		}
+	}
+	capture.enabled = config.CaptureMax > 0 &&
+		(len(capture.domains) != 0 || len(capture.clients) != 0)
+	if capture.enabled {
+		info.Println("capturing requests, max", config.CaptureMax)
+	}
+}
+
+func shouldCapture(c *clientConn, r *Request) bool {
+	if !capture.enabled {
+		return false
+	}
+	if len(capture.domains) != 0 && !hostInDomains(strings.ToLower(r.URL.Host), capture.domains) {
+		return false
+	}
+	if len(capture.clients) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, ipnet := range capture.clients {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureBody keeps the first limit bytes written to it.
+type captureBody struct {
+	bytes.Buffer
+	size  int64
+	limit int
+}
+
+func (b *captureBody) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	if n := b.limit - b.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.Buffer.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// captureReq records a request being captured. All methods can be called on
+// nil, which means the request is not captured.
+type captureReq struct {
+	client string
+	url    string
+	method string
+	header []harNameValue
+	mime   string // content type of request body
+
+	start     time.Time
+	dns       time.Duration // -1 if not looked up
+	connect   time.Duration // -1 if using pooled connection
+	sendStart time.Time
+	sent      time.Time
+	firstByte time.Time
+
+	status     int
+	statusText string
+	respHeader []byte
+
+	reqBody  captureBody
+	respBody captureBody
+}
+
+// startCapture snapshots request line and header before rewriting.
+func startCapture(c *clientConn, r *Request) *captureReq {
+	if !shouldCapture(c, r) {
+		return nil
+	}
+	scheme, port := "http://", "80"
+	if r.mitm {
+		scheme, port = "https://", "443"
+	}
+	host := r.URL.HostPort
+	if r.URL.Port == port {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	cr := &captureReq{
+		client:  c.RemoteAddr().String(),
+		method:  r.Method,
+		url:     scheme + host + r.URL.Path,
+		header:  harHeaders(r.rawHeader()),
+		mime:    headerValueOf(r.rawHeader(), "Content-Type"),
+		start:   time.Now(),
+		dns:     -1,
+		connect: -1,
+	}
+	if r.isConnect {
+		cr.url = r.URL.HostPort
+	}
+	cr.reqBody.limit = capture.bodyLimit
+	cr.respBody.limit = capture.bodyLimit
+	return cr
+}
+
+// lookup measures DNS time for direct connection.
+func (cr *captureReq) lookup(r *Request, siteInfo *VisitCnt) {
+	if cr == nil || net.ParseIP(r.URL.Host) != nil ||
+		config.AlwaysProxy || siteInfo.AsBlocked() {
+		return
+	}
+	start := time.Now()
+	if _, err := net.LookupHost(r.URL.Host); err == nil {
+		cr.dns = time.Since(start)
+	}
+}
+
+func (cr *captureReq) connected(start time.Time) {
+	if cr != nil {
+		cr.connect = time.Since(start)
+	}
+}
+
+func (cr *captureReq) sending() {
+	if cr != nil {
+		cr.sendStart = time.Now()
+	}
+}
+
+func (cr *captureReq) requestSent() {
+	if cr != nil {
+		cr.sent = time.Now()
+	}
+}
+
+// response records response header sent to client. raw starts with status
+// line.
+func (cr *captureReq) response(raw []byte) {
+	if cr == nil {
+		return
+	}
+	cr.firstByte = time.Now()
+	cr.respHeader = append([]byte(nil), raw...)
+	line := raw
+	if i := bytes.IndexByte(raw, '\n'); i != -1 {
+		line = raw[:i]
+	}
+	f := strings.SplitN(strings.TrimSpace(string(line)), " ", 3)
+	if len(f) > 1 {
+		cr.status, _ = strconv.Atoi(f[1])
+	}
+	if len(f) > 2 {
+		cr.statusText = f[2]
+	}
+}
+
+func (cr *captureReq) requestWriter(w io.Writer) io.Writer {
+	if cr == nil {
+		return w
+	}
+	return io.MultiWriter(w, &cr.reqBody)
+}
+
+func (cr *captureReq) responseWriter(w io.Writer) io.Writer {
+	if cr == nil {
+		return w
+	}
+	return io.MultiWriter(w, &cr.respBody)
+}
+
+// finish creates HAR entry for the request and stores it.
+func (cr *captureReq) finish(r *Request, rp *Response, sv *serverConn, err error) {
+	if cr == nil {
+		return
+	}
+	end := time.Now()
+	e := &harEntry{
+		StartedDateTime: cr.start.Format(time.RFC3339Nano),
+		Time:            msec(end.Sub(cr.start)),
+		Request: harRequest{
+			Method:      cr.method,
+			URL:         cr.url,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     cr.header,
+			QueryString: harQuery(cr.url),
+			HeadersSize: -1,
+			BodySize:    cr.reqBody.size,
+		},
+		Response: harResponse{
+			Status:      cr.status,
+			StatusText:  cr.statusText,
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(cr.respHeader),
+			HeadersSize: -1,
+			BodySize:    cr.respBody.size,
+			RedirectURL: "",
+		},
+		Cache:   struct{}{},
+		Timings: cr.timings(end),
+		Client:  cr.client,
+	}
+	if cr.status == 0 {
+		e.Response.Status = responseStatus(r, rp, sv, err)
+	}
+	e.Route, e.Parent = requestRoute(r, sv)
+	if err != nil && err != errPageSent {
+		e.Error = err.Error()
+	}
+	if cr.reqBody.size > 0 {
+		pd := &harPostData{MimeType: cr.mime}
+		var enc string
+		pd.Text, enc, pd.Comment = harBody(&cr.reqBody, r.Chunking)
+		if enc != "" {
+			// postData has no encoding field.
+			pd.Comment = strings.TrimSpace(enc + " encoded " + pd.Comment)
+		}
+		e.Request.PostData = pd
+	}
+	e.Response.Content = harContent{
+		Size:     cr.respBody.size,
+		MimeType: headerValueOf(cr.respHeader, "Content-Type"),
+	}
+	if cr.respBody.size > 0 {
+		_, chunked := headerValue(cr.respHeader, "Transfer-Encoding")
+		c := &e.Response.Content
+		c.Text, c.Encoding, c.Comment = harBody(&cr.respBody, chunked)
+	}
+	addHAREntry(e)
+}
+
+func (cr *captureReq) timings(end time.Time) harTimings {
+	t := harTimings{DNS: -1, Connect: -1, SSL: -1}
+	if cr.dns >= 0 {
+		t.DNS = msec(cr.dns)
+	}
+	if cr.connect >= 0 {
+		t.Connect = msec(cr.connect)
+	}
+	if cr.sendStart.IsZero() {
+		// Not sent to server: blocked, served from cache, tunnel or failed.
+		t.Blocked = msec(end.Sub(cr.start))
+		return t
+	}
+	t.Blocked = msec(cr.sendStart.Sub(cr.start))
+	for _, d := range []float64{t.DNS, t.Connect} {
+		if d > 0 {
+			t.Blocked -= d
+		}
+	}
+	if t.Blocked < 0 {
+		t.Blocked = 0
+	}
+	sent, firstByte := cr.sent, cr.firstByte
+	if sent.IsZero() {
+		sent = end
+	}
+	if firstByte.IsZero() {
+		firstByte = end
+	}
+	t.Send = msec(sent.Sub(cr.sendStart))
+	t.Wait = msec(firstByte.Sub(sent))
+	t.Receive = msec(end.Sub(firstByte))
+	return t
+}
+
+func msec(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+func headerValueOf(raw []byte, name string) string {
+	v, _ := headerValue(raw, name)
+	return v
+}
+
+func harHeaders(raw []byte) (hdr []harNameValue) {
+	forEachHeader(raw, func(name, value, _ []byte) {
+		hdr = append(hdr, harNameValue{string(name), string(value)})
+	})
+	if hdr == nil {
+		hdr = []harNameValue{}
+	}
+	return
+}
+
+func harQuery(url string) []harNameValue {
+	q := []harNameValue{}
+	i := strings.IndexByte(url, '?')
+	if i == -1 {
+		return q
+	}
+	for _, kv := range strings.Split(url[i+1:], "&") {
+		if kv == "" {
+			continue
+		}
+		f := strings.SplitN(kv, "=", 2)
+		nv := harNameValue{Name: f[0]}
+		if len(f) == 2 {
+			nv.Value = f[1]
+		}
+		q = append(q, nv)
+	}
+	return q
+}
+
+// harBody returns captured body as text, or base64 encoded if not valid
+// UTF-8.
+func harBody(b *captureBody, chunked bool) (text, encoding, comment string) {
+	body := b.Bytes()
+	if chunked {
+		body = dechunk(body)
+	}
+	if int64(b.Len()) < b.size {
+		comment = "truncated to " + strconv.Itoa(b.limit) + " bytes"
+	}
+	if utf8.Valid(body) {
+		return string(body), "", comment
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64", comment
+}
+
+// dechunk decodes chunked body, stops at the first incomplete chunk.
+func dechunk(b []byte) []byte {
+	var out []byte
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i == -1 {
+			return out
+		}
+		line := b[:i]
+		if j := bytes.IndexByte(line, ';'); j != -1 {
+			line = line[:j]
+		}
+		size, err := strconv.ParseInt(string(bytes.TrimSpace(line)), 16, 64)
+		if err != nil || size == 0 {
+			return out
+		}
+		b = b[i+1:]
+		if int64(len(b)) < size {
+			return append(out, b...)
+		}
+		out = append(out, b[:size]...)
+		b = b[size:]
+		if len(b) >= 2 && b[0] == '\r' && b[1] == '\n' {
+			b = b[2:]
+		}
+	}
+}
+
+// HAR 1.2 format, see http://www.softwareishard.com/blog/har-12-spec/
+// Fields starting with underscore are custom fields.
+
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []*harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Client          string      `json:"_client"`
+	Route           string      `json:"_route"`
+	Parent          string      `json:"_parent,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func addHAREntry(e *harEntry) {
+	capture.Lock()
+	if len(capture.entries) < cap(capture.entries) {
+		capture.entries = append(capture.entries, e)
+	} else if len(capture.entries) > 0 {
+		capture.entries[capture.next] = e
+	}
+	if n := cap(capture.entries); n > 0 {
+		capture.next = (capture.next + 1) % n
+	}
+	capture.Unlock()
+}
+
+// getHAR returns captured requests, oldest first.
+func getHAR() *harLog {
+	var h harLog
+	h.Log.Version = "1.2"
+	h.Log.Creator.Name = "COW"
+	h.Log.Creator.Version = version
+	h.Log.Entries = []*harEntry{}
+	capture.Lock()
+	n := len(capture.entries)
+	for i := 0; i < n; i++ {
+		// When buffer is full, next is the oldest entry.
+		h.Log.Entries = append(h.Log.Entries, capture.entries[(capture.next+i)%n])
+	}
+	capture.Unlock()
+	return &h
+}
+
+func writeHARFile() {
+	b, err := json.MarshalIndent(getHAR(), "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(config.CaptureFile, b, 0600)
+	}
+	if err != nil {
+		errl.Println("write capture file:", err)
+		return
+	}
+	info.Println("captured requests written to", config.CaptureFile)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDechunk(t *testing.T) {
+	testData := []struct {
+		raw, body string
+	}{
+		{"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n", "hello world"},
+		{"5;ext=1\r\nhello\r\n0\r\n\r\n", "hello"},
+		{"b\r\nhello", "hello"}, // truncated
+		{"", ""},
+	}
+	for _, td := range testData {
+		if b := string(dechunk([]byte(td.raw))); b != td.body {
+			t.Errorf("%q dechunked to %q, want %q", td.raw, b, td.body)
+		}
+	}
+}
+
+func TestCaptureHAR(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		initCapture()
+	}()
+	config.Capture = []string{"example.com"}
+	config.CaptureClient = []string{"127.0.0.0/8"}
+	config.CaptureBodyLimit = 8
+	config.CaptureMax = 2
+	initCapture()
+
+	const request = "POST http://www.example.com/upload?a=1 HTTP/1.1\r\nHost: www.example.com\r\n" +
+		"Content-Type: text/plain\r\nContent-Length: 4\r\n\r\nbody"
+	for i := 0; i < 3; i++ {
+		fc := newFakeConn(request)
+		c := newClientConn(fc, nil)
+		var r Request
+		if err := parseRequest(c, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.capture = startCapture(c, &r); r.capture == nil {
+			t.Fatal("request should be captured")
+		}
+		cliEnd, srvEnd := net.Pipe()
+		go func() {
+			rd := bufio.NewReader(srvEnd)
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil || line == "\r\n" {
+					break
+				}
+			}
+			io.ReadFull(rd, make([]byte, 4))
+			srvEnd.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n" +
+				"Transfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n"))
+		}()
+		sv := newServerConn(cliEnd, r.URL.HostPort, siteStat.GetVisitCnt(r.URL))
+		var rp Response
+		if err := sv.doRequest(c, &r, &rp); err != nil {
+			t.Fatal("doRequest:", err)
+		}
+		r.capture.finish(&r, &rp, sv, nil)
+		srvEnd.Close()
+		sv.Close()
+		c.releaseBuf()
+	}
+
+	har := getHAR()
+	if har.Log.Version != "1.2" {
+		t.Error("HAR version", har.Log.Version)
+	}
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("should keep 2 entries, got %d", len(har.Log.Entries))
+	}
+	e := har.Log.Entries[0]
+	if e.Request.URL != "http://www.example.com/upload?a=1" || e.Request.Method != "POST" {
+		t.Errorf("request %s %s", e.Request.Method, e.Request.URL)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0] != (harNameValue{"a", "1"}) {
+		t.Errorf("query string %v", e.Request.QueryString)
+	}
+	if pd := e.Request.PostData; pd == nil || pd.Text != "body" || pd.MimeType != "text/plain" {
+		t.Errorf("post data %+v", pd)
+	}
+	if e.Response.Status != 200 || e.Response.StatusText != "OK" {
+		t.Errorf("response status %d %s", e.Response.Status, e.Response.StatusText)
+	}
+	if ct := e.Response.Content; ct.Text != "hello" || ct.Comment == "" || ct.MimeType != "text/plain" {
+		t.Errorf("response content %+v", ct)
+	}
+	if e.Route != routeParent || e.Timings.Connect != -1 || e.Timings.Wait < 0 {
+		t.Errorf("route %s timings %+v", e.Route, e.Timings)
+	}
+	if har.Log.Entries[0].StartedDateTime > har.Log.Entries[1].StartedDateTime {
+		t.Error("entries should be ordered by time")
+	}
+
+	// Request of other hosts is not captured.
+	fc := newFakeConn("GET http://example.org/ HTTP/1.1\r\n\r\n")
+	c := newClientConn(fc, nil)
+	defer c.releaseBuf()
+	var r Request
+	if err := parseRequest(c, &r); err != nil {
+		t.Fatal(err)
+	}
+	if startCapture(c, &r) != nil {
+		t.Error("example.org should not be captured")
+	}
+}
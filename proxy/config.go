@@ -29,6 +29,13 @@ const (
 	loadBalanceLatency
 )
 
+type AuthMode byte
+
+const (
+	authModeConn AuthMode = iota // authenticate each client connection, default
+	authModeIP                   // cache authenticated client ip for authTimeout
+)
+
 // allow the same tunnel ports as polipo
 var defaultTunnelAllowedPort = []string{
 	"22", "80", "443", // ssh, http, https
@@ -54,25 +61,90 @@ type Config struct {
 	UserPasswdFile string // file that contains user:passwd:[port] pairs
 	AllowedClient  string
 	AuthTimeout    time.Duration
+	AuthMode       AuthMode
+	UserLimit      []string // quota and bandwidth limit for users
+	AuthBackend    []string // named authentication backends
+	ListenAuth     []string // authentication backend for listen address
+	UsageFile      string   // path for user traffic usage
+
+	ProxyProtocol       []string // trusted PROXY header sources for listen address
+	ParentProxyProtocol int      // PROXY protocol version sent to http parents, 0 disables
+
+	CowMux      bool // multiplex requests to cow parents over a few connections
+	CowMuxConns int  // max number of mux connections to each cow parent
+
+	ConnPoolMaxIdle        int           // max idle server connections
+	ConnPoolMaxIdlePerHost int           // max idle connections for each server
+	ConnPoolIdleTimeout    time.Duration // close server connections idle for this long, 0 disables
+
+	RaceConnect bool          // race direct and parent connections for new sites
+	RaceDelay   time.Duration // delay before starting parent connection in race
 
 	// advanced options
 	DialTimeout time.Duration
 	ReadTimeout time.Duration
+	UDPTimeout  time.Duration // idle timeout for UDP relay sessions
 
 	Core         int
 	DetectSSLErr bool
 
+	ShutdownTimeout time.Duration // wait for active connections when exiting
+
 	HttpErrorCode int
 
-	dir         string // directory containing config file
-	StatFile    string // Path for stat file
-	BlockedFile string // blocked sites specified by user
-	DirectFile  string // direct sites specified by user
+	AccessLog        string        // path for access log
+	AccessLogFormat  string        // json, common or combined
+	AccessLogMaxSize int64         // rotate access log when exceeding size
+	AccessLogRotate  time.Duration // rotate access log periodically
+	AccessLogBackups int           // number of rotated access logs to keep
+
+	Capture          []string // domains of requests to capture
+	CaptureClient    []string // clients of requests to capture
+	CaptureBodyLimit int64    // max body size kept for captured requests
+	CaptureMax       int      // number of captured requests kept
+	CaptureFile      string   // HAR file written on SIGUSR2
+
+	CacheDir       string   // directory for response cache, empty disables cache
+	CacheSize      int64    // max total size of cached responses
+	CacheMaxObject int64    // max size of a single cached response
+	CacheBypass    []string // domains never cached
+	CacheStore     string   // url of object storage bucket to store cache
+
+	MITMCA      string   // CA certificate for TLS interception
+	MITMCAKey   string   // CA private key
+	MITMDomain  []string // domains to intercept
+	MITMBypass  []string // domains never intercepted
+	MITMCertDir string   // directory for generated certificates
+
+	Rewrite      []string // request and response rewrite rules
+	ForwardedFor bool     // add client address to X-Forwarded-For
+	Via          string   // pseudonym in Via header, empty to not add
+
+	BlockList     []string // domain blocklists
+	BlockResponse int      // status of response for blocked requests
+
+	PACServer        []string // proxy directives in PAC
+	PACProxy         []string // domains always using proxy in PAC
+	PACNet           []string // IP/CIDR rules in PAC
+	PACDefaultDirect bool     // PAC uses direct for sites not in lists
+	PACUser          []string // PAC variants for users
+
+	dir            string        // directory containing config file
+	StatFile       string        // Path for stat file
+	StatBackend    string        // json or log, log also keeps site history
+	StatHistoryAge time.Duration // how long to keep site history
+	BlockedFile    string        // blocked sites specified by user
+	SiteSync       string        // etcd://host:port,... to share site stat
+	SiteSyncPrefix string        // key prefix for shared site stat
+	SiteSyncTTL    time.Duration // how long shared direct/blocked status lasts
+	SiteSyncNode   string        // identifies this node in shared site stat
+	DirectFile     string        // direct sites specified by user
+	BlockProbe     bool          // probe temporarily blocked sites directly
 
 	// not configurable in config file
 	PrintVer        bool
-	EstimateTimeout bool   // Whether to run estimateTimeout().
-	EstimateTarget  string // Timeout estimate target site.
+	EstimateTimeout bool     // Whether to run estimateTimeout().
+	EstimateTarget  []string // Timeout estimate target sites.
 
 	// not config option
 	saveReqLine bool // for http and cow parent, should save request line from client
@@ -90,20 +162,47 @@ func initConfig(rcFile string) {
 	config.BlockedFile = path.Join(config.dir, blockedFname)
 	config.DirectFile = path.Join(config.dir, directFname)
 	config.StatFile = path.Join(config.dir, statFname)
+	config.UsageFile = path.Join(config.dir, usageFname)
+	config.StatBackend = statBackendJSON
+	config.StatHistoryAge = defaultStatHistoryAge
+	config.SiteSyncPrefix = defaultSiteSyncPrefix
+	config.SiteSyncTTL = defaultSiteSyncTTL
+	config.SiteSyncNode = defaultSiteSyncNode()
 
 	config.DetectSSLErr = false
+	config.BlockProbe = true
 	config.AlwaysProxy = false
 
+	config.AuthMode = authModeConn
 	config.AuthTimeout = 2 * time.Hour
 	config.DialTimeout = defaultDialTimeout
 	config.ReadTimeout = defaultReadTimeout
+	config.UDPTimeout = defaultUDPTimeout
+	config.ShutdownTimeout = defaultShutdownTimeout
+
+	config.AccessLogFormat = accessLogJSON
+	config.AccessLogBackups = defaultAccessLogBackups
+
+	config.CaptureBodyLimit = defaultCaptureBodyLimit
+	config.CaptureMax = defaultCaptureMax
+	config.CaptureFile = path.Join(config.dir, captureFname)
+
+	config.CowMux = true
+	config.CowMuxConns = defaultCowMuxConns
+
+	config.ConnPoolMaxIdle = defaultConnPoolMaxIdle
+	config.ConnPoolMaxIdlePerHost = defaultConnPoolMaxIdlePerHost
+	config.ConnPoolIdleTimeout = defaultConnPoolIdleTimeout
+
+	config.RaceDelay = defaultRaceDelay
+
+	config.CacheSize = defaultCacheSize
+	config.CacheMaxObject = defaultCacheMaxObject
 
 	config.TunnelAllowedPort = make(map[string]bool)
 	for _, port := range defaultTunnelAllowedPort {
 		config.TunnelAllowedPort[port] = true
 	}
-
-	config.EstimateTarget = defaultEstimateTarget
 }
 
 // Whether command line options specifies listen addr
@@ -302,6 +401,16 @@ func (lp listenParser) ListenCow(val string) {
 	addListenProxy(newCowProxy(method, passwd, addr))
 }
 
+func (lp listenParser) ListenSocks5(val string) {
+	if cmdHasListenAddr {
+		return
+	}
+	if err := checkServerAddr(val); err != nil {
+		Fatal("listen socks5 server", err)
+	}
+	addListenProxy(newSocksProxy(val))
+}
+
 // configParser provides functions to parse options in config file.
 type configParser struct{}
 
@@ -461,6 +570,44 @@ func (p configParser) ParseStatFile(val string) {
 	config.StatFile = expandTilde(val)
 }
 
+func (p configParser) ParseStatBackend(val string) {
+	switch val {
+	case statBackendJSON, statBackendLog:
+		config.StatBackend = val
+	default:
+		Fatalf("invalid statBackend: %s, should be json or log\n", val)
+	}
+}
+
+func (p configParser) ParseStatHistoryAge(val string) {
+	config.StatHistoryAge = parseDuration(val, "statHistoryAge")
+}
+
+func (p configParser) ParseSiteSync(val string) {
+	if !strings.HasPrefix(val, "etcd://") || len(val) == len("etcd://") {
+		Fatalf("invalid siteSync: %s, should be etcd://host:port[,host:port...]\n", val)
+	}
+	config.SiteSync = val
+}
+
+func (p configParser) ParseSiteSyncPrefix(val string) {
+	if !strings.HasSuffix(val, "/") {
+		val += "/"
+	}
+	config.SiteSyncPrefix = val
+}
+
+func (p configParser) ParseSiteSyncTTL(val string) {
+	config.SiteSyncTTL = parseDuration(val, "siteSyncTTL")
+	if config.SiteSyncTTL < time.Second {
+		Fatal("siteSyncTTL should be at least 1s")
+	}
+}
+
+func (p configParser) ParseSiteSyncNode(val string) {
+	config.SiteSyncNode = val
+}
+
 func (p configParser) ParseBlockedFile(val string) {
 	config.BlockedFile = expandTilde(val)
 	if err := isFileExists(config.BlockedFile); err != nil {
@@ -563,10 +710,266 @@ func (p configParser) ParseAllowedClient(val string) {
 	config.AllowedClient = val
 }
 
+func (p configParser) ParseAuthBackend(val string) {
+	config.AuthBackend = append(config.AuthBackend, val)
+}
+
+func (p configParser) ParseListenAuth(val string) {
+	config.ListenAuth = append(config.ListenAuth, val)
+}
+
+func (p configParser) ParseCowMux(val string) {
+	config.CowMux = parseBool(val, "cowMux")
+}
+
+func (p configParser) ParseCowMuxConns(val string) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		Fatal("cowMuxConns should be a positive number")
+	}
+	config.CowMuxConns = n
+}
+
+func (p configParser) ParseConnPoolMaxIdle(val string) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		Fatal("connPoolMaxIdle should be a positive number")
+	}
+	config.ConnPoolMaxIdle = n
+}
+
+func (p configParser) ParseConnPoolMaxIdlePerHost(val string) {
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		Fatal("connPoolMaxIdlePerHost should be a positive number")
+	}
+	config.ConnPoolMaxIdlePerHost = n
+}
+
+func (p configParser) ParseConnPoolIdleTimeout(val string) {
+	config.ConnPoolIdleTimeout = parseDuration(val, "connPoolIdleTimeout")
+}
+
+func (p configParser) ParseRaceConnect(val string) {
+	config.RaceConnect = parseBool(val, "raceConnect")
+}
+
+func (p configParser) ParseRaceDelay(val string) {
+	config.RaceDelay = parseDuration(val, "raceDelay")
+	if config.RaceDelay < 0 {
+		Fatal("raceDelay should not be negative")
+	}
+}
+
+func (p configParser) ParseProxyProtocol(val string) {
+	config.ProxyProtocol = append(config.ProxyProtocol, val)
+}
+
+func (p configParser) ParseParentProxyProtocol(val string) {
+	switch val {
+	case "0", "1", "2":
+		config.ParentProxyProtocol, _ = strconv.Atoi(val)
+	default:
+		Fatal("parentProxyProtocol should be 0, 1 or 2")
+	}
+}
+
+func (p configParser) ParseUserLimit(val string) {
+	config.UserLimit = append(config.UserLimit, val)
+}
+
+func (p configParser) ParseUsageFile(val string) {
+	config.UsageFile = expandTilde(val)
+}
+
+func (p configParser) ParseAccessLog(val string) {
+	config.AccessLog = expandTilde(val)
+}
+
+func (p configParser) ParseAccessLogFormat(val string) {
+	switch val {
+	case accessLogJSON, accessLogCommon, accessLogCombined:
+		config.AccessLogFormat = val
+	default:
+		Fatalf("invalid accessLogFormat: %s\n", val)
+	}
+}
+
+func (p configParser) ParseAccessLogMaxSize(val string) {
+	size, err := parseSize(val)
+	if err != nil {
+		Fatal("accessLogMaxSize:", err)
+	}
+	config.AccessLogMaxSize = size
+}
+
+func (p configParser) ParseAccessLogRotate(val string) {
+	config.AccessLogRotate = parseDuration(val, "accessLogRotate")
+}
+
+func (p configParser) ParseAccessLogBackups(val string) {
+	config.AccessLogBackups = parseInt(val, "accessLogBackups")
+}
+
+func (p configParser) ParseShutdownTimeout(val string) {
+	config.ShutdownTimeout = parseDuration(val, "shutdownTimeout")
+}
+
+func (p configParser) ParseCapture(val string) {
+	config.Capture = appendDomains(config.Capture, val)
+}
+
+func (p configParser) ParseCaptureClient(val string) {
+	config.CaptureClient = append(config.CaptureClient, val)
+}
+
+func (p configParser) ParseCaptureBodyLimit(val string) {
+	size, err := parseSize(val)
+	if err != nil {
+		Fatal("captureBodyLimit:", err)
+	}
+	config.CaptureBodyLimit = size
+}
+
+func (p configParser) ParseCaptureMax(val string) {
+	config.CaptureMax = parseInt(val, "captureMax")
+}
+
+func (p configParser) ParseCaptureFile(val string) {
+	config.CaptureFile = expandTilde(val)
+}
+
+func (p configParser) ParseCacheDir(val string) {
+	config.CacheDir = expandTilde(val)
+}
+
+func (p configParser) ParseCacheSize(val string) {
+	size, err := parseSize(val)
+	if err != nil {
+		Fatal("cacheSize:", err)
+	}
+	config.CacheSize = size
+}
+
+func (p configParser) ParseCacheMaxObject(val string) {
+	size, err := parseSize(val)
+	if err != nil {
+		Fatal("cacheMaxObject:", err)
+	}
+	config.CacheMaxObject = size
+}
+
+func (p configParser) ParseCacheStore(val string) {
+	config.CacheStore = val
+}
+
+func (p configParser) ParseCacheBypass(val string) {
+	config.CacheBypass = appendDomains(config.CacheBypass, val)
+}
+
+// appendDomains appends comma separated domains in val to lst.
+func appendDomains(lst []string, val string) []string {
+	for _, d := range strings.Split(val, ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			lst = append(lst, d)
+		}
+	}
+	return lst
+}
+
+func (p configParser) ParseMitmCA(val string) {
+	config.MITMCA = expandTilde(val)
+}
+
+func (p configParser) ParseMitmCAKey(val string) {
+	config.MITMCAKey = expandTilde(val)
+}
+
+func (p configParser) ParseMitmDomain(val string) {
+	config.MITMDomain = appendDomains(config.MITMDomain, val)
+}
+
+func (p configParser) ParseMitmBypass(val string) {
+	config.MITMBypass = appendDomains(config.MITMBypass, val)
+}
+
+func (p configParser) ParseMitmCertDir(val string) {
+	config.MITMCertDir = expandTilde(val)
+}
+
+func (p configParser) ParseRewrite(val string) {
+	config.Rewrite = append(config.Rewrite, val)
+}
+
+func (p configParser) ParseForwardedFor(val string) {
+	config.ForwardedFor = parseBool(val, "forwardedFor")
+}
+
+func (p configParser) ParseVia(val string) {
+	config.Via = val
+}
+
+func (p configParser) ParseBlockList(val string) {
+	config.BlockList = append(config.BlockList, val)
+}
+
+func (p configParser) ParseBlockResponse(val string) {
+	switch val {
+	case "403":
+		config.BlockResponse = 403
+	case "204":
+		config.BlockResponse = 204
+	default:
+		Fatal("blockResponse should be 403 or 204")
+	}
+}
+
+func (p configParser) ParsePacServer(val string) {
+	s, err := parsePACServer(val)
+	if err != nil {
+		Fatal(err)
+	}
+	config.PACServer = append(config.PACServer, s)
+}
+
+func (p configParser) ParsePacProxy(val string) {
+	config.PACProxy = appendDomains(config.PACProxy, val)
+}
+
+func (p configParser) ParsePacNet(val string) {
+	config.PACNet = append(config.PACNet, val)
+}
+
+func (p configParser) ParsePacDefault(val string) {
+	switch val {
+	case "proxy":
+		config.PACDefaultDirect = false
+	case "direct":
+		config.PACDefaultDirect = true
+	default:
+		Fatal("pacDefault should be proxy or direct")
+	}
+}
+
+func (p configParser) ParsePacUser(val string) {
+	config.PACUser = append(config.PACUser, val)
+}
+
 func (p configParser) ParseAuthTimeout(val string) {
 	config.AuthTimeout = parseDuration(val, "authTimeout")
 }
 
+func (p configParser) ParseAuthMode(val string) {
+	switch val {
+	case "ip":
+		config.AuthMode = authModeIP
+	case "conn":
+		config.AuthMode = authModeConn
+	default:
+		Fatalf("invalid authMode: %s\n", val)
+	}
+}
+
 func (p configParser) ParseCore(val string) {
 	config.Core = parseInt(val, "core")
 }
@@ -583,12 +986,26 @@ func (p configParser) ParseDialTimeout(val string) {
 	config.DialTimeout = parseDuration(val, "dialTimeout")
 }
 
+func (p configParser) ParseUdpTimeout(val string) {
+	config.UDPTimeout = parseDuration(val, "udpTimeout")
+	if config.UDPTimeout <= 0 {
+		Fatal("udpTimeout should be positive")
+	}
+}
+
 func (p configParser) ParseDetectSSLErr(val string) {
 	config.DetectSSLErr = parseBool(val, "detectSSLErr")
 }
 
+func (p configParser) ParseBlockProbe(val string) {
+	config.BlockProbe = parseBool(val, "blockProbe")
+}
+
 func (p configParser) ParseEstimateTarget(val string) {
-	config.EstimateTarget = val
+	if _, err := parseEstimateTarget(val); err != nil {
+		Fatal(err)
+	}
+	config.EstimateTarget = append(config.EstimateTarget, val)
 }
 
 // overrideConfig should contain options from command line to override options
@@ -1,77 +1,134 @@
 // Share server connections between different clients.
+//
+//	connPoolMaxIdle = 100        # idle connections for all servers
+//	connPoolMaxIdlePerHost = 5   # idle connections for each server
+//	connPoolIdleTimeout = 2m     # close connections idle for this long
+//
+// When a limit is reached, the connection idle for the longest time is
+// closed to make room for the new one.
 
 package proxy
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
 
-// Maximum number of connections to a server.
-const maxServerConnCnt = 5
+const (
+	defaultConnPoolMaxIdle        = 100
+	defaultConnPoolMaxIdlePerHost = 5
+	defaultConnPoolIdleTimeout    = 2 * time.Minute
 
-// Store each server's connections in separate channels, getting
-// connections for different servers can be done in parallel.
+	connPoolReapInterval = 5 * time.Second
+)
+
+// make sure hostPort here won't match any actual hostPort
+const muxConnHostPort = "@muxConn"
+
+type idleConn struct {
+	sv       *serverConn
+	hostPort string // key in pool
+	since    time.Time
+	hostElem *list.Element
+	lruElem  *list.Element
+}
+
+// ConnPool stores idle connections of each server in a list, most recently
+// used at front. All idle connections are also in a LRU list for eviction.
 type ConnPool struct {
-	idleConn map[string]chan *serverConn
-	muxConn  chan *serverConn // connections support multiplexing
-	sync.RWMutex
+	sync.Mutex
+	idle map[string]*list.List
+	lru  *list.List
+	// connections support multiplexing are stored with muxConnHostPort
+
+	maxIdle        int
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+
+	hits      int64
+	misses    int64
+	evictions int64 // closed because of limits
+	expired   int64 // closed by reaper
 }
 
-var connPool = &ConnPool{
-	idleConn: map[string]chan *serverConn{},
-	muxConn:  make(chan *serverConn, maxServerConnCnt*2),
+func newConnPool() *ConnPool {
+	return &ConnPool{
+		idle:           make(map[string]*list.List),
+		lru:            list.New(),
+		maxIdle:        defaultConnPoolMaxIdle,
+		maxIdlePerHost: defaultConnPoolMaxIdlePerHost,
+		idleTimeout:    defaultConnPoolIdleTimeout,
+	}
 }
 
-const muxConnHostPort = "@muxConn"
+var connPool = newConnPool()
 
 func init() {
-	// make sure hostPort here won't match any actual hostPort
-	go closeStaleServerConn(connPool.muxConn, muxConnHostPort)
+	go connPool.reap()
+}
+
+func initConnPool() {
+	connPool.Lock()
+	connPool.maxIdle = config.ConnPoolMaxIdle
+	connPool.maxIdlePerHost = config.ConnPoolMaxIdlePerHost
+	connPool.idleTimeout = config.ConnPoolIdleTimeout
+	connPool.Unlock()
 }
 
-func getConnFromChan(ch chan *serverConn) (sv *serverConn) {
+func (cp *ConnPool) hostLimit(hostPort string) int {
+	// All mulplexing connections share one list.
+	if hostPort == muxConnHostPort {
+		return cp.maxIdlePerHost * 2
+	}
+	return cp.maxIdlePerHost
+}
+
+// remove must be called with lock held.
+func (cp *ConnPool) remove(ic *idleConn) {
+	l := cp.idle[ic.hostPort]
+	l.Remove(ic.hostElem)
+	if l.Len() == 0 {
+		delete(cp.idle, ic.hostPort)
+	}
+	cp.lru.Remove(ic.lruElem)
+}
+
+// get takes the most recently used connection for hostPort.
+func (cp *ConnPool) get(hostPort string) *serverConn {
 	for {
-		select {
-		case sv = <-ch:
-			if sv.mayBeClosed() {
-				sv.Close()
-				continue
-			}
-			return sv
-		default:
+		cp.Lock()
+		l := cp.idle[hostPort]
+		if l == nil {
+			cp.Unlock()
 			return nil
 		}
+		ic := l.Front().Value.(*idleConn)
+		cp.remove(ic)
+		cp.Unlock()
+		if !ic.sv.mayBeClosed() {
+			return ic.sv
+		}
+		ic.sv.Close()
 	}
 }
 
-func putConnToChan(sv *serverConn, ch chan *serverConn, chname string) {
-	select {
-	case ch <- sv:
-		debug.Printf("connPool channel %s: put conn\n", chname)
-		return
-	default:
-		// Simply close the connection if can't put into channel immediately.
-		// A better solution would remove old connections from the channel and
-		// add the new one. But's it's more complicated and this should happen
-		// rarely.
-		debug.Printf("connPool channel %s: full", chname)
-		sv.Close()
+func (cp *ConnPool) count(sv *serverConn) {
+	cp.Lock()
+	if sv != nil {
+		cp.hits++
+	} else {
+		cp.misses++
 	}
+	cp.Unlock()
 }
 
 func (cp *ConnPool) Get(hostPort string, asDirect bool) (sv *serverConn) {
+	defer func() { cp.count(sv) }()
 	// Get from site specific connection first.
 	// Direct connection are all site specific, so must use site specific
 	// first to avoid using parent proxy for direct sites.
-	cp.RLock()
-	ch := cp.idleConn[hostPort]
-	cp.RUnlock()
-
-	if ch != nil {
-		sv = getConnFromChan(ch)
-	}
-	if sv != nil {
+	if sv = cp.get(hostPort); sv != nil {
 		debug.Printf("connPool %s: get conn\n", hostPort)
 		return sv
 	}
@@ -82,127 +139,129 @@ func (cp *ConnPool) Get(hostPort string, asDirect bool) (sv *serverConn) {
 		return nil
 	}
 
-	sv = getConnFromChan(cp.muxConn)
+	sv = cp.get(muxConnHostPort)
 	if bool(debug) && sv != nil {
 		debug.Println("connPool mux: get conn", hostPort)
 	}
 	return sv
 }
 
-func (cp *ConnPool) Put(sv *serverConn) {
-	// Multiplexing connections.
-	switch sv.Conn.(type) {
-	case httpConn, cowConn:
-		putConnToChan(sv, cp.muxConn, "muxConn")
-		return
-	}
-
-	// Site specific connections.
-	cp.RLock()
-	ch := cp.idleConn[sv.hostPort]
-	cp.RUnlock()
-
-	if ch == nil {
-		debug.Printf("connPool %s: new channel\n", sv.hostPort)
-		ch = make(chan *serverConn, maxServerConnCnt)
-		ch <- sv
-		cp.Lock()
-		cp.idleConn[sv.hostPort] = ch
-		cp.Unlock()
-		// start a new goroutine to close stale server connections
-		go closeStaleServerConn(ch, sv.hostPort)
-	} else {
-		putConnToChan(sv, ch, sv.hostPort)
+// GetSite only gets site specific connection.
+func (cp *ConnPool) GetSite(hostPort string) (sv *serverConn) {
+	sv = cp.get(hostPort)
+	cp.count(sv)
+	if sv != nil {
+		debug.Printf("connPool %s: get conn\n", hostPort)
 	}
+	return sv
 }
 
-type chanInPool struct {
-	hostPort string
-	ch       chan *serverConn
+func poolKey(sv *serverConn) string {
+	switch conn := sv.Conn.(type) {
+	case httpConn:
+		// Connection with PROXY header can only be used by the same client.
+		if conn.client == "" {
+			return muxConnHostPort
+		}
+	case cowConn:
+		return muxConnHostPort
+	}
+	return sv.hostPort
 }
 
-func (cp *ConnPool) CloseAll() {
-	debug.Println("connPool: close all server connections")
+func (cp *ConnPool) Put(sv *serverConn) {
+	hostPort := poolKey(sv)
+	var evicted []*serverConn
 
-	// Because closeServerConn may acquire connPool.Lock, we first collect all
-	// channel, and close server connection for each one.
-	var connCh []chanInPool
-	cp.RLock()
-	for hostPort, ch := range cp.idleConn {
-		connCh = append(connCh, chanInPool{hostPort, ch})
-	}
-	cp.RUnlock()
-
-	for _, hc := range connCh {
-		closeServerConn(hc.ch, hc.hostPort, true)
-	}
-
-	closeServerConn(cp.muxConn, muxConnHostPort, true)
-}
-
-func closeServerConn(ch chan *serverConn, hostPort string, force bool) (done bool) {
-	// If force is true, close all idle connection even if it maybe open.
-	lcnt := len(ch)
-	if lcnt == 0 {
-		// Execute the loop at least once.
-		lcnt = 1
-	}
-	for i := 0; i < lcnt; i++ {
-		select {
-		case sv := <-ch:
-			if force || sv.mayBeClosed() {
-				debug.Printf("connPool channel %s: close one conn\n", hostPort)
-				sv.Close()
-			} else {
-				// Put it back and wait.
-				debug.Printf("connPool channel %s: put back conn\n", hostPort)
-				ch <- sv
-			}
-		default:
-			if hostPort != muxConnHostPort {
-				// No more connection in this channel, remove the channel from
-				// the map.
-				debug.Printf("connPool channel %s: remove\n", hostPort)
-				connPool.Lock()
-				delete(connPool.idleConn, hostPort)
-				connPool.Unlock()
-			}
-			return true
+	cp.Lock()
+	// Evict the oldest idle connections instead of discarding the new one.
+	if l := cp.idle[hostPort]; l != nil {
+		for l.Len() >= cp.hostLimit(hostPort) {
+			ic := l.Back().Value.(*idleConn)
+			cp.remove(ic)
+			evicted = append(evicted, ic.sv)
 		}
 	}
-	return false
+	for cp.lru.Len() >= cp.maxIdle {
+		ic := cp.lru.Back().Value.(*idleConn)
+		cp.remove(ic)
+		evicted = append(evicted, ic.sv)
+	}
+	l := cp.idle[hostPort]
+	if l == nil {
+		l = list.New()
+		cp.idle[hostPort] = l
+	}
+	ic := &idleConn{sv: sv, hostPort: hostPort, since: time.Now()}
+	ic.hostElem = l.PushFront(ic)
+	ic.lruElem = cp.lru.PushFront(ic)
+	cp.evictions += int64(len(evicted))
+	cp.Unlock()
+
+	debug.Printf("connPool %s: put conn\n", hostPort)
+	for _, sv := range evicted {
+		debug.Printf("connPool %s: evict conn\n", sv.hostPort)
+		sv.Close()
+	}
 }
 
-func closeStaleServerConn(ch chan *serverConn, hostPort string) {
-	// Tricky here. When removing a channel from the map, there maybe
-	// goroutines doing Put and Get using that channel.
+// closeIdle closes idle connections, all if force is true, otherwise those
+// server may have closed or idle longer than idle timeout.
+func (cp *ConnPool) closeIdle(force bool) {
+	var closed []*serverConn
+	now := time.Now()
+	cp.Lock()
+	for e := cp.lru.Back(); e != nil; {
+		ic := e.Value.(*idleConn)
+		e = e.Prev()
+		if force || ic.sv.mayBeClosed() ||
+			(cp.idleTimeout > 0 && now.Sub(ic.since) > cp.idleTimeout) {
+			cp.remove(ic)
+			closed = append(closed, ic.sv)
+		}
+	}
+	if !force {
+		cp.expired += int64(len(closed))
+	}
+	cp.Unlock()
+
+	for _, sv := range closed {
+		debug.Printf("connPool %s: close idle conn\n", sv.hostPort)
+		sv.Close()
+	}
+}
 
-	// For Get, there's no problem because it will return immediately.
-	// For Put, it's possible that a new connection is added to the
-	// channel, but the channel is no longer in the map.
-	// So after removed the channel from the map, we wait for several seconds
-	// and then close all connections left in it.
+func (cp *ConnPool) CloseAll() {
+	debug.Println("connPool: close all server connections")
+	cp.closeIdle(true)
+}
 
-	// It's possible that Put add the connection after the final wait, but
-	// that should not happen in practice, and the worst result is just lost
-	// some memory and open fd.
+// reap periodically closes stale connections.
+func (cp *ConnPool) reap() {
 	for {
-		time.Sleep(5 * time.Second)
-		if done := closeServerConn(ch, hostPort, false); done {
-			break
-		}
+		time.Sleep(connPoolReapInterval)
+		cp.closeIdle(false)
 	}
-	// Final wait and then close all left connections. In practice, there
-	// should be no other goroutines holding reference to the channel.
-	time.Sleep(2 * time.Second)
-	for {
-		select {
-		case sv := <-ch:
-			debug.Printf("connPool channel %s: close conn after removed\n", hostPort)
-			sv.Close()
-		default:
-			debug.Printf("connPool channel %s: cleanup done\n", hostPort)
-			return
-		}
+}
+
+type connPoolInfo struct {
+	Idle      int   `json:"idle"`
+	Hosts     int   `json:"hosts"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Expired   int64 `json:"expired"`
+}
+
+func (cp *ConnPool) getInfo() connPoolInfo {
+	cp.Lock()
+	defer cp.Unlock()
+	return connPoolInfo{
+		Idle:      cp.lru.Len(),
+		Hosts:     len(cp.idle),
+		Hits:      cp.hits,
+		Misses:    cp.misses,
+		Evictions: cp.evictions,
+		Expired:   cp.expired,
 	}
 }
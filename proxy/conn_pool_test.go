@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"net"
 	"testing"
 	"time"
 )
@@ -54,3 +55,59 @@ func TestConnPool(t *testing.T) {
 		}
 	}
 }
+
+type closeRecordConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeRecordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestConnPoolEvict(t *testing.T) {
+	cp := newConnPool()
+	cp.maxIdle, cp.maxIdlePerHost, cp.idleTimeout = 3, 2, time.Minute
+	closeOn := time.Now().Add(time.Minute)
+	newConn := func(hostPort string) *serverConn {
+		return &serverConn{Conn: &closeRecordConn{}, hostPort: hostPort, willCloseOn: closeOn}
+	}
+	closed := func(sv *serverConn) bool { return sv.Conn.(*closeRecordConn).closed }
+
+	a1, a2, a3 := newConn("a:80"), newConn("a:80"), newConn("a:80")
+	b1, b2 := newConn("b:80"), newConn("b:80")
+	for _, sv := range []*serverConn{a1, a2, a3} {
+		cp.Put(sv)
+	}
+	if !closed(a1) || closed(a2) || closed(a3) {
+		t.Error("oldest conn of host should be evicted")
+	}
+	cp.Put(b1)
+	cp.Put(b2)
+	if !closed(a2) || closed(a3) || cp.lru.Len() != 3 {
+		t.Error("oldest conn of all hosts should be evicted")
+	}
+	if sv := cp.GetSite("a:80"); sv != a3 {
+		t.Error("should get a3")
+	}
+	if sv := cp.GetSite("a:80"); sv != nil {
+		t.Error("a:80 should have no idle conn")
+	}
+	if sv := cp.GetSite("b:80"); sv != b2 {
+		t.Error("should get most recently used conn")
+	}
+
+	// Stale connections are closed by reaper.
+	b1.willCloseOn = time.Now().Add(-time.Second)
+	cp.Put(a3)
+	cp.lru.Front().Value.(*idleConn).since = time.Now().Add(-2 * time.Minute)
+	cp.closeIdle(false)
+	if !closed(b1) || !closed(a3) || cp.lru.Len() != 0 || len(cp.idle) != 0 {
+		t.Error("stale conns should be closed")
+	}
+	info := cp.getInfo()
+	if info.Hits != 2 || info.Misses != 1 || info.Evictions != 2 || info.Expired != 2 {
+		t.Errorf("pool info %+v", info)
+	}
+}
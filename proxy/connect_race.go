@@ -0,0 +1,126 @@
+// Race direct and parent proxy connections for sites never visited.
+//
+//	raceConnect = true   # default false
+//	raceDelay = 300ms    # start parent proxy connection after this delay
+//
+// Without racing, a new site is connected directly first and parent proxy is
+// only tried after direct connection times out, so the first visit to a new
+// blocked site is slow. With racing, parent proxy connection starts if direct
+// connection is not established after raceDelay, or at once if direct
+// connection fails. The first established connection is used and the other
+// one is closed.
+//
+// Direct connections also race IPv4 and IPv6 addresses as RFC 8305 describes.
+
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	defaultRaceDelay = 300 * time.Millisecond
+
+	// RFC 8305 recommended delay before trying the other address family.
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+type raceResult struct {
+	conn   net.Conn
+	err    error
+	direct bool
+}
+
+// dialDirect connects to hostPort, trying IPv4 and IPv6 addresses
+// concurrently. No timeout if to is 0.
+func dialDirect(hostPort string, to time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: to, FallbackDelay: happyEyeballsDelay}
+	return d.Dial("tcp", hostPort)
+}
+
+// shouldRace returns true if the site has no visit history.
+func shouldRace(siteInfo *VisitCnt) bool {
+	if !config.RaceConnect || parentProxy.empty() {
+		return false
+	}
+	return siteInfo.Direct == 0 && siteInfo.Blocked == 0 && !siteInfo.AsTempBlocked()
+}
+
+// raceConnect connects to r.URL directly and through parent proxy, returns
+// the connection first established.
+func (c *clientConn) raceConnect(r *Request, siteInfo *VisitCnt) (net.Conn, error) {
+	ch := make(chan raceResult, 2)
+	dialParent := func() {
+		go func() {
+			conn, err := parentProxy.connect(r.URL)
+			ch <- raceResult{conn, err, false}
+		}()
+	}
+	go func() {
+		conn, err := connectDirect(r.URL, siteInfo)
+		ch <- raceResult{conn, err, true}
+	}()
+
+	delay := time.NewTimer(config.RaceDelay)
+	defer delay.Stop()
+	pending, parentStarted := 1, false
+	var directErr, parentErr error
+	for pending > 0 {
+		select {
+		case <-delay.C:
+			if !parentStarted {
+				parentStarted = true
+				pending++
+				dialParent()
+			}
+		case res := <-ch:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					go raceLoser(r.URL, ch)
+				}
+				if !res.direct && directErr != nil {
+					c.handleBlockedRequest(r, directErr)
+				}
+				if debug {
+					debug.Printf("cli(%s) race to %s won by direct=%v\n",
+						c.RemoteAddr(), r.URL.HostPort, res.direct)
+				}
+				return res.conn, nil
+			}
+			if res.direct {
+				directErr = res.err
+				if !parentStarted {
+					parentStarted = true
+					pending++
+					dialParent()
+				}
+			} else {
+				parentErr = res.err
+			}
+		}
+	}
+	if directErr != nil {
+		return nil, directErr
+	}
+	return nil, parentErr
+}
+
+// raceLoser closes connection of the loser in race. If parent proxy wins and
+// direct connection fails later, the failure is recorded as in
+// handleBlockedRequest. Established direct connection proves nothing for
+// sites blocked by reset or SNI filtering, so visit is only recorded by the
+// winner upon response.
+func raceLoser(url *URL, ch chan raceResult) {
+	res := <-ch
+	if res.err == nil {
+		res.conn.Close()
+		return
+	}
+	if !res.direct {
+		return
+	}
+	siteBlock.observe(url.Host, classifyBlockErr(res.err))
+	siteStat.TempBlocked(url)
+}
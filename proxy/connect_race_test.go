@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type raceParent struct {
+	dialed int32
+}
+
+func (p *raceParent) connect(url *URL) (net.Conn, error) {
+	atomic.AddInt32(&p.dialed, 1)
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (p *raceParent) getServer() string { return "race parent" }
+func (p *raceParent) genConfig() string { return "" }
+
+func TestRaceConnect(t *testing.T) {
+	parent := &raceParent{}
+	oldParent, oldSiteStat := parentProxy, siteStat
+	parentProxy = &backupParentPool{[]ParentWithFail{{parent, 0}}}
+	siteStat = newSiteStat()
+	config.RaceConnect = true
+	config.RaceDelay = time.Second
+	defer func() {
+		parentProxy, siteStat = oldParent, oldSiteStat
+		config.RaceConnect = false
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	c := &clientConn{}
+	r := &Request{URL: &URL{}}
+	r.URL.ParseHostPort(ln.Addr().String())
+	vc := siteStat.create(r.URL.Host)
+	if !shouldRace(vc) {
+		t.Fatal("site without history should race")
+	}
+	conn, err := c.raceConnect(r, vc)
+	if err != nil {
+		t.Fatal("race connect:", err)
+	}
+	conn.Close()
+	if _, ok := conn.(directConn); !ok {
+		t.Errorf("direct connection should win, got %T", conn)
+	}
+	if atomic.LoadInt32(&parent.dialed) != 0 {
+		t.Error("parent should not be dialed before race delay")
+	}
+
+	// Direct connection fails, parent should be dialed without waiting.
+	addr := ln.Addr().String()
+	ln.Close()
+	r = &Request{URL: &URL{}}
+	r.URL.ParseHostPort(addr)
+	vc = siteStat.create(r.URL.Host)
+	start := time.Now()
+	if conn, err = c.raceConnect(r, vc); err != nil {
+		t.Fatal("race connect:", err)
+	}
+	conn.Close()
+	if _, ok := conn.(directConn); ok {
+		t.Error("parent should win when direct connection fails")
+	}
+	if time.Since(start) >= config.RaceDelay {
+		t.Error("parent should be dialed at once after direct connection fails")
+	}
+	if !vc.AsTempBlocked() {
+		t.Error("site should be temp blocked after direct connection fails")
+	}
+	if shouldRace(vc) {
+		t.Error("temp blocked site should not race")
+	}
+}
+
+func TestRaceLoserDirectLate(t *testing.T) {
+	oldSiteStat := siteStat
+	siteStat = newSiteStat()
+	defer func() { siteStat = oldSiteStat }()
+
+	url := &URL{}
+	url.ParseHostPort("late.example.com:443")
+	vc := siteStat.create(url.Host)
+
+	// Parent wins, direct connection completes TCP connect afterwards.
+	direct, peer := net.Pipe()
+	ch := make(chan raceResult, 1)
+	ch <- raceResult{conn: direct, direct: true}
+	raceLoser(url, ch)
+
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Error("late direct connection should be closed")
+	}
+	if vc.Direct != 0 || vc.AsDirect() {
+		t.Error("late direct connection should not mark site direct")
+	}
+	if vc.AsTempBlocked() {
+		t.Error("late direct connection should not mark site temp blocked")
+	}
+	if !shouldRace(vc) {
+		t.Error("site without recorded visit should still race")
+	}
+}
@@ -0,0 +1,538 @@
+// Web dashboard and JSON API served on the http listen address.
+//
+// GET  /                 dashboard page
+// GET  /api/conns        live connections
+// GET  /api/parents      parent proxies with health and latency
+// GET  /api/sites?q=     site stat entries, optionally filtered by host
+// POST /api/site?host=&mark=direct|blocked|auto  same origin only
+// GET  /api/timeouts     current dial/read timeouts, direct and of each parent
+// GET  /api/users        traffic usage and limits of users
+// GET  /api/blocklists   blocklists with hit counts
+// GET  /api/connpool     idle server connections and pool counters
+// GET  /api/har          captured requests as HAR file
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+// liveConn is a request (or tunnel) being served, shown in dashboard.
+type liveConn struct {
+	ID     uint64    `json:"id"`
+	Client string    `json:"client"`
+	User   string    `json:"user"` // empty if client not authenticated by user
+	Target string    `json:"target"`
+	Parent string    `json:"parent"`
+	Start  time.Time `json:"start"`
+	Sent   int64     `json:"sent"` // bytes sent to server, updated atomically
+	Recv   int64     `json:"recv"` // bytes received from server, updated atomically
+}
+
+var liveConns struct {
+	sync.Mutex
+	conn   map[uint64]*liveConn
+	nextID uint64
+}
+
+func init() {
+	liveConns.conn = make(map[uint64]*liveConn)
+}
+
+func startLiveConn(c *clientConn, r *Request, sv *serverConn) *liveConn {
+	lc := &liveConn{
+		Client: c.RemoteAddr().String(),
+		User:   c.user,
+		Target: r.URL.HostPort,
+		Parent: fmt.Sprint(sv.Conn),
+		Start:  time.Now(),
+	}
+	liveConns.Lock()
+	liveConns.nextID++
+	lc.ID = liveConns.nextID
+	liveConns.conn[lc.ID] = lc
+	liveConns.Unlock()
+	sv.live = lc
+	return lc
+}
+
+func (lc *liveConn) end() {
+	liveConns.Lock()
+	delete(liveConns.conn, lc.ID)
+	liveConns.Unlock()
+}
+
+type liveConnInfo struct {
+	liveConn
+	Duration string `json:"duration"`
+}
+
+func getLiveConns() []liveConnInfo {
+	now := time.Now()
+	liveConns.Lock()
+	lst := make([]liveConnInfo, 0, len(liveConns.conn))
+	for _, lc := range liveConns.conn {
+		lst = append(lst, liveConnInfo{
+			liveConn: liveConn{lc.ID, lc.Client, lc.User, lc.Target, lc.Parent, lc.Start,
+				atomic.LoadInt64(&lc.Sent), atomic.LoadInt64(&lc.Recv)},
+			Duration: now.Sub(lc.Start).Truncate(time.Second).String(),
+		})
+	}
+	liveConns.Unlock()
+	sort.Slice(lst, func(i, j int) bool { return lst[i].ID < lst[j].ID })
+	return lst
+}
+
+type parentInfo struct {
+	Type    string `json:"type"`
+	Server  string `json:"server"`
+	Fail    int    `json:"fail"`              // consecutive failures, backup and hash pool
+	Latency string `json:"latency,omitempty"` // latency pool only
+	Healthy bool   `json:"healthy"`
+}
+
+func parentType(p ParentProxy) string {
+	switch p.(type) {
+	case *shadowsocksParent:
+		return "shadowsocks"
+	case *httpParent:
+		return "http"
+	case *socksParent:
+		return "socks5"
+	case *cowParent:
+		return "cow"
+	}
+	return "unknown"
+}
+
+func getParentInfo() []parentInfo {
+	lst := []parentInfo{}
+	switch pp := parentProxy.(type) {
+	case *backupParentPool:
+		for _, p := range pp.parent {
+			lst = append(lst, parentInfo{parentType(p.ParentProxy), p.getServer(), p.fail, "", p.fail == 0})
+		}
+	case *hashParentPool:
+		for _, p := range pp.parent {
+			lst = append(lst, parentInfo{parentType(p.ParentProxy), p.getServer(), p.fail, "", p.fail == 0})
+		}
+	case *latencyParentPool:
+		latencyMutex.RLock()
+		lp := pp.parent
+		latencyMutex.RUnlock()
+		for _, p := range lp {
+			lst = append(lst, parentInfo{parentType(p.ParentProxy), p.getServer(), 0,
+				p.latency.String(), p.latency < latencyMax})
+		}
+	}
+	return lst
+}
+
+type siteInfo struct {
+	Host        string  `json:"host"`
+	Direct      int     `json:"direct"`
+	Blocked     int     `json:"blocked"`
+	Recent      string  `json:"recent"`
+	TempBlocked bool    `json:"temp_blocked"`
+	Status      string  `json:"status"`      // always_direct, always_blocked, direct or blocked
+	BlockScore  float64 `json:"block_score"` // how likely the site is blocked
+	BlockKind   string  `json:"block_kind,omitempty"`
+}
+
+func (vc *VisitCnt) status() string {
+	switch {
+	case vc.AlwaysDirect():
+		return "always_direct"
+	case vc.AlwaysBlocked():
+		return "always_blocked"
+	case vc.AsDirect():
+		return "direct"
+	}
+	return "blocked"
+}
+
+func (ss *SiteStat) getSiteInfo(filter string) []siteInfo {
+	lst := []siteInfo{}
+	ss.vcLock.RLock()
+	for host, vc := range ss.Vcnt {
+		if filter != "" && !strings.Contains(host, filter) {
+			continue
+		}
+		visitLock.Lock()
+		recent := time.Time(vc.Recent)
+		visitLock.Unlock()
+		si := siteInfo{
+			Host:        host,
+			Direct:      int(vc.Direct),
+			Blocked:     int(vc.Blocked),
+			TempBlocked: vc.AsTempBlocked(),
+			Status:      vc.status(),
+		}
+		score, kind := siteBlock.score(host)
+		si.BlockScore, si.BlockKind = score, string(kind)
+		if !recent.IsZero() {
+			si.Recent = recent.Format(dateLayout)
+		}
+		lst = append(lst, si)
+	}
+	ss.vcLock.RUnlock()
+	sort.Slice(lst, func(i, j int) bool { return lst[i].Host < lst[j].Host })
+	return lst
+}
+
+const (
+	markDirect  = "direct"
+	markBlocked = "blocked"
+	markAuto    = "auto"
+)
+
+// markSite makes the host always direct or always blocked, or let COW
+// decide again for "auto". The change is saved to user's direct and blocked
+// list file so it persists upon restart.
+func (ss *SiteStat) markSite(host, mark string) error {
+	var addFile, rmFile string
+	switch mark {
+	case markDirect:
+		ss.setUserSite(host, userCnt, 0, false)
+		addFile, rmFile = config.DirectFile, config.BlockedFile
+	case markBlocked:
+		ss.setUserSite(host, 0, userCnt, false)
+		addFile, rmFile = config.BlockedFile, config.DirectFile
+	case markAuto:
+		ss.vcLock.Lock()
+		delete(ss.Vcnt, host)
+		ss.vcLock.Unlock()
+		if err := updateSiteList(config.DirectFile, host, false); err != nil {
+			return err
+		}
+		return updateSiteList(config.BlockedFile, host, false)
+	default:
+		return fmt.Errorf("invalid mark %q, should be direct, blocked or auto", mark)
+	}
+	if err := updateSiteList(rmFile, host, false); err != nil {
+		return err
+	}
+	return updateSiteList(addFile, host, true)
+}
+
+// updateSiteList adds or removes host in the site list file.
+func updateSiteList(fpath, host string, add bool) error {
+	if fpath == "" {
+		return nil
+	}
+	lst, _ := loadSiteList(fpath)
+	var res []string
+	for _, site := range lst {
+		if site != host {
+			res = append(res, site)
+		}
+	}
+	if add {
+		res = append(res, host)
+	} else if len(res) == len(lst) {
+		return nil // not in the list
+	}
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, site := range res {
+		w.WriteString(site + "\n")
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type parentTimeoutInfo struct {
+	Server string `json:"server"`
+	Dial   string `json:"dial"`
+	Read   string `json:"read"`
+}
+
+type timeoutInfo struct {
+	Dial           string              `json:"dial"` // for direct connection
+	Read           string              `json:"read"`
+	ConfigDial     string              `json:"config_dial"`
+	ConfigRead     string              `json:"config_read"`
+	NetworkBad     bool                `json:"network_bad"`
+	Estimate       bool                `json:"estimate"`
+	EstimateTarget []string            `json:"estimate_target,omitempty"`
+	Parent         []parentTimeoutInfo `json:"parent,omitempty"`
+}
+
+func getTimeoutInfo() timeoutInfo {
+	ti := timeoutInfo{
+		Dial:       dialTimeout.String(),
+		Read:       readTimeout.String(),
+		ConfigDial: config.DialTimeout.String(),
+		ConfigRead: config.ReadTimeout.String(),
+		NetworkBad: networkBad(),
+		Estimate:   config.EstimateTimeout,
+	}
+	if config.EstimateTimeout {
+		ti.EstimateTarget = config.EstimateTarget
+		if len(ti.EstimateTarget) == 0 {
+			ti.EstimateTarget = []string{defaultEstimateTarget}
+		}
+	}
+	for _, p := range parentProxies() {
+		server := p.getServer()
+		if nt := getParentTimeout(server); nt != nil {
+			ti.Parent = append(ti.Parent, parentTimeoutInfo{server,
+				nt.dial.Timeout().String(), nt.read.Timeout().String()})
+		}
+	}
+	return ti
+}
+
+func isDashboardPath(path string) bool {
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path = path[:i]
+	}
+	return path == "/" || path == "/dashboard" || strings.HasPrefix(path, "/api/")
+}
+
+// dashboardAuthed checks client using the same users and allowed clients as
+// the proxy. Browsers send Authorization instead of Proxy-Authorization
+// when visiting the dashboard, so only basic auth is supported.
+func dashboardAuthed(c *clientConn, r *Request) bool {
+	a := authFor(c.proxy)
+	if a == nil {
+		return true
+	}
+	clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if (config.AuthMode == authModeIP && auth.authed.has(clientIP)) || authIP(clientIP) {
+		return true
+	}
+	arr := strings.SplitN(r.Authorization, " ", 2)
+	if len(arr) == 2 && strings.ToLower(arr[0]) == "basic" &&
+		authBasic(c, a, strings.TrimSpace(arr[1])) == nil {
+		if config.AuthMode == authModeIP {
+			auth.authed.addValue(clientIP, c.user)
+		}
+		return true
+	}
+	return false
+}
+
+// dashboardSameOrigin returns true if the request is sent by the dashboard
+// page, i.e. Origin, or Referer if no Origin, has the same host as request.
+func dashboardSameOrigin(r *Request) bool {
+	origin := r.Origin
+	if origin == "" {
+		origin = r.Referer
+	}
+	if origin == "" || origin == "null" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := r.Host
+	if host == "" {
+		host = r.URL.HostPort
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+func sendDashboardResp(c *clientConn, codeReason, contentType string, body []byte, extraHeader string) {
+	head := fmt.Sprintf("HTTP/1.1 %s\r\nServer: cow-proxy\r\n"+
+		"Content-Type: %s\r\nContent-Length: %d\r\n"+
+		"Cache-Control: no-cache\r\nConnection: close\r\n%s\r\n",
+		codeReason, contentType, len(body), extraHeader)
+	if _, err := c.Write(append([]byte(head), body...)); err != nil {
+		debug.Printf("cli(%s) error sending dashboard response: %v\n", c.RemoteAddr(), err)
+	}
+}
+
+func sendJSON(c *clientConn, codeReason string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		errl.Println("dashboard marshal json:", err)
+		codeReason = "500 Internal Server Error"
+		b = []byte(`{"error":"marshal json"}`)
+	}
+	sendDashboardResp(c, codeReason, "application/json", b, "")
+}
+
+func sendJSONError(c *clientConn, codeReason, msg string) {
+	sendJSON(c, codeReason, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func serveDashboard(c *clientConn, r *Request) {
+	if !dashboardAuthed(c, r) {
+		sendDashboardResp(c, "401 Unauthorized", "text/plain", []byte("401 Unauthorized\n"),
+			"WWW-Authenticate: Basic realm=\""+authRealm+"\"\r\n")
+		return
+	}
+	path, query := r.URL.Path, ""
+	if i := strings.IndexByte(path, '?'); i != -1 {
+		path, query = path[:i], path[i+1:]
+	}
+	args, _ := url.ParseQuery(query)
+
+	if r.Method == "POST" && path == "/api/site" {
+		// Browsers send cached credentials with cross site form posts.
+		if !dashboardSameOrigin(r) {
+			sendJSONError(c, "403 Forbidden", "cross origin request")
+			return
+		}
+		host := strings.TrimSpace(args.Get("host"))
+		if host == "" {
+			sendJSONError(c, statusBadReq, "missing host")
+			return
+		}
+		if err := siteStat.markSite(host, args.Get("mark")); err != nil {
+			sendJSONError(c, statusBadReq, err.Error())
+			return
+		}
+		sendJSON(c, "200 OK", siteStat.getSiteInfo(host))
+		return
+	}
+	if r.Method != "GET" {
+		sendJSONError(c, "405 Method Not Allowed", "method not allowed")
+		return
+	}
+	switch path {
+	case "/", "/dashboard":
+		sendDashboardResp(c, "200 OK", "text/html; charset=utf-8", []byte(dashboardPage), "")
+	case "/api/conns":
+		sendJSON(c, "200 OK", getLiveConns())
+	case "/api/parents":
+		sendJSON(c, "200 OK", getParentInfo())
+	case "/api/sites":
+		sendJSON(c, "200 OK", siteStat.getSiteInfo(args.Get("q")))
+	case "/api/timeouts":
+		sendJSON(c, "200 OK", getTimeoutInfo())
+	case "/api/users":
+		sendJSON(c, "200 OK", getUserUsageInfo())
+	case "/api/blocklists":
+		sendJSON(c, "200 OK", getBlockListInfo())
+	case "/api/connpool":
+		sendJSON(c, "200 OK", connPool.getInfo())
+	case "/api/har":
+		b, err := json.Marshal(getHAR())
+		if err != nil {
+			sendJSONError(c, "500 Internal Server Error", err.Error())
+			return
+		}
+		sendDashboardResp(c, "200 OK", "application/json", b,
+			"Content-Disposition: attachment; filename=\""+captureFname+"\"\r\n")
+	default:
+		sendJSONError(c, "404 Not Found", "no such api")
+	}
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>COW Proxy</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>COW Proxy ` + version + `</h1>
+<h2>Timeouts</h2><div id="timeouts"></div>
+<h2>Connection pool</h2><table id="connpool"></table>
+<h2>Parent proxies</h2><table id="parents"></table>
+<h2>Connections</h2><table id="conns"></table>
+<h2>Users</h2><table id="users"></table>
+<h2>Blocklists</h2><table id="blocklists"></table>
+<h2>Sites</h2>
+<input id="q" placeholder="filter host"> <button id="search">Search</button>
+<table id="sites"></table>
+<script>
+function cell(tag, v) {
+	var e = document.createElement(tag);
+	if (v !== undefined && v !== null) {
+		e.textContent = String(v);
+	}
+	return e;
+}
+function table(id, cols, rows, extra) {
+	var t = document.getElementById(id), tr = document.createElement('tr');
+	t.textContent = '';
+	cols.forEach(function(c) { tr.appendChild(cell('th', c)); });
+	if (extra) {
+		tr.appendChild(cell('th'));
+	}
+	t.appendChild(tr);
+	rows.forEach(function(r) {
+		tr = document.createElement('tr');
+		cols.forEach(function(c) { tr.appendChild(cell('td', r[c])); });
+		if (extra) {
+			var td = cell('td');
+			extra(r).forEach(function(e) { td.appendChild(e); });
+			tr.appendChild(td);
+		}
+		t.appendChild(tr);
+	});
+}
+function get(api, f) {
+	fetch(api, {credentials: 'same-origin'}).then(function(r) { return r.json(); }).then(f);
+}
+function loadSites() {
+	get('/api/sites?q=' + encodeURIComponent(document.getElementById('q').value), function(d) {
+		table('sites', ['host', 'status', 'direct', 'blocked', 'temp_blocked', 'recent'], d, function(r) {
+			return ['direct', 'blocked', 'auto'].map(function(m) {
+				var b = cell('button', m);
+				b.addEventListener('click', function() { mark(r.host, m); });
+				return b;
+			});
+		});
+	});
+}
+function mark(host, m) {
+	fetch('/api/site?host=' + encodeURIComponent(host) + '&mark=' + m,
+		{method: 'POST', credentials: 'same-origin'}).then(loadSites);
+}
+function refresh() {
+	get('/api/timeouts', function(d) {
+		document.getElementById('timeouts').textContent = 'direct dial ' + d.dial + ', read ' + d.read +
+			(d.network_bad ? ' (network bad)' : '') + (d.parent || []).map(function(p) {
+				return '; ' + p.server + ' dial ' + p.dial + ', read ' + p.read;
+			}).join('');
+	});
+	get('/api/connpool', function(d) {
+		table('connpool', ['idle', 'hosts', 'hits', 'misses', 'evictions', 'expired'], [d]);
+	});
+	get('/api/parents', function(d) { table('parents', ['type', 'server', 'healthy', 'latency', 'fail'], d); });
+	get('/api/conns', function(d) { table('conns', ['client', 'user', 'target', 'parent', 'sent', 'recv', 'duration'], d); });
+	get('/api/users', function(d) {
+		table('users', ['user', 'month', 'upload', 'download', 'quota', 'rate', 'conns', 'max_conns'], d);
+	});
+	get('/api/blocklists', function(d) {
+		table('blocklists', ['name', 'source', 'domains', 'exceptions', 'hits', 'updated', 'error'], d);
+	});
+}
+document.getElementById('search').addEventListener('click', loadSites);
+refresh();
+loadSites();
+setInterval(refresh, 3000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+const dashboardHost = "127.0.0.1:7777"
+
+func dashboardGet(t *testing.T, method, uri string) (status string, body []byte) {
+	r := &Request{Method: method, URL: &URL{Path: uri}}
+	r.Host, r.Origin = dashboardHost, "http://"+dashboardHost
+	return dashboardServe(t, r)
+}
+
+func dashboardServe(t *testing.T, r *Request) (status string, body []byte) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	c := &clientConn{Conn: srv}
+	go func() {
+		serveDashboard(c, r)
+		srv.Close()
+	}()
+	resp, err := ioutil.ReadAll(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(resp, []byte("\r\n\r\n"))
+	if i == -1 {
+		t.Fatalf("malformed dashboard response %q\n", resp)
+	}
+	return string(resp[:bytes.IndexByte(resp, '\r')]), resp[i+4:]
+}
+
+func TestDashboardSites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDirect, oldBlocked := config.DirectFile, config.BlockedFile
+	config.DirectFile, config.BlockedFile = path.Join(dir, "direct"), path.Join(dir, "blocked")
+	defer func() {
+		config.DirectFile, config.BlockedFile = oldDirect, oldBlocked
+	}()
+	oldSiteStat := siteStat
+	siteStat = newSiteStat()
+	defer func() {
+		siteStat = oldSiteStat
+	}()
+	siteStat.create("www.dashboard.com")
+
+	var sites []siteInfo
+	status, body := dashboardGet(t, "GET", "/api/sites?q=dashboard")
+	if err = json.Unmarshal(body, &sites); err != nil {
+		t.Fatalf("%s %v\n", status, err)
+	}
+	if len(sites) != 1 || sites[0].Host != "www.dashboard.com" || sites[0].Status != "direct" {
+		t.Errorf("sites got %v\n", sites)
+	}
+
+	status, _ = dashboardGet(t, "POST", "/api/site?host=www.dashboard.com&mark=blocked")
+	if status != "HTTP/1.1 200 OK" {
+		t.Fatal("mark site got", status)
+	}
+	if vc := siteStat.get("www.dashboard.com"); vc == nil || !vc.AlwaysBlocked() {
+		t.Error("marked site should be always blocked")
+	}
+	if lst, _ := loadSiteList(config.BlockedFile); len(lst) != 1 || lst[0] != "www.dashboard.com" {
+		t.Errorf("marked site should be saved to blocked list, got %v\n", lst)
+	}
+
+	dashboardGet(t, "POST", "/api/site?host=www.dashboard.com&mark=direct")
+	if vc := siteStat.get("www.dashboard.com"); vc == nil || !vc.AlwaysDirect() {
+		t.Error("marked site should be always direct")
+	}
+	if lst, _ := loadSiteList(config.BlockedFile); len(lst) != 0 {
+		t.Errorf("site marked as direct should be removed from blocked list, got %v\n", lst)
+	}
+
+	dashboardGet(t, "POST", "/api/site?host=www.dashboard.com&mark=auto")
+	if siteStat.get("www.dashboard.com") != nil {
+		t.Error("site marked auto should be removed")
+	}
+	if lst, _ := loadSiteList(config.DirectFile); len(lst) != 0 {
+		t.Errorf("site marked auto should be removed from direct list, got %v\n", lst)
+	}
+
+	// Cross site form posts are rejected.
+	r := &Request{Method: "POST", URL: &URL{Path: "/api/site?host=www.dashboard.com&mark=direct"}}
+	r.Host, r.Origin = dashboardHost, "http://evil.com"
+	if status, _ = dashboardServe(t, r); status != "HTTP/1.1 403 Forbidden" {
+		t.Error("cross origin post got", status)
+	}
+	r.Origin, r.Referer = "", "http://"+dashboardHost+"/"
+	if status, _ = dashboardServe(t, r); status != "HTTP/1.1 200 OK" {
+		t.Error("post with same origin referer got", status)
+	}
+	r.Referer = ""
+	if status, _ = dashboardServe(t, r); status != "HTTP/1.1 403 Forbidden" {
+		t.Error("post without origin got", status)
+	}
+
+	if status, _ = dashboardGet(t, "POST", "/api/site?host=a.com&mark=bad"); status != "HTTP/1.1 "+statusBadReq {
+		t.Error("invalid mark got", status)
+	}
+	if status, _ = dashboardGet(t, "GET", "/api/none"); status != "HTTP/1.1 404 Not Found" {
+		t.Error("unknown api got", status)
+	}
+}
@@ -1,9 +1,25 @@
+// Estimate dial and read timeouts from probes to several targets.
+//
+//	estimateTarget = example.com            # plain HTTP, same as http://
+//	estimateTarget = https://example.com    # TLS handshake
+//	estimateTarget = tcp://example.com:22   # connect only
+//
+// Targets are probed once a minute directly and through each parent proxy.
+// Direct connections and each parent have their own timeouts, which adapt to
+// recent probe results. This avoids incorrectly considering non-blocked sites
+// as blocked when network connection is bad.
+
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,91 +34,378 @@ const maxTimeout = 15 * time.Second
 var dialTimeout = defaultDialTimeout
 var readTimeout = defaultReadTimeout
 
-// estimateTimeout tries to fetch a url and adjust timeout value according to
-// how much time is spent on connect and fetch. This avoids incorrectly
-// considering non-blocked sites as blocked when network connection is bad.
-func estimateTimeout(host string, payload []byte) {
-	//debug.Println("estimating timeout")
-	buf := connectBuf.Get()
-	defer connectBuf.Put(buf)
-	var est time.Duration
-	start := time.Now()
-	c, err := net.Dial("tcp", host+":80")
-	if err != nil {
-		errl.Printf("estimateTimeout: can't connect to %s: %v, network has problem?\n",
-			host, err)
-		goto onErr
+const (
+	estimateIncreaseThresholdPct = 0.33 // increase timeout if more probes fail
+	estimateDecreaseThresholdPct = 0.10 // decrease timeout if less probes fail
+	estimateLogSize              = 16   // number of recent probes kept
+	estimateMinEntries           = 4    // adjust after this number of probes
+	estimatePercentile           = 0.9
+
+	// Estimated timeout is the percentile of probe duration times factor.
+	dialEstimateFactor = 5
+	readEstimateFactor = 10
+
+	estimateInterval = time.Minute
+)
+
+// adaptiveTimeout works like dynamicTimeout in cmd/dynamic-timeouts.go:
+// timeout is increased by 25% if probes hit it too often, and decreased
+// towards recent successful probes otherwise. Adjustment uses a rolling
+// window of recent probes, and a percentile instead of average of successful
+// probes so a few slow probes are not hidden.
+type adaptiveTimeout struct {
+	sync.Mutex
+	timeout time.Duration
+	minimum time.Duration
+	factor  time.Duration
+	log     [estimateLogSize]time.Duration // ring buffer, 0 means failure
+	entries int
+}
+
+func newAdaptiveTimeout(timeout time.Duration, factor time.Duration) *adaptiveTimeout {
+	return &adaptiveTimeout{timeout: timeout, minimum: timeout, factor: factor}
+}
+
+// Timeout returns the current timeout value.
+func (at *adaptiveTimeout) Timeout() time.Duration {
+	at.Lock()
+	defer at.Unlock()
+	return at.timeout
+}
+
+// LogSuccess logs the duration of a successful probe. Probe taking longer
+// than the timeout is logged as failure.
+func (at *adaptiveTimeout) LogSuccess(d time.Duration) {
+	if d <= 0 {
+		d = 1
 	}
-	defer c.Close()
+	if d > at.Timeout() {
+		d = 0
+	}
+	at.logEntry(d)
+}
+
+// LogFailure logs a probe that failed or hit the timeout.
+func (at *adaptiveTimeout) LogFailure() {
+	at.logEntry(0)
+}
+
+func (at *adaptiveTimeout) logEntry(d time.Duration) {
+	at.Lock()
+	defer at.Unlock()
+	at.log[at.entries%estimateLogSize] = d
+	at.entries++
+	if at.entries >= estimateMinEntries {
+		at.adjust()
+	}
+}
+
+// adjust changes the timeout based on entries in log. Caller should hold
+// lock.
+func (at *adaptiveTimeout) adjust() {
+	n := at.entries
+	if n > estimateLogSize {
+		n = estimateLogSize
+	}
+	success := make([]time.Duration, 0, n)
+	for _, d := range at.log[:n] {
+		if d != 0 {
+			success = append(success, d)
+		}
+	}
+	failPct := float64(n-len(success)) / float64(n)
 
-	est = time.Now().Sub(start) * 5
-	// debug.Println("estimated dialTimeout:", est)
-	if est > maxTimeout {
-		est = maxTimeout
+	if failPct > estimateIncreaseThresholdPct {
+		at.timeout = at.timeout * 125 / 100
+	} else if failPct < estimateDecreaseThresholdPct {
+		sort.Slice(success, func(i, j int) bool { return success[i] < success[j] })
+		est := success[int(float64(len(success)-1)*estimatePercentile)] * at.factor
+		// Middle between current timeout and estimate.
+		at.timeout = (at.timeout + est) / 2
+	}
+	if at.timeout < at.minimum {
+		at.timeout = at.minimum
 	}
-	if est > config.DialTimeout {
-		dialTimeout = est
-		debug.Println("new dial timeout:", dialTimeout)
-	} else if dialTimeout != config.DialTimeout {
-		dialTimeout = config.DialTimeout
-		debug.Println("new dial timeout:", dialTimeout)
+	if at.timeout > maxTimeout {
+		at.timeout = maxTimeout
 	}
+}
 
-	start = time.Now()
-	// include time spent on sending request, reading all content to make it a
-	// little longer
+// netTimeout holds timeouts for direct connections or a parent proxy.
+type netTimeout struct {
+	dial *adaptiveTimeout
+	read *adaptiveTimeout
+}
 
-	if _, err = c.Write(payload); err != nil {
-		errl.Println("estimateTimeout: error sending request:", err)
-		goto onErr
+func newNetTimeout() *netTimeout {
+	return &netTimeout{
+		dial: newAdaptiveTimeout(config.DialTimeout, dialEstimateFactor),
+		read: newAdaptiveTimeout(config.ReadTimeout, readEstimateFactor),
 	}
-	for err == nil {
-		_, err = c.Read(buf)
+}
+
+var directTimeout *netTimeout
+
+var parentTimeout struct {
+	sync.RWMutex
+	server map[string]*netTimeout
+}
+
+// getParentTimeout returns timeouts of parent server, nil if not estimated.
+func getParentTimeout(server string) *netTimeout {
+	parentTimeout.RLock()
+	defer parentTimeout.RUnlock()
+	return parentTimeout.server[server]
+}
+
+// parentDialTimeout returns dial timeout for parent server.
+func parentDialTimeout(server string) time.Duration {
+	if nt := getParentTimeout(server); nt != nil {
+		return nt.dial.Timeout()
 	}
-	if err != io.EOF {
-		errl.Printf("estimateTimeout: error getting %s: %v, network has problem?\n",
-			host, err)
-		goto onErr
+	return dialTimeout
+}
+
+// connParentServer returns server of parent proxy for connection, empty if
+// connection is not through parent proxy.
+func connParentServer(c net.Conn) string {
+	if mc, ok := c.(mitmConn); ok {
+		c = mc.under
+	}
+	switch pc := c.(type) {
+	case httpConn:
+		return pc.parent.getServer()
+	case shadowsocksConn:
+		return pc.parent.getServer()
+	case cowConn:
+		return pc.parent.getServer()
+	case socksConn:
+		return pc.parent.getServer()
+	}
+	return ""
+}
+
+type estimateTarget struct {
+	scheme string // http, https or tcp
+	url    *URL
+}
+
+func (t *estimateTarget) String() string {
+	return t.scheme + "://" + t.url.HostPort
+}
+
+func parseEstimateTarget(val string) (*estimateTarget, error) {
+	scheme, host := "http", val
+	if i := strings.Index(val, "://"); i != -1 {
+		scheme, host = val[:i], val[i+3:]
 	}
-	est = time.Now().Sub(start) * 10
-	// debug.Println("estimated read timeout:", est)
-	if est > maxTimeout {
-		est = maxTimeout
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host = host[:i]
 	}
-	if est > time.Duration(config.ReadTimeout) {
-		readTimeout = est
-		debug.Println("new read timeout:", readTimeout)
-	} else if readTimeout != config.ReadTimeout {
-		readTimeout = config.ReadTimeout
-		debug.Println("new read timeout:", readTimeout)
+	if host == "" {
+		return nil, fmt.Errorf("estimateTarget %s: missing host", val)
 	}
-	return
-onErr:
-	dialTimeout += 2 * time.Second
-	readTimeout += 2 * time.Second
+	var port string
+	switch scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("estimateTarget %s: unknown scheme %s", val, scheme)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if port == "" {
+			return nil, fmt.Errorf("estimateTarget %s: tcp target requires port", val)
+		}
+		host = net.JoinHostPort(host, port)
+	}
+	url, err := ParseRequestURI(host)
+	if err != nil {
+		return nil, fmt.Errorf("estimateTarget %s: %v", val, err)
+	}
+	return &estimateTarget{scheme, url}, nil
 }
 
-func runEstimateTimeout() {
-	const estimateReq = "GET / HTTP/1.1\r\n" +
+// isProxyConn returns true if requests on c are sent in proxy form, otherwise
+// c is a tunnel to the target.
+func isProxyConn(c net.Conn) bool {
+	switch c.(type) {
+	case httpConn, cowConn:
+		return true
+	}
+	return false
+}
+
+var errEstimateResponse = errors.New("no response")
+
+// probe records time spent on connecting and on TLS handshake or fetching
+// the target through c.
+func (t *estimateTarget) probe(c net.Conn, nt *netTimeout) {
+	start := time.Now()
+	var err error
+	switch t.scheme {
+	case "tcp":
+		return
+	case "https":
+		if isProxyConn(c) {
+			return
+		}
+		c.SetDeadline(start.Add(maxTimeout))
+		err = tls.Client(c, &tls.Config{ServerName: t.url.Host, InsecureSkipVerify: true}).Handshake()
+	case "http":
+		// Include time spent on sending request, reading all content to make
+		// it a little longer.
+		reqURI := "/"
+		if isProxyConn(c) {
+			reqURI = "http://" + t.url.HostPort + "/"
+		}
+		c.SetDeadline(start.Add(maxTimeout))
+		err = fetchEstimateTarget(c, reqURI, t.url.Host)
+	}
+	if err != nil {
+		errl.Printf("estimateTimeout: error probing %s: %v, network has problem?\n", t, err)
+		nt.read.LogFailure()
+		return
+	}
+	nt.read.LogSuccess(time.Now().Sub(start))
+}
+
+func fetchEstimateTarget(c net.Conn, reqURI, host string) error {
+	const estimateReq = "GET %s HTTP/1.1\r\n" +
 		"Host: %s\r\n" +
-		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.8; rv:11.0) Gecko/20100101 Firefox/11.0\r\n" +
+		"User-Agent: Mozilla/5.0 (Macintosh; Intel Mac OS X 10.8; rv:11.0) Gecko/20100101 Firefox/11.0\r\n" +
 		"Accept: */*\r\n" +
 		"Accept-Language: en-us,en;q=0.5\r\n" +
 		"Accept-Encoding: gzip, deflate\r\n" +
 		"Connection: close\r\n\r\n"
 
+	buf := connectBuf.Get()
+	defer connectBuf.Put(buf)
+	if _, err := fmt.Fprintf(c, estimateReq, reqURI, host); err != nil {
+		return err
+	}
+	var n, total int
+	var err error
+	for err == nil {
+		n, err = c.Read(buf)
+		total += n
+	}
+	if err != io.EOF {
+		return err
+	}
+	if total == 0 {
+		return errEstimateResponse
+	}
+	return nil
+}
+
+// estimateDirect probes target directly.
+func estimateDirect(t *estimateTarget) {
+	start := time.Now()
+	c, err := dialDirect(t.url.HostPort, maxTimeout)
+	if err != nil {
+		errl.Printf("estimateTimeout: can't connect to %s: %v, network has problem?\n", t, err)
+		directTimeout.dial.LogFailure()
+		return
+	}
+	defer c.Close()
+	directTimeout.dial.LogSuccess(time.Now().Sub(start))
+	t.probe(c, directTimeout)
+}
+
+// estimateParent probes target through parent proxy.
+func estimateParent(t *estimateTarget, p ParentProxy, nt *netTimeout) {
+	start := time.Now()
+	c, err := p.connect(t.url)
+	if err != nil {
+		nt.dial.LogFailure()
+		return
+	}
+	defer c.Close()
+	nt.dial.LogSuccess(time.Now().Sub(start))
+	if _, ok := c.(httpConn); ok && t.scheme != "http" {
+		// Needs CONNECT to reach target, only measure connecting to parent.
+		return
+	}
+	t.probe(c, nt)
+}
+
+// parentProxies returns all parent proxies in the pool.
+func parentProxies() []ParentProxy {
+	var lst []ParentProxy
+	switch pp := parentProxy.(type) {
+	case *backupParentPool:
+		for _, p := range pp.parent {
+			lst = append(lst, p.ParentProxy)
+		}
+	case *hashParentPool:
+		for _, p := range pp.parent {
+			lst = append(lst, p.ParentProxy)
+		}
+	case *latencyParentPool:
+		latencyMutex.RLock()
+		for _, p := range pp.parent {
+			lst = append(lst, p.ParentProxy)
+		}
+		latencyMutex.RUnlock()
+	}
+	return lst
+}
+
+func initEstimateTimeout() []*estimateTarget {
 	readTimeout = config.ReadTimeout
 	dialTimeout = config.DialTimeout
+	directTimeout = newNetTimeout()
 
-	payload := []byte(fmt.Sprintf(estimateReq, config.EstimateTarget))
+	parents := parentProxies()
+	parentTimeout.Lock()
+	parentTimeout.server = make(map[string]*netTimeout, len(parents))
+	for _, p := range parents {
+		parentTimeout.server[p.getServer()] = newNetTimeout()
+	}
+	parentTimeout.Unlock()
 
+	vals := config.EstimateTarget
+	if len(vals) == 0 {
+		vals = []string{defaultEstimateTarget}
+	}
+	var targets []*estimateTarget
+	for _, v := range vals {
+		t, err := parseEstimateTarget(v)
+		if err != nil {
+			errl.Println(err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func runEstimateTimeout() {
+	targets := initEstimateTimeout()
+	parents := parentProxies()
 	for {
-		estimateTimeout(config.EstimateTarget, payload)
-		time.Sleep(time.Minute)
+		for _, t := range targets {
+			estimateDirect(t)
+			for _, p := range parents {
+				estimateParent(t, p, getParentTimeout(p.getServer()))
+			}
+		}
+		if dt := directTimeout.dial.Timeout(); dt != dialTimeout {
+			dialTimeout = dt
+			debug.Println("new dial timeout:", dialTimeout)
+		}
+		if rt := directTimeout.read.Timeout(); rt != readTimeout {
+			readTimeout = rt
+			debug.Println("new read timeout:", readTimeout)
+		}
+		time.Sleep(estimateInterval)
 	}
 }
 
-// Guess network status based on doing HTTP request to estimateSite
+// Guess network status based on probes to estimate targets.
 func networkBad() bool {
 	return (readTimeout != config.ReadTimeout) ||
 		(dialTimeout != config.DialTimeout)
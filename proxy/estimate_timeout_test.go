@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	at := newAdaptiveTimeout(defaultDialTimeout, dialEstimateFactor)
+	for i := 0; i < estimateMinEntries; i++ {
+		at.LogFailure()
+	}
+	if to := at.Timeout(); to != defaultDialTimeout*125/100 {
+		t.Errorf("timeout should increase by 25%% after failures, got %v", to)
+	}
+
+	// Slow but successful probes keep the timeout above the minimum.
+	at = newAdaptiveTimeout(defaultDialTimeout, dialEstimateFactor)
+	for i := 0; i < estimateLogSize; i++ {
+		at.LogSuccess(2 * time.Second)
+	}
+	if to := at.Timeout(); to <= defaultDialTimeout || to > maxTimeout {
+		t.Errorf("timeout should be between %v and %v, got %v", defaultDialTimeout, maxTimeout, to)
+	}
+
+	// Fast probes bring the timeout back to the minimum.
+	for i := 0; i < 4*estimateLogSize; i++ {
+		at.LogSuccess(10 * time.Millisecond)
+	}
+	if to := at.Timeout(); to != defaultDialTimeout {
+		t.Errorf("timeout should decrease to %v, got %v", defaultDialTimeout, to)
+	}
+
+	// Probes longer than the timeout count as failures.
+	for i := 0; i < estimateLogSize; i++ {
+		at.LogSuccess(time.Minute)
+	}
+	if to := at.Timeout(); to != maxTimeout {
+		t.Errorf("timeout should be capped at %v, got %v", maxTimeout, to)
+	}
+}
+
+func TestParseEstimateTarget(t *testing.T) {
+	testData := []struct {
+		val    string
+		target string
+		ok     bool
+	}{
+		{"example.com", "http://example.com:80", true},
+		{"http://example.com:8080", "http://example.com:8080", true},
+		{"https://example.com", "https://example.com:443", true},
+		{"tcp://example.com:22", "tcp://example.com:22", true},
+		{"tcp://example.com", "", false},
+		{"ftp://example.com", "", false},
+	}
+	for _, td := range testData {
+		target, err := parseEstimateTarget(td.val)
+		if !td.ok {
+			if err == nil {
+				t.Errorf("%s should be invalid", td.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s parse error: %v", td.val, err)
+			continue
+		}
+		if target.String() != td.target {
+			t.Errorf("%s parsed as %s, should be %s", td.val, target, td.target)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Graceful shutdown and binary upgrade.
+//
+//	shutdownTimeout = 30s   # wait for active connections when exiting
+//
+// On SIGINT or SIGTERM, COW stops accepting connections, closes idle client
+// connections and waits for active requests and tunnels to finish for at most
+// shutdownTimeout before closing them. A second signal closes them at once.
+//
+// On SIGUSR1 (not supported on Windows), COW starts its binary again, which
+// may have been replaced by a new version, and passes listening sockets to the
+// new process. Then the old process drains like above. New connections are
+// queued on the same sockets and accepted by the new process, so upgrading
+// never refuses connections or drops running tunnels. Site stat and user usage
+// are stored before starting the new process, which owns the files since
+// then, so the old process does not store stat of connections being drained.
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+
+	// Listening sockets passed to new process, "addr=fd,addr=fd".
+	listenFdsEnv = "COW_LISTEN_FDS"
+)
+
+var drainPollInterval = 200 * time.Millisecond
+
+// activeConn is a client connection being served.
+type activeConn struct {
+	net.Conn
+	idle      int32       // waiting for the next request
+	idleCheck func() bool // for connections not serving requests by itself
+}
+
+var active = struct {
+	sync.Mutex
+	conns map[*activeConn]bool
+}{conns: make(map[*activeConn]bool)}
+
+var draining int32
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func trackConn(conn net.Conn) *activeConn {
+	ac := &activeConn{Conn: conn}
+	active.Lock()
+	active.conns[ac] = true
+	active.Unlock()
+	return ac
+}
+
+// done is called when connection is closed. Methods of activeConn can be
+// called on nil, which is not tracked.
+func (ac *activeConn) done() {
+	if ac == nil {
+		return
+	}
+	active.Lock()
+	delete(active.conns, ac)
+	active.Unlock()
+}
+
+func (ac *activeConn) setIdle(idle bool) {
+	if ac == nil {
+		return
+	}
+	var v int32
+	if idle {
+		v = 1
+	}
+	atomic.StoreInt32(&ac.idle, v)
+}
+
+func (ac *activeConn) setIdleCheck(fn func() bool) {
+	if ac == nil {
+		return
+	}
+	active.Lock()
+	ac.idleCheck = fn
+	active.Unlock()
+}
+
+// isIdle must be called with lock held.
+func (ac *activeConn) isIdle() bool {
+	if ac.idleCheck != nil {
+		return ac.idleCheck()
+	}
+	return atomic.LoadInt32(&ac.idle) == 1
+}
+
+// closeIdleConns closes idle connections and returns number of connections
+// not finished yet. A connection may be closed just after reading part of the
+// next request, clients retry upon this as for closed keep-alive connection.
+func closeIdleConns() int {
+	active.Lock()
+	defer active.Unlock()
+	for ac := range active.conns {
+		if ac.isIdle() {
+			ac.Close()
+		}
+	}
+	return len(active.conns)
+}
+
+func closeActiveConns() {
+	active.Lock()
+	defer active.Unlock()
+	for ac := range active.conns {
+		ac.Close()
+	}
+}
+
+// drainConns waits active connections to finish in timeout, then closes
+// all of them. Listeners should have been closed.
+func drainConns(timeout time.Duration) {
+	atomic.StoreInt32(&draining, 1)
+	deadline := time.Now().Add(timeout)
+	for {
+		n := closeIdleConns()
+		if n == 0 {
+			return
+		}
+		if !time.Now().Before(deadline) {
+			info.Printf("close %d active connections\n", n)
+			closeActiveConns()
+			return
+		}
+		debug.Printf("waiting %d active connections to finish\n", n)
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// handOff stores site stat and user usage for the new process started by
+// start. Once it's started, stores are stopped so the new process's files are
+// not overwritten.
+func handOff(start func() error) error {
+	storeSiteStat(siteStatCont)
+	storeUserUsage()
+	if err := start(); err != nil {
+		return err
+	}
+	releaseSiteStat()
+	releaseUserUsage()
+	return nil
+}
+
+var listeners = struct {
+	sync.Mutex
+	ln        map[string]net.Listener // by listen address
+	inherited map[string]*os.File     // passed from old process
+}{ln: make(map[string]net.Listener)}
+
+func init() {
+	s := os.Getenv(listenFdsEnv)
+	if s == "" {
+		return
+	}
+	os.Unsetenv(listenFdsEnv)
+	fds, err := parseListenFds(s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "inherit listeners:", err)
+		return
+	}
+	listeners.inherited = make(map[string]*os.File)
+	for addr, fd := range fds {
+		listeners.inherited[addr] = os.NewFile(fd, addr)
+	}
+}
+
+func parseListenFds(s string) (map[string]uintptr, error) {
+	fds := make(map[string]uintptr)
+	for _, f := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(f, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid %s: %s", listenFdsEnv, f)
+		}
+		fd, err := strconv.ParseUint(f[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", listenFdsEnv, f)
+		}
+		fds[f[:i]] = uintptr(fd)
+	}
+	return fds, nil
+}
+
+// listen uses listener inherited from old process if there's one for addr.
+func listen(addr string) (net.Listener, error) {
+	listeners.Lock()
+	f := listeners.inherited[addr]
+	delete(listeners.inherited, addr)
+	listeners.Unlock()
+
+	var ln net.Listener
+	var err error
+	if f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err == nil {
+			info.Printf("listen %s inherited from old process\n", addr)
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	listeners.Lock()
+	listeners.ln[addr] = ln
+	listeners.Unlock()
+	return proxyProtoListen(addr, &registeredListener{ln, addr}), nil
+}
+
+// registeredListener removes itself from listeners when closed.
+type registeredListener struct {
+	net.Listener
+	addr string
+}
+
+func (rl *registeredListener) Close() error {
+	listeners.Lock()
+	if listeners.ln[rl.addr] == rl.Listener {
+		delete(listeners.ln, rl.addr)
+	}
+	listeners.Unlock()
+	return rl.Listener.Close()
+}
+
+// listenerFiles returns duplicated files of listening sockets, and the value
+// of listenFdsEnv for the new process, which gets the files starting from
+// fd 3.
+func listenerFiles() (files []*os.File, env string, err error) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	var fds []string
+	for addr, ln := range listeners.ln {
+		fl, ok := ln.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, "", err
+		}
+		fds = append(fds, addr+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	return files, strings.Join(fds, ","), nil
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseListenFds(t *testing.T) {
+	fds, err := parseListenFds("127.0.0.1:7777=3,[::1]:7778=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fds) != 2 || fds["127.0.0.1:7777"] != 3 || fds["[::1]:7778"] != 4 {
+		t.Errorf("parsed %v", fds)
+	}
+	for _, s := range []string{"127.0.0.1:7777", "127.0.0.1:7777=x", "=3"} {
+		if _, err := parseListenFds(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestDrainConns(t *testing.T) {
+	saved := drainPollInterval
+	defer func() {
+		drainPollInterval = saved
+		draining = 0
+	}()
+	drainPollInterval = 10 * time.Millisecond
+
+	idle, idlePeer := net.Pipe()
+	busy, busyPeer := net.Pipe()
+	defer idlePeer.Close()
+	defer busyPeer.Close()
+	idleAC, busyAC := trackConn(idle), trackConn(busy)
+	idleAC.setIdle(true)
+	closed := func(conn net.Conn) chan bool {
+		ch := make(chan bool, 1)
+		go func() {
+			conn.Read(make([]byte, 1))
+			ch <- true
+		}()
+		return ch
+	}
+	idleClosed, busyClosed := closed(idlePeer), closed(busyPeer)
+	go func() {
+		<-idleClosed
+		idleAC.done()
+	}()
+
+	start := time.Now()
+	done := make(chan bool)
+	go func() {
+		drainConns(100 * time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-busyClosed:
+		t.Fatal("busy connection should not be closed before timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-done
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Error("drain returned before timeout", d)
+	}
+	select {
+	case <-busyClosed:
+	case <-time.After(time.Second):
+		t.Error("busy connection should be closed after timeout")
+	}
+	busyAC.done()
+	if !isDraining() {
+		t.Error("should be draining")
+	}
+	active.Lock()
+	if active.conns[idleAC] || active.conns[busyAC] {
+		t.Error("finished connections should not be tracked")
+	}
+	active.Unlock()
+}
+
+func TestListenInherited(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	listeners.Lock()
+	listeners.inherited = map[string]*os.File{addr: f}
+	listeners.Unlock()
+
+	// Socket is still listening with the inherited file.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	nln, err := listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nln.Close()
+	if _, err = nln.Accept(); err != nil {
+		t.Error("accept on inherited listener:", err)
+	}
+
+	files, fds, err := listenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if m, _ := parseListenFds(fds); m[addr] == 0 {
+		t.Errorf("listener %s not passed to new process: %s", addr, fds)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldStore, oldSiteStat, oldDir := statStore, siteStat, config.dir
+	oldPath, oldUser := usage.path, usage.user
+	defer func() {
+		statStore, siteStat, siteStatFini, config.dir = oldStore, oldSiteStat, false, oldDir
+		usage.path, usage.user, usage.released = oldPath, oldUser, false
+	}()
+	config.dir = dir
+	statPath := path.Join(dir, "stat")
+	statStore = jsonStatStore{statPath}
+	siteStat = newSiteStat()
+	siteStat.create("www.handoff.com")
+	usage.path = path.Join(dir, "usage")
+	usage.user = map[string]*userUsage{"alice": {Month: time.Now().Format(monthLayout)}}
+
+	if err = handOff(func() error { return errors.New("start failed") }); err == nil {
+		t.Fatal("handOff should return error of start")
+	}
+	if siteStatFini || usage.released {
+		t.Fatal("stat should still be stored if new process is not started")
+	}
+
+	err = handOff(func() error {
+		// New process loads files stored before starting.
+		if _, err := os.Stat(statPath); err != nil {
+			return err
+		}
+		_, err := os.Stat(usage.path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New process writes its files while old process is draining.
+	ioutil.WriteFile(statPath, []byte("new"), 0600)
+	ioutil.WriteFile(usage.path, []byte("new"), 0600)
+	usage.user["alice"].Upload = 1024
+	storeSiteStat(siteStatExit)
+	storeUserUsage()
+	for _, p := range []string{statPath, usage.path} {
+		if b, _ := ioutil.ReadFile(p); string(b) != "new" {
+			t.Errorf("%s of new process overwritten after hand off", p)
+		}
+	}
+}
@@ -18,10 +18,11 @@ const (
 )
 
 const (
-	statusBadReq         = "400 Bad Request"
-	statusForbidden      = "403 Forbidden"
-	statusExpectFailed   = "417 Expectation Failed"
-	statusRequestTimeout = "408 Request Timeout"
+	statusBadReq          = "400 Bad Request"
+	statusForbidden       = "403 Forbidden"
+	statusExpectFailed    = "417 Expectation Failed"
+	statusRequestTimeout  = "408 Request Timeout"
+	statusTooManyRequests = "429 Too Many Requests"
 )
 
 var CustomHttpErr = errors.New("CustomHttpErr")
@@ -30,11 +31,17 @@ type Header struct {
 	ContLen             int64
 	KeepAlive           time.Duration
 	ProxyAuthorization  string
+	Authorization       string // only used for requests to cow itself
 	Chunking            bool
 	Trailer             bool
 	ConnectionKeepAlive bool
 	ExpectContinue      bool
+	ExpectUnsupported   bool // expectation other than 100-continue
 	Host                string
+	Origin              string   // only used for requests to cow itself
+	Referer             string   // for access log
+	UserAgent           string   // for access log
+	connHeader          []string // headers listed in Connection header
 }
 
 type rqState byte
@@ -61,8 +68,15 @@ type Request struct {
 	Header
 	isConnect bool
 	partial   bool // whether contains only partial request data
+	bodyRead  bool // request body has been read from client, stored in raw for retry
 	state     rqState
 	tryCnt    byte
+	cache     *cacheReq   // nil if not using response cache
+	capture   *captureReq // nil if not captured
+	mitm      bool        // use TLS to server, e.g. decrypted from intercepted TLS connection
+
+	respRules []*rewriteRule // response rewrite rules matching request host
+	blocked   string         // name of blockList matching request host
 }
 
 // Assume keep-alive request by default.
@@ -154,6 +168,19 @@ func (r *Request) proxyRequestLine() []byte {
 	return r.raw.Bytes()[0:r.reqLnStart]
 }
 
+// rawHeader returns request headers sent to server, ending with the empty line.
+func (r *Request) rawHeader() []byte {
+	return r.raw.Bytes()[r.headStart:r.bodyStart]
+}
+
+// addHeader adds a header line (without CRLF) to request without body.
+func (r *Request) addHeader(line string) {
+	r.raw.Truncate(r.bodyStart - len(CRLF))
+	r.raw.WriteString(line)
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
 func (r *Request) genRequestLine() {
 	// Generate normal HTTP request line
 	r.raw.WriteString(r.Method + " ")
@@ -171,8 +198,9 @@ type Response struct {
 
 	Header
 
-	raw     *bytes.Buffer
-	rawByte []byte
+	raw       *bytes.Buffer
+	rawByte   []byte
+	headerEnd int // end of headers from server, connection headers are added after it
 }
 
 var zeroResponse = Response{Header: Header{ConnectionKeepAlive: true}}
@@ -204,6 +232,12 @@ func (rp *Response) rawResponse() []byte {
 	return rp.raw.Bytes()
 }
 
+// serverHeader returns status line and headers from server, without the
+// connection headers and ending empty line added by COW.
+func (rp *Response) serverHeader() []byte {
+	return rp.raw.Bytes()[:rp.headerEnd]
+}
+
 func (rp *Response) genStatusLine() {
 	rp.raw.Write([]byte("HTTP/1.1 "))
 	rp.raw.WriteString(strconv.Itoa(rp.Status))
@@ -244,9 +278,9 @@ func (url *URL) ParseHostPort(hostPort string) {
 	if err != nil {
 		// Add default 80 and split again. If there's still error this time,
 		// it's not because lack of port number.
-		host = hostPort
+		host = strings.TrimSuffix(strings.TrimPrefix(hostPort, "["), "]")
 		port = "80"
-		hostPort = net.JoinHostPort(hostPort, port)
+		hostPort = net.JoinHostPort(host, port)
 	}
 
 	url.Host = host
@@ -297,18 +331,22 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 	// e.g. google.com:80 and google.com:443 should use different connections.
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil { // missing port
-		host = hostport
+		// IPv6 literal is enclosed in brackets.
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
 		if len(scheme) == 4 {
-			hostport = net.JoinHostPort(host, "80")
 			port = "80"
 		} else {
-			hostport = net.JoinHostPort(host, "443")
 			port = "443"
 		}
 	}
-        // Fixed wechat image url bug, url like http://[::ffff:183.192.196.102]/mmsns/lVxxxxxx
-        host = strings.TrimSuffix(strings.TrimPrefix(host, "[::ffff:"), "]")
-        hostport = net.JoinHostPort(host, port)
+	// Use IPv4 address for IPv4-mapped IPv6 address. Fixed wechat image url
+	// bug, url like http://[::ffff:183.192.196.102]/mmsns/lVxxxxxx
+	if strings.IndexByte(host, ':') != -1 {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			host = ip.To4().String()
+		}
+	}
+	hostport = net.JoinHostPort(host, port)
 	return &URL{hostport, host, port, host2Domain(host), path}, nil
 }
 
@@ -318,11 +356,13 @@ func ParseRequestURIBytes(rawurl []byte) (*URL, error) {
 // Firefox and Safari send this header along with "Connection" header.
 // See more at http://homepage.ntlworld.com/jonathan.deboynepollard/FGA/web-proxy-connection-header.html
 const (
+	headerAuthorization      = "authorization"
 	headerConnection         = "connection"
 	headerContentLength      = "content-length"
 	headerExpect             = "expect"
 	headerHost               = "host"
 	headerKeepAlive          = "keep-alive"
+	headerOrigin             = "origin"
 	headerProxyAuthenticate  = "proxy-authenticate"
 	headerProxyAuthorization = "proxy-authorization"
 	headerProxyConnection    = "proxy-connection"
@@ -331,6 +371,7 @@ const (
 	headerTrailer            = "trailer"
 	headerTransferEncoding   = "transfer-encoding"
 	headerUpgrade            = "upgrade"
+	headerUserAgent          = "user-agent"
 
 	fullHeaderConnectionKeepAlive = "Connection: keep-alive\r\n"
 	fullHeaderConnectionClose     = "Connection: close\r\n"
@@ -339,15 +380,19 @@ const (
 
 // Using Go's method expression
 var headerParser = map[string]HeaderParserFunc{
+	headerAuthorization:      (*Header).parseAuthorization,
 	headerConnection:         (*Header).parseConnection,
 	headerContentLength:      (*Header).parseContentLength,
 	headerExpect:             (*Header).parseExpect,
 	headerHost:               (*Header).parseHost,
 	headerKeepAlive:          (*Header).parseKeepAlive,
+	headerOrigin:             (*Header).parseOrigin,
 	headerProxyAuthorization: (*Header).parseProxyAuthorization,
 	headerProxyConnection:    (*Header).parseConnection,
+	headerReferer:            (*Header).parseReferer,
 	headerTransferEncoding:   (*Header).parseTransferEncoding,
 	headerTrailer:            (*Header).parseTrailer,
+	headerUserAgent:          (*Header).parseUserAgent,
 }
 
 var hopByHopHeader = map[string]bool{
@@ -380,6 +425,13 @@ type HeaderParserFunc func(*Header, []byte) error
 func (h *Header) parseConnection(s []byte) error {
 	ASCIIToLowerInplace(s)
 	h.ConnectionKeepAlive = !bytes.Contains(s, []byte("close"))
+	// Other headers listed are hop-by-hop too, record them for removal.
+	for _, f := range bytes.Split(s, []byte{','}) {
+		name := string(TrimSpace(f))
+		if name != "" && name != "close" && !hopByHopHeader[name] {
+			h.connHeader = append(h.connHeader, name)
+		}
+	}
 	return nil
 }
 
@@ -395,6 +447,21 @@ func (h *Header) parseHost(s []byte) (err error) {
 	return
 }
 
+func (h *Header) parseOrigin(s []byte) error {
+	h.Origin = string(s)
+	return nil
+}
+
+func (h *Header) parseReferer(s []byte) error {
+	h.Referer = string(s)
+	return nil
+}
+
+func (h *Header) parseUserAgent(s []byte) error {
+	h.UserAgent = string(s)
+	return nil
+}
+
 func (h *Header) parseKeepAlive(s []byte) (err error) {
 	ASCIIToLowerInplace(s)
 	id := bytes.Index(s, []byte("timeout="))
@@ -417,6 +484,11 @@ func (h *Header) parseProxyAuthorization(s []byte) error {
 	return nil
 }
 
+func (h *Header) parseAuthorization(s []byte) error {
+	h.Authorization = string(s)
+	return nil
+}
+
 func (h *Header) parseTransferEncoding(s []byte) error {
 	ASCIIToLowerInplace(s)
 	// For transfer-encoding: identify, it's the same as specifying neither
@@ -446,20 +518,16 @@ func (h *Header) parseTrailer(s []byte) error {
 	return nil
 }
 
-// For now, COW does not fully support 100-continue. It will return "417
-// expectation failed" if a request contains expect header. This is one of the
-// strategies supported by polipo, which is easiest to implement in cow.
-// TODO If we see lots of expect 100-continue usage, provide full support.
+// 100-continue is relayed between client and server, see waitContinue. Other
+// expectations get "417 expectation failed".
 
 func (h *Header) parseExpect(s []byte) error {
 	ASCIIToLowerInplace(s)
-	errl.Printf("Expect header: %s\n", s) // put here to see if expect header is widely used
-	h.ExpectContinue = true
-	/*
-		if bytes.Contains(s, []byte("100-continue")) {
-			h.ExpectContinue = true
-		}
-	*/
+	if bytes.Equal(s, []byte("100-continue")) {
+		h.ExpectContinue = true
+	} else {
+		h.ExpectUnsupported = true
+	}
 	return nil
 }
 
@@ -550,9 +618,13 @@ func skipSpace(r *bufio.Reader) int {
 // Only add headers that are of interest for a proxy into request/response's header map.
 func (h *Header) parseHeader(reader *bufio.Reader, raw *bytes.Buffer, url *URL) (err error) {
 	h.ContLen = -1
+	start := raw.Len()
 	for {
 		var line, name, val []byte
 		if line, err = readContinuedLineSlice(reader); err != nil || len(line) == 0 {
+			if err == nil && len(h.connHeader) != 0 {
+				stripConnHeader(raw, start, h.connHeader)
+			}
 			return
 		}
 		if name, val, err = splitHeader(line); err != nil {
@@ -638,7 +710,7 @@ func parseRequest(c *clientConn, r *Request) (err error) {
 	}
 	// The spec says proxy must add Via header. polipo disables this by
 	// default, and I don't want to let others know the user is using COW, so
-	// don't add it.
+	// it's only added by rewriteRequest if the via option is set.
 	r.raw.WriteString(CRLF)
 	r.bodyStart = r.raw.Len()
 	return
@@ -718,9 +790,10 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 
 	if rp.Status == statusCodeContinue && !r.ExpectContinue {
 		// not expecting 100-continue, just ignore it and read final response
-		errl.Println("Ignore server 100 response for", r)
+		debug.Println("Ignore server 100 response for", r)
 		return parseResponse(sv, r, rp)
 	}
+	rewriteResponse(r, rp)
 
 	if rp.Chunking {
 		rp.raw.WriteString(fullHeaderTransferEncoding)
@@ -737,6 +810,7 @@ func parseResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 			rp.raw.WriteString("Content-Length: 0\r\n")
 		}
 	}
+	rp.headerEnd = rp.raw.Len()
 	// Whether COW should respond with keep-alive depends on client request,
 	// not server response.
 	if r.ConnectionKeepAlive {
@@ -29,6 +29,11 @@ func TestParseRequestURI(t *testing.T) {
 		{"simplehost:8080", &URL{"simplehost:8080", "simplehost", "8080", "", ""}},
 		{"192.168.1.1:8080/", &URL{"192.168.1.1:8080", "192.168.1.1", "8080", "", "/"}},
 		{"/helloworld", &URL{"", "", "", "", "/helloworld"}},
+		{"http://[2001:db8::1]/a", &URL{"[2001:db8::1]:80", "2001:db8::1", "80", "2001:db8::1", "/a"}},
+		{"https://[2001:db8::1]", &URL{"[2001:db8::1]:443", "2001:db8::1", "443", "2001:db8::1", ""}},
+		{"[2001:db8::1]:8080", &URL{"[2001:db8::1]:8080", "2001:db8::1", "8080", "2001:db8::1", ""}},
+		{"[fd00::1]:443", &URL{"[fd00::1]:443", "fd00::1", "443", "", ""}},
+		{"http://[::ffff:183.192.196.102]/mmsns", &URL{"183.192.196.102:80", "183.192.196.102", "80", "183.192.196.102", "/mmsns"}},
 	}
 	for _, td := range testData {
 		url, err := ParseRequestURI(td.rawurl)
@@ -4,13 +4,17 @@ package proxy
 // https://groups.google.com/d/msg/golang-nuts/gU7oQGoCkmg/j3nNxuS2O_sJ
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/cyfdecyf/color"
+	"github.com/minio/minio/cmd/logger"
 )
 
 type infoLogging bool
@@ -36,8 +40,15 @@ var (
 
 	verbose  bool
 	colorize bool
+
+	// When running inside the server, info and error logs go through the
+	// server's logger, so json, quiet and anonymous flags apply and server
+	// log targets also receive proxy errors. Debug logs still use logFile.
+	serverLogger bool
 )
 
+const logAPI = "PROXY" // API name in server log entries
+
 func init() {
 	flag.BoolVar((*bool)(&info), "info", true, "info log")
 	flag.BoolVar((*bool)(&debug), "debug", false, "debug log, with this option, log goes to stdout with color")
@@ -70,15 +81,62 @@ func initLog() {
 	responseLog = log.New(logFile, color.Yellow("[<<<<<] "), log.LstdFlags)
 }
 
+// UseServerLogger makes proxy log through the server's logger subsystem.
+// Should be called before Main.
+func UseServerLogger() {
+	serverLogger = true
+}
+
+func logInfo(msg string) {
+	if !serverLogger {
+		log.Print(msg)
+		return
+	}
+	if logger.IsQuiet() && !logger.IsJSON() {
+		return
+	}
+	logger.Info("%s", strings.TrimSuffix(msg, "\n"))
+}
+
+func logError(ctx context.Context, msg string) {
+	if !serverLogger {
+		errorLog.Print(msg)
+		return
+	}
+	if logger.GetReqInfo(ctx) == nil {
+		ctx = logger.SetReqInfo(ctx, &logger.ReqInfo{API: logAPI})
+	}
+	logger.LogIf(ctx, errors.New(strings.TrimSuffix(msg, "\n")))
+}
+
+// logCtx attaches the request being served to context, so errors logged
+// through the server's logger have client, host and parent as tags.
+func (c *clientConn) logCtx(r *Request, sv *serverConn) context.Context {
+	if !serverLogger {
+		return context.Background()
+	}
+	ri := logger.NewReqInfo(c.RemoteAddr().String(), r.UserAgent, "", "", logAPI, "", "")
+	if r.URL != nil {
+		ri.AppendTags("host", r.URL.HostPort)
+	}
+	if c.user != "" {
+		ri.AppendTags("user", c.user)
+	}
+	if sv != nil {
+		ri.AppendTags("parent", fmt.Sprint(sv.Conn))
+	}
+	return logger.SetReqInfo(context.Background(), ri)
+}
+
 func (d infoLogging) Printf(format string, args ...interface{}) {
 	if d {
-		log.Printf(format, args...)
+		logInfo(fmt.Sprintf(format, args...))
 	}
 }
 
 func (d infoLogging) Println(args ...interface{}) {
 	if d {
-		log.Println(args...)
+		logInfo(fmt.Sprintln(args...))
 	}
 }
 
@@ -96,13 +154,20 @@ func (d debugLogging) Println(args ...interface{}) {
 
 func (d errorLogging) Printf(format string, args ...interface{}) {
 	if d {
-		errorLog.Printf(format, args...)
+		logError(context.Background(), fmt.Sprintf(format, args...))
 	}
 }
 
 func (d errorLogging) Println(args ...interface{}) {
 	if d {
-		errorLog.Println(args...)
+		logError(context.Background(), fmt.Sprintln(args...))
+	}
+}
+
+// PrintfCtx logs with request info in ctx, which is returned by logCtx.
+func (d errorLogging) PrintfCtx(ctx context.Context, format string, args ...interface{}) {
+	if d {
+		logError(ctx, fmt.Sprintf(format, args...))
 	}
 }
 
@@ -119,11 +184,17 @@ func (d responseLogging) Printf(format string, args ...interface{}) {
 }
 
 func Fatal(args ...interface{}) {
+	if serverLogger {
+		logger.FatalIf(errors.New(strings.TrimSuffix(fmt.Sprintln(args...), "\n")), "Unable to run proxy")
+	}
 	fmt.Println(args...)
 	os.Exit(1)
 }
 
 func Fatalf(format string, args ...interface{}) {
+	if serverLogger {
+		logger.FatalIf(errors.New(strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")), "Unable to run proxy")
+	}
 	fmt.Printf(format, args...)
 	os.Exit(1)
 }
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/minio/minio/cmd/logger"
+)
+
+func TestLogCtx(t *testing.T) {
+	serverLogger = true
+	defer func() { serverLogger = false }()
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	c := &clientConn{Conn: srv, user: "alice"}
+	url, _ := ParseRequestURI("http://www.example.com/index.html")
+	r := &Request{Method: "GET", URL: url}
+	r.UserAgent = "curl/7.64"
+	sv := &serverConn{Conn: directConn{}}
+
+	ri := logger.GetReqInfo(c.logCtx(r, sv))
+	if ri == nil {
+		t.Fatal("no request info in log context")
+	}
+	if ri.API != logAPI || ri.UserAgent != "curl/7.64" {
+		t.Errorf("request info got api %s user agent %s", ri.API, ri.UserAgent)
+	}
+	tags := make(map[string]string)
+	for _, kv := range ri.GetTags() {
+		tags[kv.Key] = kv.Val
+	}
+	if tags["host"] != "www.example.com:80" || tags["user"] != "alice" ||
+		tags["parent"] != "direct connection" {
+		t.Errorf("request info tags got %v", tags)
+	}
+
+	ri = logger.GetReqInfo(c.logCtx(r, nil))
+	for _, kv := range ri.GetTags() {
+		if kv.Key == "parent" {
+			t.Error("parent tag should not be set without server connection")
+		}
+	}
+}
@@ -6,14 +6,10 @@ import (
 	"os/exec"
 	"runtime"
 	"sync"
-	"syscall"
 )
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-var (
-	quit     chan struct{}
-	relaunch bool
-)
+var quit chan struct{}
 
 // This code is from goagain
 func lookPath() (argv0 string, err error) {
@@ -40,8 +36,18 @@ func Main() {
 
 	initSelfListenAddr()
 	initLog()
+	initProxyProtocol()
+	initConnPool()
+	initAccessLog()
+	initCapture()
 	initAuth()
+	initUserUsage()
+	initCache()
+	initMITM()
+	initRewrite()
+	initBlockList()
 	initSiteStat()
+	initBlockDetect()
 	initPAC() // initPAC uses siteStat, so must init after site stat
 
 	initStat()
@@ -77,20 +83,12 @@ func Main() {
 	}
 
 	wg.Wait()
-
-	if relaunch {
-		info.Println("Relunching cow...")
-		// Need to fork me.
-		argv0, err := lookPath()
-		if nil != err {
-			errl.Println(err)
-			return
-		}
-
-		err = syscall.Exec(argv0, os.Args, os.Environ())
-		if err != nil {
-			errl.Println(err)
-		}
-	}
+	// Listeners are closed, wait for client connections.
+	drainConns(config.ShutdownTimeout)
+	// Store after draining, so stat of draining connections is not lost and
+	// they don't record site events after stat store is closed. No-op after
+	// upgrade, as stat files are owned by the new process.
+	storeSiteStat(siteStatExit)
+	storeUserUsage()
 	debug.Println("the main process is , exiting...")
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ package proxy
 
 import (
 	"os"
+	"os/exec"
 	"os/signal"
 	"syscall"
 )
@@ -11,17 +12,28 @@ import (
 
 func sigHandler() {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
 
+	var exiting bool
 	for sig := range sigChan {
-		// May handle other signals in the future.
-		info.Printf("%v caught, exit\n", sig)
-		storeSiteStat(siteStatExit)
+		if sig == syscall.SIGUSR2 {
+			writeHARFile()
+			continue
+		}
+		if exiting {
+			info.Printf("%v caught again, close active connections\n", sig)
+			closeActiveConns()
+			continue
+		}
 		if sig == syscall.SIGUSR1 {
-			relaunch = true
+			if err := handOff(startUpgrade); err != nil {
+				errl.Println("upgrade:", err)
+				continue
+			}
 		}
+		info.Printf("%v caught, exit\n", sig)
+		exiting = true
 		close(quit)
-		break
 	}
 	/*
 		if *cpuprofile != "" {
@@ -29,3 +41,29 @@ func sigHandler() {
 		}
 	*/
 }
+
+// startUpgrade starts new process which inherits listening sockets.
+func startUpgrade() error {
+	argv0, err := lookPath()
+	if err != nil {
+		return err
+	}
+	files, fds, err := listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	cmd := exec.Command(argv0, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenFdsEnv+"="+fds)
+	cmd.ExtraFiles = files
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	info.Printf("started new process %d, draining connections\n", cmd.Process.Pid)
+	return nil
+}
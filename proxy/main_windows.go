@@ -15,13 +15,8 @@ func sigHandler() {
 	for sig := range sigChan {
 		// May handle other signals in the future.
 		info.Printf("%v caught, exit\n", sig)
-		storeSiteStat(siteStatExit)
-		// Windows has no SIGUSR1 signal, so relaunching is not supported now.
-		/*
-			if sig == syscall.SIGUSR1 {
-				relaunch = true
-			}
-		*/
+		// Windows has no SIGUSR1 signal, and can't pass listening sockets to
+		// new process, so upgrading is not supported now.
 		close(quit)
 		break
 	}
@@ -0,0 +1,320 @@
+// TLS interception for selected domains.
+//
+//	mitmCA = ~/.cow/ca.pem         # CA certificate signing generated certs
+//	mitmCAKey = ~/.cow/ca-key.pem
+//	mitmDomain = example.com       # intercept CONNECT to these domains, * for all
+//	mitmBypass = pinned.example.com  # never intercept, e.g. apps pinning certs
+//	mitmCertDir = ~/.cow/mitm      # generated certs, default is mitm in config dir
+//
+// Client TLS is terminated with a certificate generated for the CONNECT host,
+// handshakes with a different SNI are rejected. Decrypted requests go through
+// the same request pipeline as plain HTTP requests. Connections to server use
+// TLS again, through CONNECT tunnel for http and cow parent proxies.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mitmCertLifetime = 365 * 24 * time.Hour
+	// Regenerate cert that expires soon.
+	mitmCertMinValid = 24 * time.Hour
+	mitmCertDirName  = "mitm"
+	mitmPoolPrefix   = "tls:"
+)
+
+// mitmCert generates and caches certificates signed by the CA.
+var mitmCert struct {
+	sync.Mutex
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	dir   string
+	cert  map[string]*tls.Certificate // host -> cert
+}
+
+func initMITM() {
+	if config.MITMCA == "" {
+		if len(config.MITMDomain) != 0 {
+			Fatal("mitmDomain requires mitmCA and mitmCAKey")
+		}
+		return
+	}
+	if config.MITMCAKey == "" {
+		Fatal("mitmCA requires mitmCAKey")
+	}
+	pair, err := tls.LoadX509KeyPair(config.MITMCA, config.MITMCAKey)
+	if err != nil {
+		Fatal("load mitm CA:", err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		Fatal("parse mitm CA:", err)
+	}
+	if !ca.IsCA {
+		Fatal("mitmCA is not a CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		Fatal("mitmCAKey not supported")
+	}
+	dir := config.MITMCertDir
+	if dir == "" {
+		dir = filepath.Join(config.dir, mitmCertDirName)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		Fatal("create mitm cert dir:", err)
+	}
+	mitmCert.ca, mitmCert.caKey, mitmCert.dir = ca, key, dir
+	mitmCert.cert = make(map[string]*tls.Certificate)
+}
+
+// shouldIntercept returns whether CONNECT to host should be intercepted.
+func shouldIntercept(host string) bool {
+	if mitmCert.ca == nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	return hostInDomains(host, config.MITMDomain) && !hostInDomains(host, config.MITMBypass)
+}
+
+// hostInDomains returns whether host is one of the domains or their
+// subdomains. "*" matches all hosts.
+func hostInDomains(host string, domains []string) bool {
+	for _, d := range domains {
+		if d == "*" || host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func mitmCertValid(cert *tls.Certificate) bool {
+	return cert.Leaf != nil && time.Now().Add(mitmCertMinValid).Before(cert.Leaf.NotAfter)
+}
+
+func mitmCertPath(host string) string {
+	// IPv6 address contains ':', which is not allowed in file names on Windows.
+	return filepath.Join(mitmCert.dir, strings.Replace(host, ":", "_", -1)+".pem")
+}
+
+// getMITMCert returns certificate for host, loading from disk or generating
+// a new one if not in memory.
+func getMITMCert(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	mitmCert.Lock()
+	defer mitmCert.Unlock()
+	if cert, ok := mitmCert.cert[host]; ok && mitmCertValid(cert) {
+		return cert, nil
+	}
+	cert, err := loadMITMCert(host)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debug.Println("load mitm cert:", err)
+		}
+		if cert, err = genMITMCert(host); err != nil {
+			return nil, err
+		}
+	}
+	mitmCert.cert[host] = cert
+	return cert, nil
+}
+
+func loadMITMCert(host string) (*tls.Certificate, error) {
+	fpath := mitmCertPath(host)
+	cert, err := tls.LoadX509KeyPair(fpath, fpath)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	// CA may have been changed.
+	if err = cert.Leaf.CheckSignatureFrom(mitmCert.ca); err != nil {
+		return nil, err
+	}
+	if !mitmCertValid(&cert) {
+		return nil, errors.New("mitm cert expires for " + host)
+	}
+	return &cert, nil
+}
+
+func genMITMCert(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour), // tolerate client clock skew
+		NotAfter:     now.Add(mitmCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if tmpl.NotAfter.After(mitmCert.ca.NotAfter) {
+		tmpl.NotAfter = mitmCert.ca.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, mitmCert.ca, &key.PublicKey, mitmCert.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, mitmCert.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	if err = saveMITMCert(host, cert, key); err != nil {
+		errl.Println("save mitm cert:", err)
+	}
+	debug.Println("generated mitm cert for", host)
+	return cert, nil
+}
+
+func saveMITMCert(host string, cert *tls.Certificate, key *ecdsa.PrivateKey) error {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+
+	// Write to temp file and rename, so concurrent readers never see partial
+	// content.
+	f, err := ioutil.TempFile(mitmCert.dir, "cert")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), mitmCertPath(host))
+}
+
+// prefixConn returns data buffered by client reader before reading from
+// connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (pc *prefixConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+// mitmCertFor returns GetCertificate func that only issues certificate for
+// the CONNECT host. Handshakes with other SNI are rejected, otherwise a client
+// allowed to connect to one host could get certificates signed by our CA for
+// any host.
+func mitmCertFor(host string) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		sni := strings.TrimSuffix(hello.ServerName, ".")
+		if sni != "" && !strings.EqualFold(sni, host) {
+			return nil, fmt.Errorf("sni %s differs from connect host %s", hello.ServerName, host)
+		}
+		return getMITMCert(host)
+	}
+}
+
+// intercept terminates client TLS for CONNECT request, and serves decrypted
+// requests with a new client connection until it's closed.
+func (c *clientConn) intercept(r *Request) error {
+	if _, err := c.Write(connEstablished); err != nil {
+		return err
+	}
+	var conn net.Conn = c.Conn
+	if n := c.bufRd.Buffered(); n > 0 {
+		b, _ := c.bufRd.Peek(n)
+		conn = &prefixConn{c.Conn, io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), c.Conn)}
+	}
+	c.releaseBuf()
+
+	tc := tls.Server(conn, &tls.Config{GetCertificate: mitmCertFor(r.URL.Host)})
+	setConnReadTimeout(c.Conn, clientConnTimeout, "mitm handshake")
+	if err := tc.Handshake(); err != nil {
+		// Clients pinning certificates fail here, they should be added to
+		// mitmBypass.
+		return fmt.Errorf("mitm handshake with client for %s: %v", r.URL.HostPort, err)
+	}
+	unsetConnReadTimeout(c.Conn, "mitm handshake")
+	if debug {
+		debug.Printf("cli(%s) intercepting %s\n", c.RemoteAddr(), r.URL.HostPort)
+	}
+
+	mc := newClientConn(tc, c.proxy)
+	mc.user, mc.authHeader, mc.usage = c.user, c.authHeader, c.usage
+	c.usage = nil // released when mc is closed
+	mc.mitm = r.URL
+	mc.serve()
+	return nil
+}
+
+// mitmConn is TLS connection to server for intercepted requests.
+type mitmConn struct {
+	*tls.Conn
+	under net.Conn // connection type to server, e.g. directConn
+}
+
+func (mc mitmConn) String() string {
+	return fmt.Sprint(mc.under)
+}
+
+// connectTLS establishes TLS connection to server for intercepted request over
+// conn.
+func connectTLS(r *Request, conn net.Conn) (net.Conn, error) {
+	conn, err := parentTunnel(conn, r.URL)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, &tls.Config{ServerName: r.URL.Host})
+	setConnReadTimeout(conn, readTimeout, "mitm handshake")
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	unsetConnReadTimeout(conn, "mitm handshake")
+	return mitmConn{tc, conn}, nil
+}
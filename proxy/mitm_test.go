@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShouldIntercept(t *testing.T) {
+	saved := mitmCert.ca
+	savedDomain, savedBypass := config.MITMDomain, config.MITMBypass
+	defer func() {
+		mitmCert.ca = saved
+		config.MITMDomain, config.MITMBypass = savedDomain, savedBypass
+	}()
+
+	config.MITMDomain = []string{"example.com"}
+	config.MITMBypass = []string{"pinned.example.com"}
+	mitmCert.ca = nil
+	if shouldIntercept("www.example.com") {
+		t.Error("should not intercept without CA")
+	}
+	mitmCert.ca = &x509.Certificate{}
+
+	testData := []struct {
+		host      string
+		intercept bool
+	}{
+		{"example.com", true},
+		{"WWW.Example.com", true},
+		{"notexample.com", false},
+		{"pinned.example.com", false},
+		{"api.pinned.example.com", false},
+		{"google.com", false},
+	}
+	for _, td := range testData {
+		if shouldIntercept(td.host) != td.intercept {
+			t.Errorf("%s intercept should be %v", td.host, td.intercept)
+		}
+	}
+
+	config.MITMDomain = []string{"*"}
+	if !shouldIntercept("google.com") {
+		t.Error("* should intercept all hosts")
+	}
+}
+
+func setupTestCA(t *testing.T, dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cow test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * 30 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mitmCert.ca, mitmCert.caKey, mitmCert.dir = ca, key, dir
+	mitmCert.cert = make(map[string]*tls.Certificate)
+}
+
+func TestMITMCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setupTestCA(t, dir)
+	defer func() { mitmCert.ca = nil }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(mitmCert.ca)
+	for _, host := range []string{"www.example.com", "127.0.0.1"} {
+		cert, err := getMITMCert(host)
+		if err != nil {
+			t.Fatalf("get cert for %s: %v", host, err)
+		}
+		if _, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("verify cert for %s: %v", host, err)
+		}
+		if c, _ := getMITMCert(host); c != cert {
+			t.Errorf("cert for %s not cached in memory", host)
+		}
+	}
+
+	cert := mitmCert.cert["www.example.com"]
+	mitmCert.cert = make(map[string]*tls.Certificate)
+	loaded, err := getMITMCert("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Leaf.Raw, cert.Leaf.Raw) {
+		t.Error("cert not loaded from disk")
+	}
+
+	// Certs signed by other CA are regenerated.
+	setupTestCA(t, dir)
+	if c, err := getMITMCert("www.example.com"); err != nil || bytes.Equal(c.Leaf.Raw, cert.Leaf.Raw) {
+		t.Error("cert signed by old CA should be regenerated")
+	}
+}
+
+func TestMITMCertFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setupTestCA(t, dir)
+	defer func() { mitmCert.ca = nil }()
+
+	getCert := mitmCertFor("www.example.com")
+	for _, sni := range []string{"", "www.example.com", "WWW.Example.com."} {
+		cert, err := getCert(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil {
+			t.Errorf("sni %q: %v", sni, err)
+			continue
+		}
+		if err = cert.Leaf.VerifyHostname("www.example.com"); err != nil {
+			t.Errorf("sni %q: %v", sni, err)
+		}
+	}
+	if _, err := getCert(&tls.ClientHelloInfo{ServerName: "www.other.com"}); err == nil {
+		t.Error("sni different from connect host should be rejected")
+	}
+}
+
+func TestParentTunnel(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		n, _ := srv.Read(buf)
+		if !bytes.HasPrefix(buf[:n], []byte("CONNECT www.example.com:443 HTTP/1.1\r\n")) ||
+			!bytes.Contains(buf[:n], []byte("Proxy-Authorization: Basic Zm9vOmJhcg==\r\n")) {
+			srv.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		srv.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nTLS"))
+	}()
+	parent := &httpParent{authHeader: []byte("Proxy-Authorization: Basic Zm9vOmJhcg==\r\n")}
+	u := &URL{}
+	u.ParseHostPort("www.example.com:443")
+	if _, err := parentTunnel(httpConn{cli, parent, ""}, u); err != nil {
+		t.Fatal(err)
+	}
+	// Data after response header should not be consumed.
+	b := make([]byte, 3)
+	if _, err := cli.Read(b); err != nil || string(b) != "TLS" {
+		t.Errorf("read after CONNECT got %q %v", b, err)
+	}
+}
@@ -0,0 +1,576 @@
+// Stream multiplexing over connections between cow instances.
+//
+// Client asks cow parent to upgrade a new connection with
+//
+//	GET /cowmux HTTP/1.1
+//	Upgrade: cowmux/1
+//
+// Old versions treat this as request to cow itself and respond 404, client
+// then uses a connection for each request as before. After "101 Switching
+// Protocols", both sides exchange frames:
+//
+//	version(1) cmd(1) length(2) stream id(4) data(length)
+//
+// Client opens streams with odd ids, each serves requests like a cow
+// connection. Receiver of a stream sends window update after consuming data,
+// sender waits if the peer window is used up. Keepalive frames are sent
+// periodically and the session is closed if nothing is received in time.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	muxVersion = 1
+
+	muxSYN = 0 // open stream
+	muxFIN = 1 // close stream
+	muxPSH = 2 // data
+	muxNOP = 3 // keepalive
+	muxUPD = 4 // window update, data is 4 bytes credit
+
+	muxHeaderLen = 8
+	muxMaxFrame  = 16 * 1024
+	muxWindow    = 256 * 1024 // receive window for each stream
+
+	muxKeepAlive        = 10 * time.Second
+	muxKeepAliveTimeout = 30 * time.Second
+	muxAcceptBacklog    = 256
+
+	defaultCowMuxConns = 4
+	// Open another session to parent if all have this many streams.
+	muxSessionStreams = 64
+	// Try upgrading again after this long if parent doesn't support mux.
+	muxRetryInterval = 10 * time.Minute
+
+	muxUpgradePath = "/cowmux"
+	muxProtocol    = "cowmux/1"
+)
+
+var (
+	errMuxClosed       = errors.New("mux session closed")
+	errMuxStreamClosed = errors.New("use of closed mux stream")
+	errMuxUnsupported  = errors.New("parent does not support mux")
+	errMuxProtocol     = errors.New("mux protocol error")
+
+	muxUpgradeRequest  = []byte("GET " + muxUpgradePath + " HTTP/1.1\r\nConnection: Upgrade\r\nUpgrade: " + muxProtocol + "\r\n\r\n")
+	muxUpgradeResponse = []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + muxProtocol + "\r\n\r\n")
+)
+
+type muxTimeoutError struct{}
+
+func (muxTimeoutError) Error() string   { return "mux stream i/o timeout" }
+func (muxTimeoutError) Timeout() bool   { return true }
+func (muxTimeoutError) Temporary() bool { return true }
+
+type muxSession struct {
+	conn     net.Conn
+	nextID   uint32 // updated atomically
+	lastRecv int64  // unix nano of last received frame, updated atomically
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+
+	wmu     sync.Mutex // serializes writing frames
+	accept  chan *muxStream
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		nextID:  2,
+		streams: make(map[uint32]*muxStream),
+		accept:  make(chan *muxStream, muxAcceptBacklog),
+		die:     make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+	go s.recvLoop()
+	go s.keepAlive()
+	return s
+}
+
+func (s *muxSession) Close() error {
+	s.dieOnce.Do(func() {
+		close(s.die)
+		s.conn.Close()
+	})
+	return nil
+}
+
+func (s *muxSession) isClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	n := len(s.streams)
+	s.mu.Unlock()
+	return n
+}
+
+func (s *muxSession) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *muxSession) writeFrame(cmd byte, id uint32, data []byte) error {
+	b := make([]byte, muxHeaderLen+len(data))
+	b[0] = muxVersion
+	b[1] = cmd
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(b[4:], id)
+	copy(b[muxHeaderLen:], data)
+
+	s.wmu.Lock()
+	// Peer not reading for long is treated as dead.
+	s.conn.SetWriteDeadline(time.Now().Add(muxKeepAliveTimeout))
+	_, err := s.conn.Write(b)
+	s.wmu.Unlock()
+	if err != nil {
+		s.Close()
+		return errMuxClosed
+	}
+	return nil
+}
+
+func (s *muxSession) openStream() (*muxStream, error) {
+	if s.isClosed() {
+		return nil, errMuxClosed
+	}
+	id := atomic.AddUint32(&s.nextID, 2) - 2
+	st := newMuxStream(id, s)
+	s.mu.Lock()
+	s.streams[id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(muxSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) acceptStream() (*muxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.die:
+		return nil, errMuxClosed
+	}
+}
+
+func (s *muxSession) recvLoop() {
+	defer s.Close()
+	hdr := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			debug.Printf("mux session %s read: %v\n", s.conn.RemoteAddr(), err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+		if hdr[0] != muxVersion {
+			errl.Printf("mux session %s: unknown version %d\n", s.conn.RemoteAddr(), hdr[0])
+			return
+		}
+		cmd := hdr[1]
+		id := binary.BigEndian.Uint32(hdr[4:])
+		var data []byte
+		if n := binary.BigEndian.Uint16(hdr[2:]); n > 0 {
+			data = make([]byte, n)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				debug.Printf("mux session %s read: %v\n", s.conn.RemoteAddr(), err)
+				return
+			}
+		}
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+
+		var err error
+		switch cmd {
+		case muxSYN:
+			if st != nil {
+				err = errMuxProtocol
+				break
+			}
+			st = newMuxStream(id, s)
+			s.mu.Lock()
+			s.streams[id] = st
+			s.mu.Unlock()
+			select {
+			case s.accept <- st:
+			default:
+				debug.Printf("mux session %s: too many pending streams\n", s.conn.RemoteAddr())
+				s.removeStream(id)
+				s.writeFrame(muxFIN, id, nil)
+			}
+		case muxPSH:
+			// Data for closed stream is dropped.
+			if st != nil {
+				err = st.pushData(data)
+			}
+		case muxFIN:
+			if st != nil {
+				st.finReceived()
+			}
+		case muxUPD:
+			if len(data) != 4 {
+				err = errMuxProtocol
+			} else if st != nil {
+				st.addCredit(int(binary.BigEndian.Uint32(data)))
+			}
+		case muxNOP:
+		default:
+			err = errMuxProtocol
+		}
+		if err != nil {
+			errl.Printf("mux session %s cmd %d stream %d: %v\n", s.conn.RemoteAddr(), cmd, id, err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) keepAlive() {
+	tick := time.NewTicker(muxKeepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			last := time.Unix(0, atomic.LoadInt64(&s.lastRecv))
+			if time.Now().Sub(last) > muxKeepAliveTimeout {
+				errl.Printf("mux session %s: keepalive timeout\n", s.conn.RemoteAddr())
+				s.Close()
+				return
+			}
+			s.writeFrame(muxNOP, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// muxStream is a logical connection in mux session.
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	consumed   int // bytes read but not yet acknowledged to peer
+	credit     int // bytes can be sent before window update from peer
+	finRecv    bool
+	closed     bool
+	rdDeadline time.Time
+	wrDeadline time.Time
+	readEv     chan struct{}
+	writeEv    chan struct{}
+}
+
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	return &muxStream{
+		id:      id,
+		sess:    sess,
+		credit:  muxWindow,
+		readEv:  make(chan struct{}, 1),
+		writeEv: make(chan struct{}, 1),
+	}
+}
+
+func notifyEvent(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) pushData(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.buf.Len()+st.consumed+len(data) > muxWindow {
+		return errors.New("receive window exceeded")
+	}
+	st.buf.Write(data)
+	notifyEvent(st.readEv)
+	return nil
+}
+
+func (st *muxStream) finReceived() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notifyEvent(st.readEv)
+	notifyEvent(st.writeEv)
+}
+
+func (st *muxStream) addCredit(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	notifyEvent(st.writeEv)
+}
+
+// wait waits for event on ev, session close or deadline.
+func (st *muxStream) wait(ev chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := deadline.Sub(time.Now())
+		if d <= 0 {
+			return muxTimeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ev:
+		return nil
+	case <-st.sess.die:
+		return nil // checked by caller
+	case <-timeout:
+		return muxTimeoutError{}
+	}
+}
+
+func (st *muxStream) Read(b []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, errMuxStreamClosed
+		}
+		if st.buf.Len() > 0 {
+			n, _ = st.buf.Read(b)
+			st.consumed += n
+			var upd int
+			if st.consumed >= muxWindow/2 {
+				upd, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if upd > 0 {
+				credit := make([]byte, 4)
+				binary.BigEndian.PutUint32(credit, uint32(upd))
+				st.sess.writeFrame(muxUPD, st.id, credit)
+			}
+			return n, nil
+		}
+		fin, deadline := st.finRecv, st.rdDeadline
+		st.mu.Unlock()
+		if fin {
+			return 0, io.EOF
+		}
+		if st.sess.isClosed() {
+			return 0, errMuxClosed
+		}
+		if err = st.wait(st.readEv, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return n, errMuxStreamClosed
+		}
+		if st.finRecv {
+			// Peer has closed the stream.
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		}
+		if st.credit == 0 {
+			deadline := st.wrDeadline
+			st.mu.Unlock()
+			if st.sess.isClosed() {
+				return n, errMuxClosed
+			}
+			if err = st.wait(st.writeEv, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		sz := len(b)
+		if sz > st.credit {
+			sz = st.credit
+		}
+		if sz > muxMaxFrame {
+			sz = muxMaxFrame
+		}
+		st.credit -= sz
+		st.mu.Unlock()
+		if err = st.sess.writeFrame(muxPSH, st.id, b[:sz]); err != nil {
+			return n, err
+		}
+		n += sz
+		b = b[sz:]
+	}
+	return n, nil
+}
+
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.mu.Unlock()
+	notifyEvent(st.readEv)
+	notifyEvent(st.writeEv)
+	st.sess.removeStream(st.id)
+	if st.sess.isClosed() {
+		return nil
+	}
+	return st.sess.writeFrame(muxFIN, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rdDeadline = t
+	st.mu.Unlock()
+	notifyEvent(st.readEv)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wrDeadline = t
+	st.mu.Unlock()
+	notifyEvent(st.writeEv)
+	return nil
+}
+
+// muxUpgrade asks cow parent to upgrade conn to mux session. Returns
+// errMuxUnsupported if parent does not support it.
+func muxUpgrade(conn net.Conn) error {
+	code, _, err := parentRoundTrip(conn, muxUpgradeRequest, "mux upgrade")
+	if err != nil {
+		return err
+	}
+	if code != "101" {
+		return errMuxUnsupported
+	}
+	return nil
+}
+
+func isMuxUpgrade(r *Request) bool {
+	return r.Method == "GET" && r.URL.Path == muxUpgradePath
+}
+
+// serveMux serves mux session on cow client connection until it's closed.
+// Each stream is served as a cow client connection.
+func (c *clientConn) serveMux() error {
+	if _, err := c.Write(muxUpgradeResponse); err != nil {
+		return err
+	}
+	var conn net.Conn = c.Conn
+	if n := c.bufRd.Buffered(); n > 0 {
+		b, _ := c.bufRd.Peek(n)
+		conn = &prefixConn{c.Conn, io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), c.Conn)}
+	}
+	c.releaseBuf()
+	unsetConnReadTimeout(c.Conn, "mux session")
+	if debug {
+		debug.Printf("cli(%s) upgraded to mux session\n", c.RemoteAddr())
+	}
+
+	s := newMuxSession(conn, false)
+	defer s.Close()
+	// Streams are served and tracked as separate connections.
+	c.active.setIdleCheck(func() bool { return s.numStreams() == 0 })
+	for {
+		st, err := s.acceptStream()
+		if err != nil {
+			return nil
+		}
+		go newClientConn(st, c.proxy).serve()
+	}
+}
+
+// openMuxStream opens stream to cow parent on existing or new mux session.
+// Returns nil if mux can't be used.
+func (cp *cowParent) openMuxStream() *muxStream {
+	cp.muxMu.Lock()
+	defer cp.muxMu.Unlock()
+
+	var best *muxSession
+	live := cp.muxSess[:0]
+	for _, s := range cp.muxSess {
+		if s.isClosed() {
+			continue
+		}
+		live = append(live, s)
+		if best == nil || s.numStreams() < best.numStreams() {
+			best = s
+		}
+	}
+	cp.muxSess = live
+
+	if (best == nil || best.numStreams() >= muxSessionStreams) &&
+		len(cp.muxSess) < config.CowMuxConns && time.Now().After(cp.muxRetry) {
+		s, err := cp.newMuxSession()
+		if err == nil {
+			cp.muxSess = append(cp.muxSess, s)
+			best = s
+		} else if err == errMuxUnsupported {
+			info.Printf("cow parent %s does not support mux\n", cp.server)
+			cp.muxRetry = time.Now().Add(muxRetryInterval)
+		} else {
+			errl.Printf("cow parent %s mux: %v\n", cp.server, err)
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	st, err := best.openStream()
+	if err != nil {
+		return nil
+	}
+	return st
+}
+
+func (cp *cowParent) newMuxSession() (*muxSession, error) {
+	conn, err := cp.dial()
+	if err != nil {
+		return nil, err
+	}
+	if err = muxUpgrade(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	debug.Printf("mux session to cow parent %s\n", cp.server)
+	return newMuxSession(conn, true), nil
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ss "github.com/shadowsocks/shadowsocks-go/shadowsocks"
+)
+
+func TestMuxStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cli := newMuxSession(c1, true)
+	srv := newMuxSession(c2, false)
+	defer cli.Close()
+	defer srv.Close()
+
+	// Echo on server side.
+	go func() {
+		for {
+			st, err := srv.acceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	// Data larger than window in both directions on concurrent streams.
+	data := bytes.Repeat([]byte("0123456789abcdef"), muxWindow/8)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			st, err := cli.openStream()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer st.Close()
+			go st.Write(data)
+			b := make([]byte, len(data))
+			if _, err = io.ReadFull(st, b); err == nil && !bytes.Equal(b, data) {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal("echo:", err)
+		}
+	}
+	if cli.nextID != 5 {
+		t.Errorf("client stream id %d", cli.nextID)
+	}
+
+	st, err := cli.openStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err = st.Read(make([]byte, 1)); !isErrTimeout(err) {
+		t.Error("read should time out, got", err)
+	}
+	st.Close()
+	if _, err = st.Write([]byte("x")); err != errMuxStreamClosed {
+		t.Error("write to closed stream should fail, got", err)
+	}
+
+	c1.Close()
+	time.Sleep(10 * time.Millisecond)
+	if !cli.isClosed() {
+		t.Error("session should be closed with connection")
+	}
+	if _, err = cli.openStream(); err != errMuxClosed {
+		t.Error("open stream on closed session should fail, got", err)
+	}
+}
+
+// serveCow serves cow proxy connections accepted from ln.
+func serveCow(ln net.Listener, cipher *ss.Cipher) {
+	cp := &cowProxy{addr: ln.Addr().String(), cipher: cipher}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go newClientConn(ss.NewConn(conn, cipher.Copy()), cp).serve()
+	}
+}
+
+func TestCowParentMux(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.CowMux = true
+	config.CowMuxConns = 1
+	initSelfListenAddr() // request without host is for cow itself
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cipher, _ := ss.NewCipher("aes-128-cfb", "foobar")
+	go serveCow(ln, cipher)
+
+	cp := newCowParent(ln.Addr().String(), "aes-128-cfb", "foobar")
+	url := &URL{HostPort: "example.com:80"}
+	for i := 0; i < 2; i++ {
+		conn, err := cp.connect(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := conn.(cowConn).Conn.(*muxStream); !ok {
+			t.Fatal("should connect with mux stream")
+		}
+		// Request to cow itself is answered by the parent.
+		conn.Write([]byte("GET /notexist HTTP/1.1\r\n\r\n"))
+		b, _ := ioutil.ReadAll(conn)
+		if !strings.HasPrefix(string(b), "HTTP/1.1 404") {
+			t.Errorf("response through stream %q", b)
+		}
+		conn.Close()
+	}
+	if len(cp.muxSess) != 1 {
+		t.Errorf("%d mux sessions, streams should share session", len(cp.muxSess))
+	}
+}
+
+func TestCowParentMuxUnsupported(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.CowMux = true
+	config.CowMuxConns = 1
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cipher, _ := ss.NewCipher("aes-128-cfb", "foobar")
+	// Old version responds 404 to upgrade request.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			sc := ss.NewConn(conn, cipher.Copy())
+			sc.Read(make([]byte, 1024))
+			sc.Write([]byte("HTTP/1.1 404 not found\r\nConnection: close\r\n\r\n"))
+			sc.Close()
+		}
+	}()
+
+	cp := newCowParent(ln.Addr().String(), "aes-128-cfb", "foobar")
+	conn, err := cp.connect(&URL{HostPort: "example.com:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, ok := conn.(cowConn).Conn.(*muxStream); ok {
+		t.Error("should not use mux stream")
+	}
+	if !cp.muxRetry.After(time.Now()) {
+		t.Error("should not retry mux immediately")
+	}
+}
@@ -1,9 +1,29 @@
+// PAC served at /pac of http listen address.
+//
+//	pacServer = PROXY 10.0.0.1:7777     # proxy directives in failover order,
+//	pacServer = SOCKS5 10.0.0.2:1080    # default is PROXY of the listen address
+//	pacProxy = example.com,example.org  # always use proxy for these domains
+//	pacNet = 10.0.0.0/8 direct          # IP/CIDR rule, direct or proxy
+//	pacDefault = proxy                  # route for other sites, proxy or direct
+//	pacUser = alice type=socks          # variant for authenticated user
+//
+// /pac is served without authentication, as some clients can't handle it.
+// With pacUser, /pac requests are authenticated to select the user variant.
+//
+// Variants can also be selected by query parameters, e.g. /pac?type=socks&default=direct.
+// type keeps only directives of the given type (proxy, socks or https), and
+// default overrides pacDefault. Query parameters override user variant.
+//
+// Generated PAC is cached for each variant until site lists change.
+
 package proxy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"text/template"
@@ -13,48 +33,174 @@ import (
 var pac struct {
 	template       *template.Template
 	topLevelDomain string
-	directList     string
-	// Assignments and reads to directList are in different goroutines. Go
+
+	// Assignments and reads to lists are in different goroutines. Go
 	// does not guarantee atomic assignment, so we should protect these racing
 	// access.
-	dLRWMutex sync.RWMutex
+	sync.RWMutex
+	directList string
+	proxyList  string
+	version    int
+	cache      map[string][]byte // variant key -> generated PAC of version
+
+	netRules []pacNetRule
+	user     map[string]pacVariant
+}
+
+type pacNetRule struct {
+	Net    string // network address, or CIDR for IPv6
+	Mask   string // empty for IPv6
+	Direct bool
+}
+
+type pacVariant struct {
+	typ           string // keep only directives of this type
+	defaultDirect bool
+	hasDefault    bool
+}
+
+var pacDirectiveType = map[string]string{
+	"PROXY":  "proxy",
+	"HTTP":   "proxy",
+	"SOCKS":  "socks",
+	"SOCKS4": "socks",
+	"SOCKS5": "socks",
+	"HTTPS":  "https",
+}
+
+func parsePACServer(val string) (string, error) {
+	f := strings.Fields(val)
+	if len(f) != 2 {
+		return "", errors.New("pacServer should be <type> <host:port>")
+	}
+	typ := strings.ToUpper(f[0])
+	if _, ok := pacDirectiveType[typ]; !ok {
+		return "", fmt.Errorf("pacServer: unknown type %s", f[0])
+	}
+	if _, _, err := net.SplitHostPort(f[1]); err != nil {
+		return "", fmt.Errorf("pacServer: %v", err)
+	}
+	return typ + " " + f[1], nil
+}
+
+func parsePACNet(val string) (rule pacNetRule, err error) {
+	f := strings.Fields(val)
+	if len(f) != 2 || (f[1] != "direct" && f[1] != "proxy") {
+		return rule, errors.New("pacNet should be <ip/cidr> direct|proxy")
+	}
+	ipnet, err := parseIPNet(f[0])
+	if err != nil {
+		return rule, fmt.Errorf("pacNet: %v", err)
+	}
+	rule.Direct = f[1] == "direct"
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		rule.Net = ip4.String()
+		rule.Mask = net.IP(ipnet.Mask).String()
+	} else {
+		rule.Net = ipnet.String()
+	}
+	return rule, nil
+}
+
+// apply sets variant options from query parameters or pacUser options.
+func (v *pacVariant) apply(opts url.Values) error {
+	if typ := opts.Get("type"); typ != "" {
+		if typ != "proxy" && typ != "socks" && typ != "https" {
+			return errors.New("pac type should be proxy, socks or https")
+		}
+		v.typ = typ
+	}
+	switch d := opts.Get("default"); d {
+	case "":
+	case "direct", "proxy":
+		v.defaultDirect, v.hasDefault = d == "direct", true
+	default:
+		return errors.New("pac default should be direct or proxy")
+	}
+	return nil
 }
 
-func getDirectList() string {
-	pac.dLRWMutex.RLock()
-	dl := pac.directList
-	pac.dLRWMutex.RUnlock()
-	return dl
+func (v pacVariant) key() string {
+	return fmt.Sprintf("%s/%v/%v", v.typ, v.hasDefault, v.defaultDirect)
+}
+
+func parsePACUser(val string) (user string, v pacVariant, err error) {
+	f := strings.Fields(val)
+	if len(f) < 2 {
+		return "", v, errors.New("pacUser should be <user> <option>=<value> ...")
+	}
+	opts := url.Values{}
+	for _, kv := range f[1:] {
+		arr := strings.SplitN(kv, "=", 2)
+		if len(arr) != 2 {
+			return "", v, fmt.Errorf("pacUser %s: malformed %s", f[0], kv)
+		}
+		opts.Set(arr[0], arr[1])
+	}
+	if err = v.apply(opts); err != nil {
+		return "", v, fmt.Errorf("pacUser %s: %v", f[0], err)
+	}
+	return f[0], v, nil
+}
+
+func pacDomainList(lst []string) string {
+	return strings.Join(lst, "\",\n\"")
 }
 
 func updateDirectList() {
-	dl := strings.Join(siteStat.GetDirectList(), "\",\n\"")
-	pac.dLRWMutex.Lock()
-	pac.directList = dl
-	pac.dLRWMutex.Unlock()
+	dl := pacDomainList(siteStat.GetDirectList())
+	pl := pacDomainList(append(siteStat.GetBlockedList(), config.PACProxy...))
+	pac.Lock()
+	if dl != pac.directList || pl != pac.proxyList {
+		pac.directList, pac.proxyList = dl, pl
+		pac.version++
+		pac.cache = make(map[string][]byte)
+	}
+	pac.Unlock()
 }
 
 func init() {
 	const pacRawTmpl = `var direct = 'DIRECT';
-var httpProxy = 'PROXY {{.ProxyAddr}}; DIRECT';
+var httpProxy = '{{.Proxy}}';
+var defaultRoute = {{if .DefaultDirect}}direct{{else}}httpProxy{{end}};
 
 var directList = [
-"",
 "{{.DirectDomains}}"
 ];
 
-var directAcc = {};
-for (var i = 0; i < directList.length; i += 1) {
-	directAcc[directList[i]] = true;
+var proxyList = [
+"{{.ProxyDomains}}"
+];
+
+// [network, mask, isDirect], IPv6 rules have CIDR as network and empty mask
+var netRules = [
+{{range .NetRules}}	["{{.Net}}", "{{.Mask}}", {{.Direct}}],
+{{end}}];
+
+function toAcc(list) {
+	var acc = {};
+	for (var i = 0; i < list.length; i += 1) {
+		if (list[i]) {
+			acc[list[i]] = true;
+		}
+	}
+	return acc;
 }
+var directAcc = toAcc(directList);
+var proxyAcc = toAcc(proxyList);
 
 var topLevel = {
 {{.TopLevel}}
 };
 
 // hostIsIP determines whether a host address is an IP address and whether
-// it is private. Currenly only handles IPv4 addresses.
+// it is private, link-local or unique local.
 function hostIsIP(host) {
+	if (host.indexOf(':') !== -1) {
+		var h = host.toLowerCase();
+		var isPrivate = h == '::1' || h == '::' || /^f[cd]/.test(h) || /^fe[89ab]/.test(h);
+		return [true, isPrivate];
+	}
 	var part = host.split('.');
 	if (part.length != 4) {
 		return [false, false];
@@ -69,7 +215,8 @@ function hostIsIP(host) {
 			return [false, false];
 		}
 	}
-	if (part[0] == '127' || part[0] == '10' || (part[0] == '192' && part[1] == '168')) {
+	if (part[0] == '127' || part[0] == '10' || (part[0] == '192' && part[1] == '168') ||
+		(part[0] == '169' && part[1] == '254') || host == '0.0.0.0') {
 		return [true, true];
 	}
 	if (part[0] == '172') {
@@ -113,7 +260,46 @@ function host2Domain(host) {
 	return host.substring(dot2ndLast+1);
 }
 
+// inList checks host and its parent domains.
+function inList(acc, host) {
+	for (;;) {
+		if (acc[host]) {
+			return true;
+		}
+		var dot = host.indexOf('.');
+		if (dot === -1) {
+			return false;
+		}
+		host = host.substring(dot+1);
+	}
+}
+
+function matchNet(host) {
+	if (netRules.length === 0) {
+		return null;
+	}
+	var ip = host;
+	if (!hostIsIP(host)[0] && host.indexOf(':') === -1) {
+		ip = dnsResolve(host);
+		if (!ip) {
+			return null;
+		}
+	}
+	for (var i = 0; i < netRules.length; i += 1) {
+		var r = netRules[i];
+		var match = r[1] ? ip.indexOf(':') === -1 && isInNet(ip, r[0], r[1]) :
+			(typeof isInNetEx === 'function' && isInNetEx(ip, r[0]));
+		if (match) {
+			return r[2] ? direct : httpProxy;
+		}
+	}
+	return null;
+}
+
 function FindProxyForURL(url, host) {
+	if (host.charAt(0) == '[') {
+		host = host.substring(1, host.length - 1);
+	}
 	if (url.substring(0,4) == "ftp:")
 		return direct;
 	if (host.substring(0,7) == "::ffff:")
@@ -121,11 +307,19 @@ function FindProxyForURL(url, host) {
 	if (host.indexOf(".local", host.length - 6) !== -1) {
 		return direct;
 	}
+	if (inList(proxyAcc, host)) {
+		return httpProxy;
+	}
 	var domain = host2Domain(host);
-	if (host.length == domain.length) {
-		return directAcc[host] ? direct : httpProxy;
+	if (domain !== "" && (directAcc[host] || directAcc[domain])) {
+		return direct;
+	}
+	var route = matchNet(host);
+	if (route !== null) {
+		return route;
 	}
-	return (directAcc[host] || directAcc[domain]) ? direct : httpProxy;
+	// Private IP and simple host are direct unless matching pacNet.
+	return domain === "" ? direct : defaultRoute;
 }
 `
 	var err error
@@ -145,10 +339,29 @@ function FindProxyForURL(url, host) {
 var pacHeader = []byte("HTTP/1.1 200 OK\r\nServer: cow-proxy\r\n" +
 	"Content-Type: application/x-ns-proxy-autoconfig\r\nConnection: close\r\n\r\n")
 
-// Different client will have different proxy URL, so generate it upon each request.
-func genPAC(c *clientConn) []byte {
-	buf := new(bytes.Buffer)
+// pacProxyDirective returns proxy directives for variant.
+func pacProxyDirective(c *clientConn, v pacVariant) string {
+	servers := config.PACServer
+	if v.typ != "" {
+		var lst []string
+		for _, s := range servers {
+			if pacDirectiveType[strings.Fields(s)[0]] == v.typ {
+				lst = append(lst, s)
+			}
+		}
+		// Fall back to all servers if none has the type.
+		if len(lst) != 0 {
+			servers = lst
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"PROXY " + pacProxyAddr(c)}
+	}
+	return strings.Join(servers, "; ") + "; DIRECT"
+}
 
+// Different client may have different proxy address.
+func pacProxyAddr(c *clientConn) string {
 	hproxy, ok := c.proxy.(*httpProxy)
 	if !ok {
 		panic("sendPAC should only be called for http proxy")
@@ -165,37 +378,90 @@ func genPAC(c *clientConn) []byte {
 		}
 		proxyAddr = net.JoinHostPort(host, hproxy.port)
 	}
+	return proxyAddr
+}
 
-	dl := getDirectList()
+// pacVariantFor returns variant for client, query overrides user variant.
+func pacVariantFor(c *clientConn, query string) (v pacVariant, err error) {
+	if c.user != "" {
+		v = pac.user[c.user]
+	}
+	opts, err := url.ParseQuery(query)
+	if err != nil {
+		return v, err
+	}
+	err = v.apply(opts)
+	return v, err
+}
+
+func genPAC(c *clientConn, v pacVariant) []byte {
+	proxy := pacProxyDirective(c, v)
+	key := v.key() + "/" + proxy
 
-	if dl == "" {
-		// Empty direct domain list
-		buf.Write(pacHeader)
-		pacproxy := fmt.Sprintf("function FindProxyForURL(url, host) { return 'PROXY %s; DIRECT'; };",
-			proxyAddr)
-		buf.Write([]byte(pacproxy))
-		return buf.Bytes()
+	pac.RLock()
+	b, ok := pac.cache[key]
+	dl, pl, version := pac.directList, pac.proxyList, pac.version
+	pac.RUnlock()
+	if ok {
+		return b
 	}
 
 	data := struct {
-		ProxyAddr     string
+		Proxy         string
+		DefaultDirect bool
 		DirectDomains string
+		ProxyDomains  string
+		NetRules      []pacNetRule
 		TopLevel      string
 	}{
-		proxyAddr,
+		proxy,
+		config.PACDefaultDirect,
 		dl,
+		pl,
+		pac.netRules,
 		pac.topLevelDomain,
 	}
+	if v.hasDefault {
+		data.DefaultDirect = v.defaultDirect
+	}
 
+	buf := new(bytes.Buffer)
 	buf.Write(pacHeader)
 	if err := pac.template.Execute(buf, data); err != nil {
 		errl.Println("Error generating pac file:", err)
 		panic("Error generating pac file")
 	}
-	return buf.Bytes()
+	b = buf.Bytes()
+
+	pac.Lock()
+	// Lists may have changed while generating.
+	if version == pac.version {
+		if pac.cache == nil {
+			pac.cache = make(map[string][]byte)
+		}
+		pac.cache[key] = b
+	}
+	pac.Unlock()
+	return b
 }
 
 func initPAC() {
+	pac.netRules = nil
+	for _, val := range config.PACNet {
+		rule, err := parsePACNet(val)
+		if err != nil {
+			Fatal(err)
+		}
+		pac.netRules = append(pac.netRules, rule)
+	}
+	pac.user = make(map[string]pacVariant)
+	for _, val := range config.PACUser {
+		user, v, err := parsePACUser(val)
+		if err != nil {
+			Fatal(err)
+		}
+		pac.user[user] = v
+	}
 	// we can't control goroutine scheduling, make sure when
 	// initPAC is done, direct list is updated
 	updateDirectList()
@@ -207,9 +473,22 @@ func initPAC() {
 	}()
 }
 
-func sendPAC(c *clientConn) error {
-	_, err := c.Write(genPAC(c))
+func sendPAC(c *clientConn, r *Request) error {
+	var query string
+	if i := strings.IndexByte(r.URL.Path, '?'); i != -1 {
+		query = r.URL.Path[i+1:]
+	}
+	if len(pac.user) != 0 && c.user == "" && authFor(c.proxy) != nil {
+		if err := Authenticate(c, r); err != nil {
+			return err
+		}
+	}
+	v, err := pacVariantFor(c, query)
 	if err != nil {
+		sendErrorPage(c, statusBadReq, "Bad PAC request", err.Error())
+		return err
+	}
+	if _, err = c.Write(genPAC(c, v)); err != nil {
 		debug.Printf("cli(%s) error sending PAC: %s", c.RemoteAddr(), err)
 	}
 	return err
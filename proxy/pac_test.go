@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePACRules(t *testing.T) {
+	if s, err := parsePACServer("socks5 10.0.0.1:1080"); err != nil || s != "SOCKS5 10.0.0.1:1080" {
+		t.Errorf("pacServer parsed as %q %v", s, err)
+	}
+	for _, val := range []string{"FTP 1.2.3.4:21", "PROXY 1.2.3.4", "PROXY"} {
+		if _, err := parsePACServer(val); err == nil {
+			t.Errorf("pacServer %q should be invalid", val)
+		}
+	}
+
+	testNet := []struct {
+		val  string
+		rule pacNetRule
+	}{
+		{"10.1.2.3/8 direct", pacNetRule{"10.0.0.0", "255.0.0.0", true}},
+		{"1.2.3.4 proxy", pacNetRule{"1.2.3.4", "255.255.255.255", false}},
+		{"2001:db8::/32 direct", pacNetRule{"2001:db8::/32", "", true}},
+	}
+	for _, td := range testNet {
+		rule, err := parsePACNet(td.val)
+		if err != nil || rule != td.rule {
+			t.Errorf("pacNet %q parsed as %+v %v", td.val, rule, err)
+		}
+	}
+	if _, err := parsePACNet("10.0.0.0/8 reject"); err == nil {
+		t.Error("pacNet with wrong route should be invalid")
+	}
+
+	user, v, err := parsePACUser("alice type=socks default=direct")
+	if err != nil || user != "alice" || v.typ != "socks" || !v.hasDefault || !v.defaultDirect {
+		t.Errorf("pacUser parsed as %s %+v %v", user, v, err)
+	}
+	if _, _, err = parsePACUser("alice type=ftp"); err == nil {
+		t.Error("pacUser with wrong type should be invalid")
+	}
+}
+
+func TestGenPAC(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		pac.user = nil
+		pac.netRules = nil
+	}()
+	config.PACServer = []string{"PROXY 10.0.0.1:7777", "SOCKS5 10.0.0.2:1080"}
+	config.PACProxy = []string{"always.example.com"}
+	config.PACNet = []string{"192.0.2.0/24 direct"}
+	config.PACUser = []string{"alice default=direct"}
+	initPAC()
+
+	c := newClientConn(newFakeConn(""), newHttpProxy("127.0.0.1:7777", "1.2.3.4:7777"))
+	defer c.releaseBuf()
+	v, err := pacVariantFor(c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := string(genPAC(c, v))
+	for _, s := range []string{
+		"var httpProxy = 'PROXY 10.0.0.1:7777; SOCKS5 10.0.0.2:1080; DIRECT';",
+		"var defaultRoute = httpProxy;",
+		`"always.example.com"`,
+		`["192.0.2.0", "255.255.255.0", true],`,
+	} {
+		if !strings.Contains(b, s) {
+			t.Errorf("PAC should contain %s", s)
+		}
+	}
+	if b2 := genPAC(c, v); string(b2) != b || len(pac.cache) != 1 {
+		t.Error("PAC should be served from cache")
+	}
+
+	c.user = "alice"
+	if v, err = pacVariantFor(c, "type=socks"); err != nil {
+		t.Fatal(err)
+	}
+	b = string(genPAC(c, v))
+	if !strings.Contains(b, "var httpProxy = 'SOCKS5 10.0.0.2:1080; DIRECT';") ||
+		!strings.Contains(b, "var defaultRoute = direct;") {
+		t.Errorf("PAC variant for user and query:\n%s", b)
+	}
+	if _, err = pacVariantFor(c, "default=reject"); err == nil {
+		t.Error("invalid default in query should be error")
+	}
+
+	// Changing lists clears cache.
+	config.PACProxy = append(config.PACProxy, "new.example.com")
+	updateDirectList()
+	if len(pac.cache) != 0 {
+		t.Error("cache not cleared when list changes")
+	}
+	if b = string(genPAC(c, v)); !strings.Contains(b, `"new.example.com"`) {
+		t.Error("PAC not updated after list change")
+	}
+}
+
+func TestPACUserAuth(t *testing.T) {
+	saved, savedAuth := config, auth
+	defer func() {
+		config, auth = saved, savedAuth
+		pac.user = nil
+	}()
+	config.UserPasswd = "alice:secret"
+	config.PACUser = []string{"alice default=direct"}
+	initAuth()
+	initPAC()
+
+	// get returns response to PAC request with credential.
+	get := func(credential string) string {
+		fc := newFakeConn("")
+		c := newClientConn(fc, newHttpProxy("127.0.0.1:7777", ""))
+		defer c.releaseBuf()
+		r := &Request{Method: "GET", URL: &URL{Path: "/pac"}}
+		r.ProxyAuthorization = credential
+		sendPAC(c, r)
+		return fc.out.String()
+	}
+	if s := get(""); !strings.HasPrefix(s, "HTTP/1.1 407 ") {
+		t.Errorf("PAC request without credential should get 407 with pacUser, got %q", s)
+	}
+	if s := get(basicAuthHeader("alice", "secret")); !strings.Contains(s, "var defaultRoute = direct;") {
+		t.Errorf("PAC request from alice should get user variant:\n%s", s)
+	}
+}
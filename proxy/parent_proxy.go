@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -23,6 +24,11 @@ type ParentProxy interface {
 	genConfig() string // for upgrading config
 }
 
+// Parent proxies which can relay UDP should also implement this interface.
+type PacketParentProxy interface {
+	connectPacket(*URL) (packetConn, error)
+}
+
 // Interface for different proxy selection strategy.
 type ParentPool interface {
 	add(ParentProxy)
@@ -30,6 +36,8 @@ type ParentPool interface {
 	// Select a proxy from the pool and connect. May try several proxies until
 	// one that succees, return nil and error if all parent proxies fail.
 	connect(*URL) (net.Conn, error)
+	// Same as connect, but only uses parent proxies that support UDP.
+	connectPacket(*URL) (packetConn, error)
 }
 
 // Init parentProxy to be backup pool. So config parsing have a pool to add
@@ -103,6 +111,10 @@ func (pp *backupParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 	return connectInOrder(url, pp.parent, 0)
 }
 
+func (pp *backupParentPool) connectPacket(url *URL) (packetConn, error) {
+	return connectPacketInOrder(url, pp.parent, 0)
+}
+
 // Hash load balance strategy:
 // Each host will use a proxy based on a hash value.
 type hashParentPool struct {
@@ -115,6 +127,11 @@ func (pp *hashParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 	return connectInOrder(url, pp.parent, start)
 }
 
+func (pp *hashParentPool) connectPacket(url *URL) (packetConn, error) {
+	start := int(crc32.ChecksumIEEE([]byte(url.Host)) % uint32(len(pp.parent)))
+	return connectPacketInOrder(url, pp.parent, start)
+}
+
 func (parent *ParentWithFail) connect(url *URL) (srvconn net.Conn, err error) {
 	const maxFailCnt = 30
 	srvconn, err = parent.ParentProxy.connect(url)
@@ -158,6 +175,23 @@ func connectInOrder(url *URL, pp []ParentWithFail, start int) (srvconn net.Conn,
 	return nil, err
 }
 
+var errNoUDPParent = errors.New("no parent proxy supports udp")
+
+func connectPacketInOrder(url *URL, pp []ParentWithFail, start int) (pc packetConn, err error) {
+	err = errNoUDPParent
+	nproxy := len(pp)
+	for i := 0; i < nproxy; i++ {
+		parent, ok := pp[(start+i)%nproxy].ParentProxy.(PacketParentProxy)
+		if !ok {
+			continue
+		}
+		if pc, err = parent.connectPacket(url); err == nil {
+			return
+		}
+	}
+	return nil, err
+}
+
 type ParentWithLatency struct {
 	ParentProxy
 	latency time.Duration
@@ -236,6 +270,24 @@ func (pp *latencyParentPool) connect(url *URL) (srvconn net.Conn, err error) {
 	return nil, err
 }
 
+func (pp *latencyParentPool) connectPacket(url *URL) (pc packetConn, err error) {
+	latencyMutex.RLock()
+	lp := pp.parent
+	latencyMutex.RUnlock()
+
+	err = errNoUDPParent
+	for _, p := range lp {
+		parent, ok := p.ParentProxy.(PacketParentProxy)
+		if !ok {
+			continue
+		}
+		if pc, err = parent.connectPacket(url); err == nil {
+			return
+		}
+	}
+	return nil, err
+}
+
 func (parent *ParentWithLatency) updateLatency(wg *sync.WaitGroup) {
 	defer wg.Done()
 	proxy := parent.ParentProxy
@@ -319,6 +371,7 @@ type httpParent struct {
 type httpConn struct {
 	net.Conn
 	parent *httpParent
+	client string // client address sent in PROXY header
 }
 
 func (s httpConn) String() string {
@@ -351,7 +404,7 @@ func (hp *httpParent) initAuth(userPasswd string) {
 }
 
 func (hp *httpParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", hp.server)
+	c, err := net.DialTimeout("tcp", hp.server, parentDialTimeout(hp.server))
 	if err != nil {
 		errl.Printf("can't connect to http parent %s for %s: %v\n",
 			hp.server, url.HostPort, err)
@@ -359,7 +412,7 @@ func (hp *httpParent) connect(url *URL) (net.Conn, error) {
 	}
 	debug.Printf("connected to: %s via http parent: %s\n",
 		url.HostPort, hp.server)
-	return httpConn{c, hp}, nil
+	return httpConn{Conn: c, parent: hp}, nil
 }
 
 // shadowsocks parent proxy
@@ -420,12 +473,67 @@ func (sp *shadowsocksParent) connect(url *URL) (net.Conn, error) {
 	return shadowsocksConn{c, sp}, nil
 }
 
+type shadowsocksPacketConn struct {
+	*ss.SecurePacketConn
+	server net.Addr
+}
+
+func (s shadowsocksPacketConn) String() string {
+	return "shadowsocks udp " + s.server.String()
+}
+
+func (sp *shadowsocksParent) connectPacket(url *URL) (packetConn, error) {
+	server, err := net.ResolveUDPAddr("udp", sp.server)
+	if err != nil {
+		errl.Printf("can't resolve shadowsocks parent %s for udp: %v\n", sp.server, err)
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	debug.Println("udp relay to:", url.HostPort, "via shadowsocks:", sp.server)
+	return shadowsocksPacketConn{ss.NewSecurePacketConn(pc, sp.cipher.Copy()), server}, nil
+}
+
+// Shadowsocks UDP packet: ATYP DST.ADDR DST.PORT DATA, the whole packet is
+// encrypted by SecurePacketConn.
+func (s shadowsocksPacketConn) WriteTo(b []byte, hostPort string) (int, error) {
+	addr, err := genSocksAddr(hostPort)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.SecurePacketConn.WriteTo(append(addr, b...), s.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s shadowsocksPacketConn) ReadFrom(b []byte) (int, string, error) {
+	for {
+		n, _, err := s.SecurePacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, "", err
+		}
+		hostPort, alen, err := parseSocksAddr(b[:n])
+		if err != nil {
+			debug.Println("shadowsocks udp reply:", err)
+			continue
+		}
+		return copy(b, b[alen:n]), hostPort, nil
+	}
+}
+
 // cow parent proxy
 type cowParent struct {
 	server string
 	method string
 	passwd string
 	cipher *ss.Cipher
+
+	muxMu    sync.Mutex
+	muxSess  []*muxSession
+	muxRetry time.Time // don't try mux before this time
 }
 
 type cowConn struct {
@@ -442,7 +550,7 @@ func newCowParent(srv, method, passwd string) *cowParent {
 	if err != nil {
 		Fatal("create cow cipher:", err)
 	}
-	return &cowParent{srv, method, passwd, cipher}
+	return &cowParent{server: srv, method: method, passwd: passwd, cipher: cipher}
 }
 
 func (cp *cowParent) getServer() string {
@@ -457,8 +565,23 @@ func (cp *cowParent) genConfig() string {
 	return fmt.Sprintf("proxy = cow://%s:%s@%s", method, cp.passwd, cp.server)
 }
 
+func (cp *cowParent) dial() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", cp.server, parentDialTimeout(cp.server))
+	if err != nil {
+		return nil, err
+	}
+	return ss.NewConn(c, cp.cipher.Copy()), nil
+}
+
 func (cp *cowParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", cp.server)
+	if config.CowMux {
+		if st := cp.openMuxStream(); st != nil {
+			debug.Printf("connected to: %s via cow parent: %s stream %d\n",
+				url.HostPort, cp.server, st.id)
+			return cowConn{st, cp}, nil
+		}
+	}
+	ssconn, err := cp.dial()
 	if err != nil {
 		errl.Printf("can't connect to cow parent %s for %s: %v\n",
 			cp.server, url.HostPort, err)
@@ -466,7 +589,6 @@ func (cp *cowParent) connect(url *URL) (net.Conn, error) {
 	}
 	debug.Printf("connected to: %s via cow parent: %s\n",
 		url.HostPort, cp.server)
-	ssconn := ss.NewConn(c, cp.cipher.Copy())
 	return cowConn{ssconn, cp}, nil
 }
 
@@ -519,7 +641,7 @@ func (sp *socksParent) genConfig() string {
 }
 
 func (sp *socksParent) connect(url *URL) (net.Conn, error) {
-	c, err := net.Dial("tcp", sp.server)
+	c, err := net.DialTimeout("tcp", sp.server, parentDialTimeout(sp.server))
 	if err != nil {
 		errl.Printf("can't connect to socks parent %s for %s: %v\n",
 			sp.server, url.HostPort, err)
@@ -614,3 +736,173 @@ func (sp *socksParent) connect(url *URL) (net.Conn, error) {
 	// Now the socket can be used to pass data.
 	return socksConn{c, sp}, nil
 }
+
+// socksPacketConn relays UDP through socks server. The UDP association
+// terminates when the TCP control connection is closed.
+type socksPacketConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay net.Addr
+}
+
+func (s socksPacketConn) String() string {
+	return "socks udp " + s.relay.String()
+}
+
+func (sp *socksParent) connectPacket(url *URL) (packetConn, error) {
+	c, err := net.DialTimeout("tcp", sp.server, dialTimeout)
+	if err != nil {
+		errl.Printf("can't connect to socks parent %s for udp %s: %v\n",
+			sp.server, url.HostPort, err)
+		return nil, err
+	}
+	hasErr := true
+	defer func() {
+		if hasErr {
+			c.Close()
+		}
+	}()
+
+	setConnReadTimeout(c, readTimeout, "socks udp associate")
+	if _, err = c.Write(socksMsgVerMethodSelection); err != nil {
+		return nil, err
+	}
+	repBuf := make([]byte, 2)
+	if _, err = io.ReadFull(c, repBuf); err != nil {
+		return nil, err
+	}
+	if repBuf[0] != socksVer5 || repBuf[1] != socksMethodNoAuth {
+		return nil, socksProtocolErr
+	}
+	// Client address is not known before sending, use all zero address.
+	req := []byte{socksVer5, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err = c.Write(req); err != nil {
+		return nil, err
+	}
+	replyBuf := make([]byte, 3)
+	if _, err = io.ReadFull(c, replyBuf); err != nil {
+		return nil, err
+	}
+	if replyBuf[0] != socksVer5 {
+		return nil, socksProtocolErr
+	}
+	if replyBuf[1] != socksRepSucceeded {
+		errl.Printf("socks udp associate %s error %s\n", sp.server, socksError[replyBuf[1]])
+		return nil, socksProtocolErr
+	}
+	bndAddr, err := readSocksAddr(c)
+	if err != nil {
+		return nil, err
+	}
+	unsetConnReadTimeout(c, "socks udp associate")
+
+	// Server may reply with unspecified address, use the server's address then.
+	bndHost, bndPort, _ := net.SplitHostPort(bndAddr)
+	if ip := net.ParseIP(bndHost); ip != nil && ip.IsUnspecified() {
+		bndHost, _, _ = net.SplitHostPort(sp.server)
+	}
+	relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(bndHost, bndPort))
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	hasErr = false
+	debug.Println("udp relay to:", url.HostPort, "via socks server:", sp.server)
+	return socksPacketConn{pc, c, relay}, nil
+}
+
+func (s socksPacketConn) WriteTo(b []byte, hostPort string) (int, error) {
+	hdr, err := genSocksUDPHeader(hostPort)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = s.PacketConn.WriteTo(append(hdr, b...), s.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (s socksPacketConn) ReadFrom(b []byte) (int, string, error) {
+	for {
+		n, _, err := s.PacketConn.ReadFrom(b)
+		if err != nil {
+			return 0, "", err
+		}
+		hostPort, data, err := parseSocksUDPHeader(b[:n])
+		if err != nil {
+			debug.Println("socks udp reply:", err)
+			continue
+		}
+		return copy(b, data), hostPort, nil
+	}
+}
+
+func (s socksPacketConn) Close() error {
+	s.ctrl.Close()
+	return s.PacketConn.Close()
+}
+
+// parentTunnel sends CONNECT request to http and cow parent proxy. Other
+// connections are returned as is. srvconn is closed on error.
+func parentTunnel(srvconn net.Conn, url *URL) (net.Conn, error) {
+	var authHeader []byte
+	switch pc := srvconn.(type) {
+	case httpConn:
+		authHeader = pc.parent.authHeader
+	case cowConn:
+	default:
+		return srvconn, nil
+	}
+	req := "CONNECT " + url.HostPort + " HTTP/1.1\r\nHost: " + url.HostPort + CRLF
+	b := append([]byte(req), authHeader...)
+	b = append(b, CRLF...)
+	code, resp, err := parentRoundTrip(srvconn, b, "parent tunnel")
+	if err == nil && code != "200" {
+		err = fmt.Errorf("parent proxy CONNECT %s failed: %s", url.HostPort,
+			bytes.SplitN(resp, []byte(CRLF), 2)[0])
+	}
+	if err != nil {
+		srvconn.Close()
+		return nil, err
+	}
+	return srvconn, nil
+}
+
+// parentRoundTrip sends req to parent proxy and reads response header,
+// returns status code and the header. Parent sends nothing more before
+// client does for CONNECT and upgrade requests, and data after the header
+// belongs to the tunnel, so header is read byte by byte without buffering.
+func parentRoundTrip(conn net.Conn, req []byte, what string) (code string, resp []byte, err error) {
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	setConnReadTimeout(conn, readTimeout, what)
+	defer unsetConnReadTimeout(conn, what)
+	if resp, err = readRawResponseHeader(conn); err != nil {
+		return
+	}
+	if f := bytes.Fields(resp); len(f) >= 2 {
+		code = string(f[1])
+	}
+	return
+}
+
+// readRawResponseHeader reads response header byte by byte, so data sent
+// after the header is not consumed.
+func readRawResponseHeader(conn net.Conn) ([]byte, error) {
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte("\r\n\r\n")) {
+		if len(resp) > httpBufSize {
+			return nil, errors.New("response header too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, err
+		}
+		resp = append(resp, b[0])
+	}
+	return resp, nil
+}
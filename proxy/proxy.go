@@ -8,6 +8,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cyfdecyf/bufio"
@@ -90,13 +91,20 @@ type serverConn struct {
 	willCloseOn time.Time
 	siteInfo    *VisitCnt
 	visited     bool
+	live        *liveConn  // request currently using this connection
+	usage       *userUsage // user of the request currently using this connection
 }
 
 type clientConn struct {
-	net.Conn // connection to the proxy client
-	bufRd    *bufio.Reader
-	buf      []byte // buffer for the buffered reader
-	proxy    Proxy
+	net.Conn   // connection to the proxy client
+	bufRd      *bufio.Reader
+	buf        []byte // buffer for the buffered reader
+	proxy      Proxy
+	user       string     // authenticated user name, empty if not authenticated by user
+	authHeader string     // Proxy-Authorization accepted for user, used in conn auth mode
+	usage      *userUsage // traffic accounting for user
+	mitm       *URL       // CONNECT target if serving intercepted TLS connection
+	active     *activeConn
 }
 
 var (
@@ -147,7 +155,7 @@ func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	defer func() {
 		wg.Done()
 	}()
-	ln, err := net.Listen("tcp", hp.addr)
+	ln, err := listen(hp.addr)
 	if err != nil {
 		fmt.Println("listen http failed:", err)
 		return
@@ -160,7 +168,7 @@ func (hp *httpProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 	}()
 	host, _, _ := net.SplitHostPort(hp.addr)
 	var pacURL string
-	if host == "" || host == "0.0.0.0" {
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
 		pacURL = fmt.Sprintf("http://<hostip>:%s/pac", hp.port)
 	} else if hp.addrInPAC == "" {
 		pacURL = fmt.Sprintf("http://%s/pac", hp.addr)
@@ -222,7 +230,7 @@ func (cp *cowProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
 		wg.Done()
 	}()
 
-	ln, err := net.Listen("tcp", cp.addr)
+	ln, err := listen(cp.addr)
 	if err != nil {
 		fmt.Println("listen cow failed:", err)
 		return
@@ -280,6 +288,10 @@ func (c *clientConn) releaseBuf() {
 
 func (c *clientConn) Close() {
 	c.releaseBuf()
+	if c.usage != nil {
+		c.usage.releaseConn()
+		c.usage = nil
+	}
 	if debug {
 		debug.Printf("cli(%s) closed, total %d clients\n",
 			c.RemoteAddr(), decCliCnt())
@@ -287,18 +299,39 @@ func (c *clientConn) Close() {
 	c.Conn.Close()
 }
 
+// initUsage starts accounting for authenticated user.
+func (c *clientConn) initUsage() error {
+	if c.user == "" || c.usage != nil {
+		return nil
+	}
+	uu := getUserUsage(c.user)
+	if err := uu.acquireConn(); err != nil {
+		return err
+	}
+	c.usage = uu
+	return nil
+}
+
+func (c *clientConn) isCowClient() bool {
+	switch c.Conn.(type) {
+	case *ss.Conn, *muxStream:
+		return true
+	}
+	return false
+}
+
 func (c *clientConn) setReadTimeout(msg string) {
 	// Always keep connections alive for cow conn from client for more reuse.
 	// For other client connections, set read timeout so we can close the
 	// connection after a period of idle to reduce number of open connections.
-	if _, ok := c.Conn.(*ss.Conn); !ok {
+	if !c.isCowClient() {
 		// make actual timeout a little longer than keep-alive value sent to client
 		setConnReadTimeout(c.Conn, clientConnTimeout+2*time.Second, msg)
 	}
 }
 
 func (c *clientConn) unsetReadTimeout(msg string) {
-	if _, ok := c.Conn.(*ss.Conn); !ok {
+	if !c.isCowClient() {
 		unsetConnReadTimeout(c.Conn, msg)
 	}
 }
@@ -356,22 +389,31 @@ func isSelfRequest(r *Request) bool {
 }
 
 func (c *clientConn) serveSelfURL(r *Request) (err error) {
-	if _, ok := c.proxy.(*httpProxy); !ok {
-		goto end
+	if _, ok := c.proxy.(*cowProxy); ok && isMuxUpgrade(r) {
+		if err = c.serveMux(); err != nil {
+			return err
+		}
+		// Session closed, close client connection.
+		return errPageSent
 	}
-	if r.Method != "GET" {
+	if _, ok := c.proxy.(*httpProxy); !ok {
 		goto end
 	}
-	if r.URL.Path == "/pac" || strings.HasPrefix(r.URL.Path, "/pac?") {
-		sendPAC(c)
+	if r.Method == "GET" && (r.URL.Path == "/pac" || strings.HasPrefix(r.URL.Path, "/pac?")) {
+		sendPAC(c, r)
 		// PAC header contains connection close, send non nil error to close
 		// client connection.
 		return errPageSent
 	}
+	if isDashboardPath(r.URL.Path) {
+		// Dashboard responses also close connection.
+		serveDashboard(c, r)
+		return errPageSent
+	}
 end:
 	sendErrorPage(c, "404 not found", "Page not found",
 		genErrMsg(r, nil, "Serving request to COW proxy."))
-	errl.Printf("cli(%s) page not found, serving request to cow %s\n%s",
+	errl.PrintfCtx(c.logCtx(r, nil), "cli(%s) page not found, serving request to cow %s\n%s",
 		c.RemoteAddr(), r, r.Verbose())
 	return errPageSent
 }
@@ -418,7 +460,7 @@ func (c *clientConn) shouldRetry(r *Request, sv *serverConn, re error) bool {
 
 func dbgPrintRq(c *clientConn, r *Request) {
 	if r.Trailer {
-		errl.Printf("cli(%s) request  %s has Trailer header\n%s",
+		errl.PrintfCtx(c.logCtx(r, nil), "cli(%s) request  %s has Trailer header\n%s",
 			c.RemoteAddr(), r, r.Verbose())
 	}
 	if dbgRq {
@@ -441,16 +483,23 @@ func (c *clientConn) serve() {
 	var rp Response
 	var sv *serverConn
 	var err error
+	var rqStart time.Time // for access log
 
 	var authed bool
 	// For cow proxy server, authentication is done by matching password.
 	if _, ok := c.proxy.(*cowProxy); ok {
 		authed = true
 	}
+	// Intercepted TLS connection is authenticated by CONNECT request.
+	if c.mitm != nil {
+		authed = true
+	}
 
+	c.active = trackConn(c.Conn)
 	defer func() {
 		r.releaseBuf()
 		c.Close()
+		c.active.done()
 	}()
 
 	// Refer to implementation.md for the design choices on parsing the request
@@ -460,7 +509,14 @@ func (c *clientConn) serve() {
 			panic("client read buffer nil")
 		}
 
-		if err = parseRequest(c, &r); err != nil {
+		// Idle connection is closed when draining.
+		c.active.setIdle(true)
+		if isDraining() {
+			return
+		}
+		err = parseRequest(c, &r)
+		c.active.setIdle(false)
+		if err != nil {
 			debug.Printf("cli(%s) parse request %v\n", c.RemoteAddr(), err)
 			if err == io.EOF || isErrConnReset(err) {
 				return
@@ -473,11 +529,18 @@ func (c *clientConn) serve() {
 				"Your browser didn't send a complete request in time.")
 			return
 		}
+		if c.mitm != nil {
+			// Requests in intercepted connection are in origin form.
+			r.URL.ParseHostPort(c.mitm.HostPort)
+			r.mitm = true
+		}
 		dbgPrintRq(c, &r)
+		rqStart = time.Now()
 
 		// PAC may leak frequently visited sites information. But if cow
 		// requires authentication for PAC, some clients may not be able
-		// handle it. (e.g. Proxy SwitchySharp extension on Chrome.)
+		// handle it. (e.g. Proxy SwitchySharp extension on Chrome.) Only
+		// authenticated when pacUser is used, see sendPAC.
 		if isSelfRequest(&r) {
 			if err = c.serveSelfURL(&r); err != nil {
 				return
@@ -485,15 +548,32 @@ func (c *clientConn) serve() {
 			continue
 		}
 
-		if auth.required && !authed {
+		if !authed && authFor(c.proxy) != nil {
 			if err = Authenticate(c, &r); err != nil {
-				errl.Printf("cli(%s) %v\n", c.RemoteAddr(), err)
+				errl.PrintfCtx(c.logCtx(&r, nil), "cli(%s) %v\n", c.RemoteAddr(), err)
 				// Request may have body. To make things simple, close
 				// connection so we don't need to skip request body before
 				// reading the next request.
 				return
 			}
 			authed = true
+			if err = c.initUsage(); err != nil {
+				sendErrorPage(c, statusTooManyRequests, err.Error(),
+					genErrMsg(&r, nil, "Please close some connections and retry."))
+				return
+			}
+		} else if config.AuthMode == authModeConn && c.user != "" {
+			if err = reauthenticate(c, &r); err != nil {
+				errl.PrintfCtx(c.logCtx(&r, nil), "cli(%s) %v\n", c.RemoteAddr(), err)
+				return
+			}
+		}
+		if c.usage != nil {
+			if err = c.usage.checkQuota(); err != nil {
+				sendErrorPage(c, statusForbidden, err.Error(),
+					genErrMsg(&r, nil, "Please contact proxy admin."))
+				return
+			}
 		}
 
 		if r.isConnect && !config.TunnelAllowedPort[r.URL.Port] {
@@ -502,9 +582,9 @@ func (c *clientConn) serve() {
 			return
 		}
 
-		if r.ExpectContinue {
-			sendErrorPage(c, statusExpectFailed, "Expect header not supported",
-				"Please contact COW's developer if you see this.")
+		if r.ExpectUnsupported {
+			sendErrorPage(c, statusExpectFailed, "Expectation not supported",
+				"Only 100-continue expectation is supported.")
 			// Client may have sent request body at this point. Simply close
 			// connection so we don't need to handle this case.
 			// NOTE: sendErrorPage tells client the connection will keep alive, but
@@ -512,6 +592,32 @@ func (c *clientConn) serve() {
 			return
 		}
 
+		r.capture = startCapture(c, &r)
+		if r.blocked = blockedBy(r.URL.Host); r.blocked != "" {
+			err = c.rejectBlocked(&r)
+			logAccess(c, &r, &rp, nil, nil, rqStart, err)
+			if err != nil || !r.ConnectionKeepAlive {
+				return
+			}
+			continue
+		}
+
+		c.rewriteRequest(&r)
+		if served, err := c.tryCache(&r, &rp); served {
+			logAccess(c, &r, &rp, nil, nil, rqStart, err)
+			if err != nil || !r.ConnectionKeepAlive {
+				return
+			}
+			continue
+		}
+
+		if r.isConnect && shouldIntercept(r.URL.Host) {
+			if err = c.intercept(&r); err != nil {
+				errl.PrintfCtx(c.logCtx(&r, nil), "cli(%s) %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+
 	retry:
 		r.tryOnce()
 		if bool(debug) && r.isRetry() {
@@ -521,6 +627,7 @@ func (c *clientConn) serve() {
 			if debug {
 				debug.Printf("cli(%s) failed to get server conn %v\n", c.RemoteAddr(), &r)
 			}
+			logAccess(c, &r, &rp, nil, nil, rqStart, err)
 			// Failed connection will send error page back to the client.
 			// For CONNECT, the client read buffer is released in copyClient2Server,
 			// so can't go back to getRequest.
@@ -535,29 +642,38 @@ func (c *clientConn) serve() {
 			return
 		}
 
+		sv.usage = c.usage
+		live := startLiveConn(c, &r, sv)
 		if r.isConnect {
 			// server connection will be closed in doConnect
 			err = sv.doConnect(&r, c)
+			live.end()
 			if c.shouldRetry(&r, sv, err) {
 				goto retry
 			}
+			logAccess(c, &r, &rp, sv, live, rqStart, err)
 			// debug.Printf("doConnect %s to %s done\n", c.RemoteAddr(), r.URL.HostPort)
 			return
 		}
 
-		if err = sv.doRequest(c, &r, &rp); err != nil {
+		err = sv.doRequest(c, &r, &rp)
+		live.end()
+		if err != nil {
 			// For client I/O error, we can actually put server connection to
 			// pool. But let's make thing simple for now.
 			sv.Close()
 			if c.shouldRetry(&r, sv, err) {
 				goto retry
-			} else if err == errPageSent && (!r.hasBody() || r.hasSent()) {
+			}
+			logAccess(c, &r, &rp, sv, live, rqStart, err)
+			if err == errPageSent && (!r.hasBody() || r.hasSent()) {
 				// Can only continue if request has no body, or request body
 				// has been read.
 				continue
 			}
 			return
 		}
+		logAccess(c, &r, &rp, sv, live, rqStart, nil)
 		// Put server connection to pool, so other clients can use it.
 		_, isCowConn := sv.Conn.(cowConn)
 		if rp.ConnectionKeepAlive || isCowConn {
@@ -593,6 +709,7 @@ func genErrMsg(r *Request, sv *serverConn, what string) string {
 }
 
 func (c *clientConn) handleBlockedRequest(r *Request, err error) error {
+	siteBlock.observe(r.URL.Host, classifyBlockErr(err))
 	siteStat.TempBlocked(r.URL)
 	return RetryError{err}
 }
@@ -612,7 +729,8 @@ func (c *clientConn) handleServerReadError(r *Request, sv *serverConn, err error
 		sendErrorPage(c, "502 read error", err.Error(), genErrMsg(r, sv, msg))
 		return errPageSent
 	}
-	errl.Printf("cli(%s) unhandled server read error %s %v %s\n", c.RemoteAddr(), msg, err, r)
+	errl.PrintfCtx(c.logCtx(r, sv), "cli(%s) unhandled server read error %s %v %s\n",
+		c.RemoteAddr(), msg, err, r)
 	return err
 }
 
@@ -620,6 +738,7 @@ func (c *clientConn) handleServerWriteError(r *Request, sv *serverConn, err erro
 	// This function is only called in doRequest, no response is sent to client.
 	// So if visiting blocked site, can always retry request.
 	if sv.maybeFake() && isErrConnReset(err) {
+		siteBlock.observe(r.URL.Host, blockReset)
 		siteStat.TempBlocked(r.URL)
 	}
 	return RetryError{err}
@@ -627,7 +746,7 @@ func (c *clientConn) handleServerWriteError(r *Request, sv *serverConn, err erro
 
 func dbgPrintRep(c *clientConn, r *Request, rp *Response) {
 	if rp.Trailer {
-		errl.Printf("cli(%s) response %s has Trailer header\n%s",
+		errl.PrintfCtx(c.logCtx(r, nil), "cli(%s) response %s has Trailer header\n%s",
 			c.RemoteAddr(), rp, rp.Verbose())
 	}
 	if dbgRep {
@@ -663,22 +782,42 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 	if err = parseResponse(sv, r, rp); err != nil {
 		return c.handleServerReadError(r, sv, err, "parse response")
 	}
+	return c.sendResponse(sv, r, rp)
+}
+
+// sendResponse sends parsed response header and body to client.
+func (c *clientConn) sendResponse(sv *serverConn, r *Request, rp *Response) (err error) {
 	dbgPrintRep(c, r, rp)
 	// After have received the first reponses from the server, we consider
 	// ther server as real instead of fake one caused by wrong DNS reply. So
 	// don't time out later.
 	sv.state = svSendRecvResponse
 	r.state = rsRecvBody
+	fill := r.cache.startFill(r, rp)
+	defer func() { fill.finish(err) }()
+	notModified := r.cache.notModified(rp)
+	r.capture.response(rp.rawResponse())
 	r.releaseBuf()
 
-	if _, err = c.Write(rp.rawResponse()); err != nil {
+	if notModified {
+		err = r.cache.serveRevalidated(c, r, rp)
+	} else {
+		_, err = c.Write(rp.rawResponse())
+	}
+	if err != nil {
 		return err
 	}
 
 	rp.releaseBuf()
 
 	if rp.hasBody(r.Method) {
-		if err = sendBody(c, sv.bufRd, int(rp.ContLen), rp.Chunking); err != nil {
+		var w io.Writer = c
+		if fill != nil {
+			fill.w = c
+			w = fill
+		}
+		w = r.capture.responseWriter(w)
+		if err = sendBody(w, sv.bufRd, int(rp.ContLen), rp.Chunking); err != nil {
 			if debug {
 				debug.Printf("cli(%s) send body %v\n", c.RemoteAddr(), err)
 			}
@@ -699,6 +838,10 @@ func (c *clientConn) readResponse(sv *serverConn, r *Request, rp *Response) (err
 			return err
 		}
 	}
+	if notModified {
+		// Client gets the stored response.
+		rp.Status = r.cache.entry.Status
+	}
 	r.state = rsDone
 	/*
 		if debug {
@@ -722,7 +865,23 @@ func (c *clientConn) getServerConn(r *Request) (*serverConn, error) {
 	if r.isConnect {
 		return c.createServerConn(r, siteInfo)
 	}
-	sv := connPool.Get(r.URL.HostPort, siteInfo.AsDirect())
+	var sv *serverConn
+	if config.ParentProxyProtocol != 0 {
+		// Parent connections with PROXY header for this client.
+		key := c.proxyProtoPoolKey(r.URL.HostPort)
+		if r.mitm {
+			key = mitmPoolPrefix + key
+		}
+		sv = connPool.GetSite(key)
+	}
+	if sv == nil {
+		if r.mitm {
+			// Multiplexing connections to parent can't be used for TLS.
+			sv = connPool.GetSite(mitmPoolPrefix + r.URL.HostPort)
+		} else {
+			sv = connPool.Get(r.URL.HostPort, siteInfo.AsDirect())
+		}
+	}
 	if sv != nil {
 		// For websites like feedly, the site itself is not blocked, but the
 		// content it loads may result reset. So we should reset server
@@ -743,7 +902,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 	var c net.Conn
 	var err error
 	if siteInfo.AlwaysDirect() {
-		c, err = net.Dial("tcp", url.HostPort)
+		c, err = dialDirect(url.HostPort, 0)
 	} else {
 		to := dialTimeout
 		if siteInfo.OnceBlocked() && to >= defaultDialTimeout {
@@ -754,7 +913,7 @@ func connectDirect2(url *URL, siteInfo *VisitCnt, recursive bool) (net.Conn, err
 			// problems when network condition is bad.
 			to = maxTimeout
 		}
-		c, err = net.DialTimeout("tcp", url.HostPort, to)
+		c, err = dialDirect(url.HostPort, to)
 	}
 	if err != nil {
 		debug.Printf("error direct connect to: %s %v\n", url.HostPort, err)
@@ -806,7 +965,7 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 		errMsg = genErrMsg(r, nil, "Parent proxy connection failed, always use parent proxy.")
 		goto fail
 	}
-	if siteInfo.AsBlocked() && !parentProxy.empty() {
+	if (siteInfo.AsBlocked() || siteBlock.likelyBlocked(r.URL, siteInfo)) && !parentProxy.empty() {
 		// In case of connection error to socks server, fallback to direct connection
 		if srvconn, err = parentProxy.connect(r.URL); err == nil {
 			return
@@ -823,6 +982,11 @@ func (c *clientConn) connect(r *Request, siteInfo *VisitCnt) (srvconn net.Conn,
 			return
 		}
 		errMsg = genErrMsg(r, nil, "Parent proxy and direct connection failed, maybe blocked site.")
+	} else if shouldRace(siteInfo) {
+		if srvconn, err = c.raceConnect(r, siteInfo); err == nil {
+			return
+		}
+		errMsg = genErrMsg(r, nil, "Direct and parent proxy connection failed, maybe blocked site.")
 	} else {
 		// In case of error on direction connection, try parent server
 		if srvconn, err = connectDirect(r.URL, siteInfo); err == nil {
@@ -864,11 +1028,32 @@ fail:
 }
 
 func (c *clientConn) createServerConn(r *Request, siteInfo *VisitCnt) (*serverConn, error) {
+	r.capture.lookup(r, siteInfo)
+	start := time.Now()
 	srvconn, err := c.connect(r, siteInfo)
 	if err != nil {
 		return nil, err
 	}
-	sv := newServerConn(srvconn, r.URL.HostPort, siteInfo)
+	r.capture.connected(start)
+	hostPort := r.URL.HostPort
+	if srvconn, err = c.sendProxyHeader(srvconn); err != nil {
+		srvconn.Close()
+		sendErrorPage(c, "502 Parent proxy error", err.Error(),
+			genErrMsg(r, nil, "Sending PROXY header to parent proxy failed."))
+		return nil, errPageSent
+	}
+	if hc, ok := srvconn.(httpConn); ok && hc.client != "" {
+		hostPort = c.proxyProtoPoolKey(hostPort)
+	}
+	if r.mitm {
+		if srvconn, err = connectTLS(r, srvconn); err != nil {
+			sendErrorPage(c, "502 TLS handshake failed", err.Error(),
+				genErrMsg(r, nil, "TLS connection to server failed."))
+			return nil, errPageSent
+		}
+		hostPort = mitmPoolPrefix + hostPort
+	}
+	sv := newServerConn(srvconn, hostPort, siteInfo)
 	if debug {
 		debug.Printf("cli(%s) connected to %s %d concurrent connections\n",
 			c.RemoteAddr(), sv.hostPort, incSrvConnCnt(sv.hostPort))
@@ -889,7 +1074,11 @@ func newServerConn(c net.Conn, hostPort string, siteInfo *VisitCnt) *serverConn
 }
 
 func (sv *serverConn) isDirect() bool {
-	_, ok := sv.Conn.(directConn)
+	conn := sv.Conn
+	if mc, ok := conn.(mitmConn); ok {
+		conn = mc.under
+	}
+	_, ok := conn.(directConn)
 	return ok
 }
 
@@ -921,6 +1110,31 @@ func (sv *serverConn) releaseBuf() {
 	}
 }
 
+// Read and Write count bytes for the dashboard and user accounting. Bandwidth
+// limit of user is also applied here, which covers both copyServer2Client
+// and copyClient2Server for CONNECT and normal HTTP requests.
+func (sv *serverConn) Read(b []byte) (int, error) {
+	n, err := sv.Conn.Read(b)
+	if sv.live != nil {
+		atomic.AddInt64(&sv.live.Recv, int64(n))
+	}
+	if qerr := sv.usage.download(n); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+func (sv *serverConn) Write(b []byte) (int, error) {
+	n, err := sv.Conn.Write(b)
+	if sv.live != nil {
+		atomic.AddInt64(&sv.live.Sent, int64(n))
+	}
+	if qerr := sv.usage.upload(n); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
 func (sv *serverConn) Close() error {
 	sv.releaseBuf()
 	if debug {
@@ -948,6 +1162,10 @@ func unsetConnReadTimeout(cn net.Conn, msg string) {
 }
 
 func (sv *serverConn) setReadTimeout(msg string) {
+	if nt := getParentTimeout(connParentServer(sv.Conn)); nt != nil {
+		setConnReadTimeout(sv.Conn, nt.read.Timeout(), msg)
+		return
+	}
 	to := readTimeout
 	if sv.siteInfo.OnceBlocked() && to > defaultReadTimeout {
 		to = minReadTimeout
@@ -1013,6 +1231,7 @@ func copyServer2Client(sv *serverConn, c *clientConn, r *Request) (err error) {
 		var n int
 		if n, err = sv.Read(buf); err != nil {
 			if sv.maybeFake() && maybeBlocked(err) {
+				siteBlock.observe(r.URL.Host, classifyBlockErr(err))
 				siteStat.TempBlocked(r.URL)
 				debug.Printf("srv->cli blocked site %s detected, err: %v retry\n", r.URL.HostPort, err)
 				return RetryError{err}
@@ -1254,15 +1473,16 @@ func (sv *serverConn) sendRequestHeader(r *Request, c *clientConn) (err error) {
 }
 
 func (sv *serverConn) sendRequestBody(r *Request, c *clientConn) (err error) {
-	// Send request body. If this is retry, r.raw contains request body and is
-	// sent while sending raw request.
-	if !r.hasBody() || r.isRetry() {
+	// Send request body. If body has been read in previous try, r.raw contains
+	// request body and is sent while sending raw request.
+	if !r.hasBody() || r.bodyRead {
 		return
 	}
 
-	err = sendBody(newServerWriter(r, sv), c.bufRd, int(r.ContLen), r.Chunking)
+	r.bodyRead = true
+	err = sendBody(r.capture.requestWriter(newServerWriter(r, sv)), c.bufRd, int(r.ContLen), r.Chunking)
 	if err != nil {
-		errl.Printf("cli(%s) send request body error %v %s\n", c.RemoteAddr(), err, r)
+		errl.PrintfCtx(c.logCtx(r, sv), "cli(%s) send request body error %v %s\n", c.RemoteAddr(), err, r)
 		if isErrOpWrite(err) {
 			err = c.handleServerWriteError(r, sv, err, "send request body")
 		}
@@ -1277,12 +1497,25 @@ func (sv *serverConn) sendRequestBody(r *Request, c *clientConn) (err error) {
 // Do HTTP request other that CONNECT
 func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err error) {
 	r.state = rsCreated
+	r.capture.sending()
 	if err = sv.sendRequestHeader(r, c); err != nil {
 		return
 	}
+	if r.ExpectContinue {
+		var final bool
+		if r.hasBody() && !r.bodyRead {
+			final, err = sv.waitContinue(c, r, rp)
+		}
+		// Later 100 responses are ignored by parseResponse.
+		r.ExpectContinue = false
+		if err != nil || final {
+			return
+		}
+	}
 	if err = sv.sendRequestBody(r, c); err != nil {
 		return
 	}
+	r.capture.requestSent()
 	r.state = rsSent
 	if err = c.readResponse(sv, r, rp); err == nil {
 		sv.updateVisit()
@@ -1290,6 +1523,53 @@ func (sv *serverConn) doRequest(c *clientConn, r *Request, rp *Response) (err er
 	return err
 }
 
+// Wait at most this long for server's response to 100-continue expectation.
+var expectContinueTimeout = time.Second
+
+var continueResponse = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// waitContinue waits for server's response before sending request body with
+// 100-continue expectation. 100 Continue is relayed to client. If server
+// sends final response, it's sent to client and the request body is not
+// forwarded. Server may not support the expectation, so body is sent if
+// there's no response in time.
+func (sv *serverConn) waitContinue(c *clientConn, r *Request, rp *Response) (final bool, err error) {
+	sv.initBuf()
+	setConnReadTimeout(sv.Conn, expectContinueTimeout, "waitContinue")
+	_, err = sv.bufRd.Peek(1)
+	unsetConnReadTimeout(sv.Conn, "waitContinue")
+	if err != nil {
+		if isErrTimeout(err) {
+			debug.Printf("cli(%s) no 100 continue in %v, sending body %v\n",
+				c.RemoteAddr(), expectContinueTimeout, r)
+			return false, nil
+		}
+		return false, c.handleServerReadError(r, sv, err, "wait 100 continue")
+	}
+
+	// If server sends final response, client may send body or not, so client
+	// connection can't be used for the next request.
+	keepAlive := r.ConnectionKeepAlive
+	r.ConnectionKeepAlive = false
+	if err = parseResponse(sv, r, rp); err != nil {
+		r.ConnectionKeepAlive = keepAlive
+		return false, c.handleServerReadError(r, sv, err, "parse 100 continue response")
+	}
+	if rp.Status == statusCodeContinue {
+		r.ConnectionKeepAlive = keepAlive
+		if _, err = c.Write(continueResponse); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	debug.Printf("cli(%s) final response %s before request body %v\n", c.RemoteAddr(), rp, r)
+	// Server may still expect request body, don't reuse the connection.
+	rp.ConnectionKeepAlive = false
+	r.state = rsSent
+	defer rp.releaseBuf()
+	return true, c.sendResponse(sv, r, rp)
+}
+
 // Send response body if header specifies content length
 func sendBodyWithContLen(w io.Writer, r *bufio.Reader, contLen int) (err error) {
 	// debug.Println("Sending body with content length", contLen)
@@ -3,8 +3,10 @@ package proxy
 import (
 	"bytes"
 	"github.com/cyfdecyf/bufio"
+	"net"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSendBodyChunked(t *testing.T) {
@@ -105,3 +107,85 @@ func TestInitSelfListenAddr(t *testing.T) {
 		}
 	}
 }
+
+func TestParseExpect(t *testing.T) {
+	var h Header
+	h.parseExpect([]byte("100-Continue"))
+	if !h.ExpectContinue || h.ExpectUnsupported {
+		t.Error("100-continue should be supported")
+	}
+	h = Header{}
+	h.parseExpect([]byte("200-ok"))
+	if h.ExpectContinue || !h.ExpectUnsupported {
+		t.Error("other expectation should be unsupported")
+	}
+}
+
+// expectServer reads request header from conn, runs respond and reports what
+// it read after the header. Responds 200 if request body is received.
+func expectServer(conn net.Conn, respond func(net.Conn), body chan<- string) {
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil || line == "\r\n" {
+			break
+		}
+	}
+	respond(conn)
+	b := make([]byte, 64)
+	n, _ := rd.Read(b)
+	if n > 0 {
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+	}
+	body <- string(b[:n])
+}
+
+func TestExpectContinue(t *testing.T) {
+	saved := expectContinueTimeout
+	defer func() { expectContinueTimeout = saved }()
+	expectContinueTimeout = 50 * time.Millisecond
+
+	const request = "POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\n" +
+		"Expect: 100-continue\r\nContent-Length: 4\r\n\r\nbody"
+	testData := []struct {
+		respond   func(net.Conn)
+		body      string
+		outPrefix string
+		keepAlive bool
+	}{
+		{func(c net.Conn) { c.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n")) },
+			"body", "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n", true},
+		{func(c net.Conn) { c.Write([]byte("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\n\r\n")) },
+			"", "HTTP/1.1 401 Unauthorized\r\n", false},
+		{func(net.Conn) {}, "body", "HTTP/1.1 200 OK\r\n", true},
+	}
+	for i, td := range testData {
+		fc := newFakeConn(request)
+		c := newClientConn(fc, nil)
+		var r Request
+		if err := parseRequest(c, &r); err != nil {
+			t.Fatal(err)
+		}
+		cliEnd, srvEnd := net.Pipe()
+		body := make(chan string, 1)
+		go expectServer(srvEnd, td.respond, body)
+		sv := newServerConn(cliEnd, r.URL.HostPort, siteStat.GetVisitCnt(r.URL))
+		var rp Response
+		if err := sv.doRequest(c, &r, &rp); err != nil {
+			t.Errorf("%d doRequest error: %v", i, err)
+		}
+		cliEnd.Close()
+		if b := <-body; b != td.body {
+			t.Errorf("%d server got body %q, want %q", i, b, td.body)
+		}
+		if s := fc.out.String(); !strings.HasPrefix(s, td.outPrefix) {
+			t.Errorf("%d client got %q", i, s)
+		}
+		if r.ConnectionKeepAlive != td.keepAlive {
+			t.Errorf("%d keep alive should be %v", i, td.keepAlive)
+		}
+		srvEnd.Close()
+		sv.Close()
+		c.releaseBuf()
+	}
+}
@@ -0,0 +1,346 @@
+// PROXY protocol (v1 and v2) support, for running behind load balancers:
+//
+//	proxyProtocol = 0.0.0.0:7777 10.0.0.0/8,192.168.1.1  # listen address, trusted sources
+//	parentProxyProtocol = 1                               # send v1 or v2 header to http parents
+//
+// Connections from trusted sources to the listener must start with a PROXY
+// header, whose source address is then used as the client address for
+// authentication, accounting and logs. Connections from other sources are
+// served as usual. See
+// http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const (
+	proxyProtoTimeout = 5 * time.Second
+	proxyProtoV1Max   = 107 // max length of v1 header including CRLF
+
+	proxyProtoPoolPrefix = "proxy:"
+)
+
+var (
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyProtoHeader = errors.New("invalid PROXY protocol header")
+)
+
+// trusted sources of PROXY header for listen address
+var proxyProtoTrusted map[string][]*net.IPNet
+
+func initProxyProtocol() {
+	proxyProtoTrusted = make(map[string][]*net.IPNet)
+	for _, val := range config.ProxyProtocol {
+		arr := strings.Fields(val)
+		if len(arr) != 2 {
+			Fatal("proxyProtocol syntax wrong, should be <listen address> <trusted IP/CIDR,...>:", val)
+		}
+		var trusted []*net.IPNet
+		for _, s := range strings.Split(arr[1], ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			ipnet, err := parseIPNet(s)
+			if err != nil {
+				Fatal("proxyProtocol trusted source", err)
+			}
+			trusted = append(trusted, ipnet)
+		}
+		proxyProtoTrusted[arr[0]] = trusted
+	}
+	for addr := range proxyProtoTrusted {
+		found := false
+		for _, p := range listenProxy {
+			if p.Addr() == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			Fatal("proxyProtocol: no listen address", addr)
+		}
+	}
+}
+
+// proxyProtoListen wraps listener for proxy at addr, which accepts PROXY
+// header from trusted sources if enabled for the address.
+func proxyProtoListen(addr string, ln net.Listener) net.Listener {
+	if trusted, ok := proxyProtoTrusted[addr]; ok {
+		return &proxyProtoListener{ln, trusted}
+	}
+	return ln
+}
+
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (pl *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range pl.trusted {
+		if ipnet.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil || !pl.isTrusted(conn.RemoteAddr()) {
+		return conn, err
+	}
+	return newProxyProtoConn(conn), nil
+}
+
+// proxyProtoConn reads PROXY header on first Read or address query, so
+// accepting connections is not blocked by slow clients.
+type proxyProtoConn struct {
+	net.Conn
+	rd       *bufio.Reader // nil after buffered data is consumed
+	once     sync.Once
+	remote   net.Addr
+	local    net.Addr
+	err      error
+	deadline time.Time // read deadline set by user
+}
+
+func newProxyProtoConn(conn net.Conn) *proxyProtoConn {
+	return &proxyProtoConn{Conn: conn, rd: bufio.NewReaderSize(conn, 256)}
+}
+
+func (pc *proxyProtoConn) readHeader() {
+	pc.once.Do(func() {
+		d := time.Now().Add(proxyProtoTimeout)
+		if !pc.deadline.IsZero() && pc.deadline.Before(d) {
+			d = pc.deadline
+		}
+		pc.Conn.SetReadDeadline(d)
+		pc.remote, pc.local, pc.err = readProxyHeader(pc.rd)
+		pc.Conn.SetReadDeadline(pc.deadline)
+		if pc.err != nil {
+			errl.Printf("cli(%s) PROXY protocol: %v\n", pc.Conn.RemoteAddr(), pc.err)
+		} else if debug && pc.remote != nil {
+			debug.Printf("cli(%s) PROXY protocol client %s\n", pc.Conn.RemoteAddr(), pc.remote)
+		}
+	})
+}
+
+func (pc *proxyProtoConn) Read(b []byte) (int, error) {
+	pc.readHeader()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	if pc.rd != nil {
+		if pc.rd.Buffered() > 0 {
+			return pc.rd.Read(b)
+		}
+		pc.rd = nil
+	}
+	return pc.Conn.Read(b)
+}
+
+func (pc *proxyProtoConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	if pc.remote != nil {
+		return pc.remote
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyProtoConn) LocalAddr() net.Addr {
+	pc.readHeader()
+	if pc.local != nil {
+		return pc.local
+	}
+	return pc.Conn.LocalAddr()
+}
+
+func (pc *proxyProtoConn) SetDeadline(t time.Time) error {
+	pc.deadline = t
+	return pc.Conn.SetDeadline(t)
+}
+
+func (pc *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	pc.deadline = t
+	return pc.Conn.SetReadDeadline(t)
+}
+
+// readProxyHeader reads v1 or v2 header. Returned addresses are nil if the
+// header does not carry addresses, e.g. health check from load balancer.
+func readProxyHeader(rd *bufio.Reader) (remote, local net.Addr, err error) {
+	b, err := rd.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyProtoV2Sig) {
+		return readProxyHeaderV2(rd)
+	}
+	if bytes.HasPrefix(b, proxyProtoV1Prefix) {
+		return readProxyHeaderV1(rd)
+	}
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func readProxyHeaderV1(rd *bufio.Reader) (remote, local net.Addr, err error) {
+	line, err := rd.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errProxyProtoHeader
+		}
+		return nil, nil, err
+	}
+	if len(line) > proxyProtoV1Max || !bytes.HasSuffix(line, []byte(CRLF)) {
+		return nil, nil, errProxyProtoHeader
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, nil, errProxyProtoHeader
+	}
+	src, srcErr := parseProxyAddr(f[2], f[4])
+	dst, dstErr := parseProxyAddr(f[3], f[5])
+	if srcErr != nil || dstErr != nil {
+		return nil, nil, errProxyProtoHeader
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyProtoHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+const (
+	proxyProtoV2Local = 0x20
+	proxyProtoV2Proxy = 0x21
+	proxyProtoV2TCP4  = 0x11
+	proxyProtoV2TCP6  = 0x21
+)
+
+func readProxyHeaderV2(rd *bufio.Reader) (remote, local net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err = io.ReadFull(rd, hdr); err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err = io.ReadFull(rd, b); err != nil {
+		return nil, nil, err
+	}
+	switch hdr[12] {
+	case proxyProtoV2Local:
+		return nil, nil, nil
+	case proxyProtoV2Proxy:
+	default:
+		return nil, nil, errProxyProtoHeader
+	}
+	var ipLen int
+	switch hdr[13] {
+	case proxyProtoV2TCP4:
+		ipLen = net.IPv4len
+	case proxyProtoV2TCP6:
+		ipLen = net.IPv6len
+	default:
+		// Other protocols are not supported, use connection address.
+		return nil, nil, nil
+	}
+	if len(b) < 2*ipLen+4 {
+		return nil, nil, errProxyProtoHeader
+	}
+	// Remaining TLVs are ignored.
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), b[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), b[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(b[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// genProxyHeader generates PROXY header of version for connection from src
+// to dst. Addresses of different families or non TCP addresses are sent as
+// unknown.
+func genProxyHeader(version int, src, dst net.Addr) []byte {
+	sa, _ := src.(*net.TCPAddr)
+	da, _ := dst.(*net.TCPAddr)
+	v4 := sa != nil && da != nil && sa.IP.To4() != nil && da.IP.To4() != nil
+	v6 := sa != nil && da != nil && !v4 && sa.IP.To4() == nil && da.IP.To4() == nil
+	if version == 1 {
+		switch {
+		case v4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", sa.IP, da.IP, sa.Port, da.Port))
+		case v6:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", sa.IP, da.IP, sa.Port, da.Port))
+		}
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	b := make([]byte, 16, 16+2*net.IPv6len+4)
+	copy(b, proxyProtoV2Sig)
+	b[12] = proxyProtoV2Proxy
+	var sip, dip net.IP
+	switch {
+	case v4:
+		b[13] = proxyProtoV2TCP4
+		sip, dip = sa.IP.To4(), da.IP.To4()
+	case v6:
+		b[13] = proxyProtoV2TCP6
+		sip, dip = sa.IP.To16(), da.IP.To16()
+	default:
+		b[12] = proxyProtoV2Local
+		return b
+	}
+	b = append(b, sip...)
+	b = append(b, dip...)
+	b = append(b, byte(sa.Port>>8), byte(sa.Port), byte(da.Port>>8), byte(da.Port))
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-16))
+	return b
+}
+
+// sendProxyHeader sends PROXY header for client to newly connected http
+// parent. Returns the connection to use.
+func (c *clientConn) sendProxyHeader(conn net.Conn) (net.Conn, error) {
+	hc, ok := conn.(httpConn)
+	if !ok || config.ParentProxyProtocol == 0 {
+		return conn, nil
+	}
+	if _, err := hc.Write(genProxyHeader(config.ParentProxyProtocol, c.RemoteAddr(), c.LocalAddr())); err != nil {
+		return conn, err
+	}
+	hc.client = c.RemoteAddr().String()
+	return hc, nil
+}
+
+// proxyProtoPoolKey returns connection pool key for parent connections with
+// PROXY header for the client, these connections can't be shared.
+func (c *clientConn) proxyProtoPoolKey(hostPort string) string {
+	return proxyProtoPoolPrefix + c.RemoteAddr().String() + "@" + hostPort
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 7777}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 7777}
+	testData := []struct {
+		header   string
+		src, dst string
+		err      bool
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 7777\r\n", "192.0.2.1:56324", "192.0.2.2:7777", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 7777\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:7777", false},
+		{"PROXY UNKNOWN\r\n", "", "", false},
+		{string(genProxyHeader(1, src, dst)), "192.0.2.1:56324", "192.0.2.2:7777", false},
+		{string(genProxyHeader(2, src, dst)), "192.0.2.1:56324", "192.0.2.2:7777", false},
+		{string(genProxyHeader(2, src6, dst6)), "[2001:db8::1]:56324", "[2001:db8::2]:7777", false},
+		{string(genProxyHeader(2, src, dst6)), "", "", false}, // LOCAL
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 77777\r\n", "", "", true},
+		{"PROXY TCP4 192.0.2.1 192.0.2.2 56324 7777\n", "", "", true},
+		{"GET / HTTP/1.1\r\n\r\n", "", "", true},
+	}
+	for _, td := range testData {
+		rd := bufio.NewReader(strings.NewReader(td.header + "data"))
+		remote, local, err := readProxyHeader(rd)
+		if td.err {
+			if err == nil {
+				t.Errorf("%q should be invalid", td.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q error: %v", td.header, err)
+			continue
+		}
+		if td.src == "" {
+			if remote != nil || local != nil {
+				t.Errorf("%q should have no address, got %v %v", td.header, remote, local)
+			}
+		} else if remote.String() != td.src || local.String() != td.dst {
+			t.Errorf("%q parsed as %v %v", td.header, remote, local)
+		}
+		if b, _ := rd.Peek(4); string(b) != "data" {
+			t.Errorf("%q: data after header %q", td.header, b)
+		}
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		proxyProtoTrusted = nil
+	}()
+	proxyProtoTrusted = map[string][]*net.IPNet{}
+	trusted, _ := parseIPNet("127.0.0.0/8")
+	proxyProtoTrusted["127.0.0.1:0"] = []*net.IPNet{trusted}
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 7777\r\nhello"))
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if s := conn.RemoteAddr().String(); s != "192.0.2.1:56324" {
+		t.Errorf("remote addr %s", s)
+	}
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("read %q %v", b, err)
+	}
+
+	// PROXY header for the client is sent to http parent.
+	config.ParentProxyProtocol = 1
+	c := newClientConn(conn, nil)
+	defer c.releaseBuf()
+	fc := newFakeConn("")
+	pconn, err := c.sendProxyHeader(httpConn{Conn: fc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fc.out.String(); s != "PROXY TCP4 192.0.2.1 192.0.2.2 56324 7777\r\n" {
+		t.Errorf("sent PROXY header %q", s)
+	}
+	if pconn.(httpConn).client != "192.0.2.1:56324" {
+		t.Error("connection to parent should record client")
+	}
+}
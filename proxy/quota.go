@@ -0,0 +1,416 @@
+// Per-user traffic accounting, monthly quota, bandwidth and concurrent
+// connection limits for authenticated users.
+//
+// Limits are specified with the userLimit option:
+//
+//	userLimit = alice quota=10G rate=512K conns=8
+//	userLimit = * quota=1G
+//
+// "*" applies to users without their own limit. Usage is saved to usageFile
+// and reset at the beginning of each month.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	usageFname     = "usage"
+	monthLayout    = "2006-01"
+	defaultLimitID = "*"
+)
+
+var (
+	errQuotaExceeded = errors.New("monthly quota exceeded")
+	errTooManyConns  = errors.New("too many concurrent connections")
+)
+
+type userLimit struct {
+	quota int64 // bytes per month, upload and download, 0 means unlimited
+	rate  int64 // bytes per second for each direction, 0 means unlimited
+	conns int32 // max concurrent client connections, 0 means unlimited
+}
+
+// parseSize parses size like 512K, 10M, 1G, 1.5GB.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	mul := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		case 'T':
+			mul = 1 << 40
+		}
+		if mul != 1 {
+			s = s[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(mul)), nil
+}
+
+func parseUserLimit(val string) (user string, ul userLimit, err error) {
+	arr := strings.Fields(val)
+	if len(arr) < 2 {
+		err = errors.New("userLimit syntax wrong, should be user quota=<size> rate=<size> conns=<n>")
+		return
+	}
+	user = arr[0]
+	for _, kv := range arr[1:] {
+		v := strings.SplitN(kv, "=", 2)
+		if len(v) != 2 {
+			return "", ul, fmt.Errorf("userLimit %s: malformed %s", user, kv)
+		}
+		switch v[0] {
+		case "quota":
+			ul.quota, err = parseSize(v[1])
+		case "rate":
+			ul.rate, err = parseSize(v[1])
+		case "conns":
+			var n int
+			n, err = strconv.Atoi(v[1])
+			ul.conns = int32(n)
+			if err == nil && n < 0 {
+				err = errors.New("conns should not be negative")
+			}
+		default:
+			err = fmt.Errorf("unknown limit %s", v[0])
+		}
+		if err != nil {
+			return "", ul, fmt.Errorf("userLimit %s: %v", user, err)
+		}
+	}
+	return
+}
+
+// tokenBucket limits bandwidth. Bytes are taken after transfer, so the bucket
+// may go into debt and the next transfer waits until it's paid.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (tb *tokenBucket) take(n int) {
+	if tb == nil || n <= 0 {
+		return
+	}
+	tb.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.rate { // allow burst of one second
+		tb.tokens = tb.rate
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	var wait time.Duration
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// userUsage records traffic of a user in the current month.
+type userUsage struct {
+	Month    string `json:"month"`
+	Upload   int64  `json:"upload"`   // updated atomically
+	Download int64  `json:"download"` // updated atomically
+
+	user     string
+	limit    userLimit
+	conns    int32 // current client connections, updated atomically
+	upRate   *tokenBucket
+	downRate *tokenBucket
+	exceeded int32 // whether quota exceeded is logged in this month
+}
+
+var usage struct {
+	sync.Mutex
+	limit map[string]userLimit
+	user  map[string]*userUsage
+	path  string
+
+	storeLock sync.Mutex // serializes storing, held while writing file
+	released  bool       // usage file is owned by new process after upgrade
+}
+
+func initUserUsage() {
+	usage.limit = make(map[string]userLimit)
+	usage.user = make(map[string]*userUsage)
+	for _, val := range config.UserLimit {
+		user, ul, err := parseUserLimit(val)
+		if err != nil {
+			Fatal(err)
+		}
+		if _, ok := usage.limit[user]; ok {
+			Fatal("duplicate userLimit for", user)
+		}
+		usage.limit[user] = ul
+	}
+	usage.path = config.UsageFile
+	if err := loadUserUsage(usage.path); err != nil && !os.IsNotExist(err) {
+		errl.Println("load user usage:", err)
+	}
+	if !auth.required {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(5 * time.Minute)
+			storeUserUsage()
+		}
+	}()
+}
+
+func loadUserUsage(path string) error {
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	saved := make(map[string]*userUsage)
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	for user, uu := range saved {
+		getUserUsage(user).restore(uu)
+	}
+	return nil
+}
+
+func storeUserUsage() {
+	if usage.path == "" {
+		return
+	}
+	usage.storeLock.Lock()
+	defer usage.storeLock.Unlock()
+	if usage.released {
+		return
+	}
+	saved := make(map[string]*userUsage)
+	usage.Lock()
+	for user, uu := range usage.user {
+		saved[user] = &userUsage{
+			Month:    uu.Month,
+			Upload:   atomic.LoadInt64(&uu.Upload),
+			Download: atomic.LoadInt64(&uu.Download),
+		}
+	}
+	usage.Unlock()
+	b, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		errl.Println("marshal user usage:", err)
+		return
+	}
+	f, err := ioutil.TempFile(path.Dir(usage.path), "usage")
+	if err != nil {
+		errl.Println("store user usage:", err)
+		return
+	}
+	if _, err = f.Write(b); err != nil {
+		errl.Println("store user usage:", err)
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+	f.Close()
+	if err = os.Rename(f.Name(), usage.path); err != nil {
+		errl.Println("rename user usage file:", err)
+	}
+}
+
+// releaseUserUsage stops storing usage, after the new process started on
+// upgrade has loaded the usage file.
+func releaseUserUsage() {
+	usage.storeLock.Lock()
+	usage.released = true
+	usage.storeLock.Unlock()
+}
+
+// getUserUsage returns usage for the user, creating one if not exist.
+func getUserUsage(user string) *userUsage {
+	usage.Lock()
+	defer usage.Unlock()
+	if uu, ok := usage.user[user]; ok {
+		return uu
+	}
+	ul, ok := usage.limit[user]
+	if !ok {
+		ul = usage.limit[defaultLimitID]
+	}
+	uu := &userUsage{
+		Month:    time.Now().Format(monthLayout),
+		user:     user,
+		limit:    ul,
+		upRate:   newTokenBucket(ul.rate),
+		downRate: newTokenBucket(ul.rate),
+	}
+	usage.user[user] = uu
+	return uu
+}
+
+func (uu *userUsage) restore(saved *userUsage) {
+	if saved.Month != time.Now().Format(monthLayout) {
+		return
+	}
+	atomic.StoreInt64(&uu.Upload, saved.Upload)
+	atomic.StoreInt64(&uu.Download, saved.Download)
+}
+
+// checkMonth resets usage at the beginning of a month.
+func (uu *userUsage) checkMonth() {
+	now := time.Now().Format(monthLayout)
+	usage.Lock()
+	if uu.Month != now {
+		info.Printf("user %s usage in %s: upload %d download %d, reset\n",
+			uu.user, uu.Month, atomic.LoadInt64(&uu.Upload), atomic.LoadInt64(&uu.Download))
+		uu.Month = now
+		atomic.StoreInt64(&uu.Upload, 0)
+		atomic.StoreInt64(&uu.Download, 0)
+		atomic.StoreInt32(&uu.exceeded, 0)
+	}
+	usage.Unlock()
+}
+
+func (uu *userUsage) total() int64 {
+	return atomic.LoadInt64(&uu.Upload) + atomic.LoadInt64(&uu.Download)
+}
+
+// checkQuota should be called before serving each request.
+func (uu *userUsage) checkQuota() error {
+	uu.checkMonth()
+	return uu.overQuota()
+}
+
+func (uu *userUsage) overQuota() error {
+	if uu.limit.quota == 0 || uu.total() < uu.limit.quota {
+		return nil
+	}
+	if atomic.CompareAndSwapInt32(&uu.exceeded, 0, 1) {
+		info.Printf("user %s exceeded monthly quota %d\n", uu.user, uu.limit.quota)
+	}
+	return errQuotaExceeded
+}
+
+func (uu *userUsage) acquireConn() error {
+	n := atomic.AddInt32(&uu.conns, 1)
+	if uu.limit.conns > 0 && n > uu.limit.conns {
+		atomic.AddInt32(&uu.conns, -1)
+		info.Printf("user %s exceeded max %d concurrent connections\n", uu.user, uu.limit.conns)
+		return errTooManyConns
+	}
+	return nil
+}
+
+func (uu *userUsage) releaseConn() {
+	atomic.AddInt32(&uu.conns, -1)
+}
+
+// upload and download are called after transferring data to and from server.
+// They block if exceeding bandwidth limit, and return errQuotaExceeded once
+// the monthly quota is used up, so long lived tunnels are stopped too.
+func (uu *userUsage) upload(n int) error {
+	if uu == nil {
+		return nil
+	}
+	atomic.AddInt64(&uu.Upload, int64(n))
+	uu.upRate.take(n)
+	return uu.overQuota()
+}
+
+func (uu *userUsage) download(n int) error {
+	if uu == nil {
+		return nil
+	}
+	atomic.AddInt64(&uu.Download, int64(n))
+	uu.downRate.take(n)
+	return uu.overQuota()
+}
+
+// usageConn accounts traffic on connection to server for user. Used by
+// SOCKS tunnels, HTTP requests account in serverConn.
+type usageConn struct {
+	net.Conn
+	usage *userUsage
+}
+
+func (uc usageConn) Read(b []byte) (int, error) {
+	n, err := uc.Conn.Read(b)
+	if qerr := uc.usage.download(n); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+func (uc usageConn) Write(b []byte) (int, error) {
+	n, err := uc.Conn.Write(b)
+	if qerr := uc.usage.upload(n); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+type userUsageInfo struct {
+	User     string `json:"user"`
+	Month    string `json:"month"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	Quota    int64  `json:"quota"`
+	Rate     int64  `json:"rate"`
+	Conns    int32  `json:"conns"`
+	MaxConns int32  `json:"max_conns"`
+}
+
+func getUserUsageInfo() []userUsageInfo {
+	lst := []userUsageInfo{}
+	usage.Lock()
+	for user, uu := range usage.user {
+		lst = append(lst, userUsageInfo{
+			User:     user,
+			Month:    uu.Month,
+			Upload:   atomic.LoadInt64(&uu.Upload),
+			Download: atomic.LoadInt64(&uu.Download),
+			Quota:    uu.limit.quota,
+			Rate:     uu.limit.rate,
+			Conns:    atomic.LoadInt32(&uu.conns),
+			MaxConns: uu.limit.conns,
+		})
+	}
+	usage.Unlock()
+	sort.Slice(lst, func(i, j int) bool { return lst[i].User < lst[j].User })
+	return lst
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseUserLimit(t *testing.T) {
+	user, ul, err := parseUserLimit("alice quota=1.5G rate=512K conns=8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" || ul.quota != 3<<29 || ul.rate != 512<<10 || ul.conns != 8 {
+		t.Errorf("parse user limit got %s %+v\n", user, ul)
+	}
+	for _, val := range []string{"alice", "alice quota", "alice quota=1X", "alice speed=1M", "alice conns=-1"} {
+		if _, _, err = parseUserLimit(val); err == nil {
+			t.Errorf("%q should return error\n", val)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(100 << 10)
+	start := time.Now()
+	// The first 100K is burst, then need to wait for another 50K.
+	tb.take(100 << 10)
+	tb.take(50 << 10)
+	if d := time.Now().Sub(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("token bucket wait %v, should be about 500ms\n", d)
+	}
+	var unlimited *tokenBucket
+	unlimited.take(1 << 30) // should not block
+}
+
+func TestUserUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.UserLimit = []string{"alice quota=1K conns=1", "* conns=2"}
+	config.UsageFile = path.Join(dir, "usage")
+	defer func() {
+		config.UserLimit = nil
+	}()
+	initUserUsage()
+
+	uu := getUserUsage("alice")
+	if err = uu.acquireConn(); err != nil {
+		t.Fatal(err)
+	}
+	if err = uu.acquireConn(); err != errTooManyConns {
+		t.Error("should exceed max concurrent connections, got", err)
+	}
+	uu.releaseConn()
+
+	uu.upload(600)
+	uu.download(300)
+	if err = uu.checkQuota(); err != nil {
+		t.Error("should not exceed quota, got", err)
+	}
+	if err = uu.download(200); err != errQuotaExceeded {
+		t.Error("transfer over quota should fail, got", err)
+	}
+	if err = uu.checkQuota(); err != errQuotaExceeded {
+		t.Error("should exceed quota, got", err)
+	}
+	if bob := getUserUsage("bob"); bob.limit.conns != 2 || bob.limit.quota != 0 {
+		t.Errorf("default limit should apply, got %+v\n", bob.limit)
+	}
+
+	storeUserUsage()
+	initUserUsage()
+	uu = getUserUsage("alice")
+	if uu.Upload != 600 || uu.Download != 500 {
+		t.Errorf("loaded usage upload %d download %d\n", uu.Upload, uu.Download)
+	}
+
+	// Usage of last month should be reset.
+	uu.Month = "2000-01"
+	if err = uu.checkQuota(); err != nil || uu.total() != 0 {
+		t.Errorf("usage should be reset on new month, total %d err %v\n", uu.total(), err)
+	}
+}
+
+func TestUsageConnQuota(t *testing.T) {
+	uu := &userUsage{user: "carol", limit: userLimit{quota: 100}}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		c2.Write(make([]byte, 80))
+		c2.Write(make([]byte, 80))
+		c2.Close()
+	}()
+	uc := usageConn{c1, uu}
+	buf := make([]byte, 100)
+	if _, err := uc.Read(buf); err != nil {
+		t.Fatal("read within quota:", err)
+	}
+	if _, err := uc.Read(buf); err != errQuotaExceeded {
+		t.Error("read over quota should stop tunnel, got", err)
+	}
+}
@@ -0,0 +1,269 @@
+// Request and response rewriting.
+//
+//	rewrite = <domains> <action> [args]
+//
+// domains is a comma separated list matching the domains and their subdomains,
+// * matches all hosts. Actions:
+//
+//	reqadd Name: value       add request header
+//	reqset Name: value       replace request header
+//	reqdel Name              remove request header
+//	respadd Name: value      add response header
+//	respset Name: value      replace response header
+//	respdel Name             remove response header
+//	url <path prefix> <url>  rewrite request with path prefix to url, e.g.
+//	                         rewrite = example.com url /pkg/ http://mirror.lan/pkg/
+//
+// Rules apply in the order given. Hop-by-hop headers are managed by COW and
+// can't be rewritten.
+//
+//	forwardedFor = true      add client address to X-Forwarded-For
+//	via = name               add "Via: 1.1 name" to requests and responses
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+type rewriteAction byte
+
+const (
+	rwReqAdd rewriteAction = iota
+	rwReqSet
+	rwReqDel
+	rwRespAdd
+	rwRespSet
+	rwRespDel
+	rwURL
+)
+
+var rewriteActionName = map[string]rewriteAction{
+	"reqadd":  rwReqAdd,
+	"reqset":  rwReqSet,
+	"reqdel":  rwReqDel,
+	"respadd": rwRespAdd,
+	"respset": rwRespSet,
+	"respdel": rwRespDel,
+	"url":     rwURL,
+}
+
+type rewriteRule struct {
+	domains []string
+	action  rewriteAction
+	name    string // header name
+	line    string // header line to add, without CRLF
+
+	prefix    string // path prefix for url rewrite
+	target    *URL
+	targetTLS bool   // target url is https
+	host      string // Host header for target
+}
+
+func (rr *rewriteRule) isResponse() bool {
+	return rr.action >= rwRespAdd && rr.action <= rwRespDel
+}
+
+var rewriteRules []*rewriteRule
+
+func initRewrite() {
+	rewriteRules = nil
+	for _, val := range config.Rewrite {
+		rr, err := parseRewriteRule(val)
+		if err != nil {
+			Fatal(err)
+		}
+		rewriteRules = append(rewriteRules, rr)
+	}
+}
+
+func parseRewriteRule(val string) (*rewriteRule, error) {
+	arr := strings.Fields(val)
+	if len(arr) < 3 {
+		return nil, errors.New("rewrite syntax wrong, should be <domains> <action> <args>")
+	}
+	act, ok := rewriteActionName[strings.ToLower(arr[1])]
+	if !ok {
+		return nil, fmt.Errorf("rewrite %s: unknown action %s", val, arr[1])
+	}
+	rr := &rewriteRule{action: act}
+	for _, d := range strings.Split(strings.ToLower(arr[0]), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			rr.domains = append(rr.domains, d)
+		}
+	}
+
+	switch act {
+	case rwURL:
+		if len(arr) != 4 || !strings.HasPrefix(arr[2], "/") {
+			return nil, fmt.Errorf("rewrite %s: should be url <path prefix> <url>", val)
+		}
+		u, err := url.Parse(arr[3])
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %s: %v", val, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("rewrite %s: target should be http or https url", val)
+		}
+		rr.prefix = arr[2]
+		rr.targetTLS = u.Scheme == "https"
+		rr.host = u.Host
+		rr.target = &URL{Path: u.RequestURI()}
+		hostPort := u.Host
+		if u.Port() == "" {
+			if rr.targetTLS {
+				hostPort = net.JoinHostPort(u.Hostname(), "443")
+			} else {
+				hostPort = net.JoinHostPort(u.Hostname(), "80")
+			}
+		}
+		rr.target.ParseHostPort(hostPort)
+		return rr, nil
+	case rwReqDel, rwRespDel:
+		if len(arr) != 3 {
+			return nil, fmt.Errorf("rewrite %s: should be %s <name>", val, arr[1])
+		}
+		rr.name = arr[2]
+	default:
+		// Header value may contain spaces, so skip domains and action to
+		// get the header line.
+		line := strings.TrimSpace(val)
+		for i := 0; i < 2; i++ {
+			line = strings.TrimLeft(line[strings.IndexAny(line, " \t"):], " \t")
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("rewrite %s: header should be Name: value", val)
+		}
+		rr.name = strings.TrimSpace(line[:i])
+		rr.line = rr.name + ": " + strings.TrimSpace(line[i+1:])
+	}
+	if hopByHopHeader[strings.ToLower(rr.name)] {
+		return nil, fmt.Errorf("rewrite %s: can't rewrite hop-by-hop header", val)
+	}
+	return rr, nil
+}
+
+// rewriteHeader applies header rule to raw header lines.
+func (rr *rewriteRule) rewriteHeader(hdr []byte) []byte {
+	switch rr.action {
+	case rwReqSet, rwReqDel, rwRespSet, rwRespDel:
+		hdr = removeHeader(hdr, rr.name)
+	}
+	switch rr.action {
+	case rwReqAdd, rwReqSet, rwRespAdd, rwRespSet:
+		hdr = append(append(hdr, rr.line...), CRLF...)
+	}
+	return hdr
+}
+
+// rewriteRequest applies rewrite rules matching the request host, and adds
+// X-Forwarded-For and Via if configured. Should be called before reading
+// request body.
+func (c *clientConn) rewriteRequest(r *Request) {
+	if r.isConnect {
+		return
+	}
+	host := strings.ToLower(r.URL.Host)
+	var rules []*rewriteRule
+	for _, rr := range rewriteRules {
+		if hostInDomains(host, rr.domains) {
+			rules = append(rules, rr)
+		}
+	}
+	if len(rules) == 0 && !config.ForwardedFor && config.Via == "" {
+		return
+	}
+
+	// Last line of raw header is the empty line.
+	hdr := append([]byte(nil), r.raw.Bytes()[r.headStart:r.bodyStart-len(CRLF)]...)
+	urlRewritten := false
+	for _, rr := range rules {
+		if rr.isResponse() {
+			r.respRules = append(r.respRules, rr)
+			continue
+		}
+		if rr.action != rwURL {
+			hdr = rr.rewriteHeader(hdr)
+			continue
+		}
+		if urlRewritten || !strings.HasPrefix(r.URL.Path, rr.prefix) {
+			continue
+		}
+		debug.Printf("cli(%s) rewrite %s to %s\n", c.RemoteAddr(), r, rr.target)
+		u := *rr.target
+		u.Path = rr.target.Path + r.URL.Path[len(rr.prefix):]
+		r.URL = &u
+		r.Header.Host = u.HostPort
+		r.mitm = rr.targetTLS
+		hdr = removeHeader(hdr, headerHost)
+		hdr = append(append(hdr, "Host: "+rr.host...), CRLF...)
+		urlRewritten = true
+	}
+	if config.ForwardedFor {
+		clientIP, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if v, ok := headerValue(hdr, "x-forwarded-for"); ok {
+			clientIP = v + ", " + clientIP
+			hdr = removeHeader(hdr, "x-forwarded-for")
+		}
+		hdr = append(append(hdr, "X-Forwarded-For: "+clientIP...), CRLF...)
+	}
+	if config.Via != "" {
+		hdr = append(append(hdr, "Via: 1.1 "+config.Via...), CRLF...)
+	}
+
+	if urlRewritten {
+		r.raw.Reset()
+		if config.saveReqLine {
+			r.raw.WriteString(r.Method + " http://" + r.URL.HostPort + r.URL.Path + " HTTP/1.1\r\n")
+		}
+		r.reqLnStart = r.raw.Len()
+		r.genRequestLine()
+		r.headStart = r.raw.Len()
+	} else {
+		r.raw.Truncate(r.headStart)
+	}
+	r.raw.Write(hdr)
+	r.raw.WriteString(CRLF)
+	r.bodyStart = r.raw.Len()
+}
+
+// rewriteResponse applies response rules of the request to response header
+// parsed so far.
+func rewriteResponse(r *Request, rp *Response) {
+	if len(r.respRules) == 0 && config.Via == "" {
+		return
+	}
+	raw := rp.raw.Bytes()
+	statusEnd := bytes.IndexByte(raw, '\n') + 1
+	hdr := append([]byte(nil), raw[statusEnd:]...)
+	for _, rr := range r.respRules {
+		hdr = rr.rewriteHeader(hdr)
+	}
+	if config.Via != "" {
+		hdr = append(append(hdr, "Via: 1.1 "+config.Via...), CRLF...)
+	}
+	rp.raw.Truncate(statusEnd)
+	rp.raw.Write(hdr)
+}
+
+// stripConnHeader removes headers listed in Connection header from raw
+// header starting at start. They are hop-by-hop as well.
+func stripConnHeader(raw *bytes.Buffer, start int, names []string) {
+	var buf bytes.Buffer
+	forEachHeader(raw.Bytes()[start:], func(n, _, line []byte) {
+		for _, name := range names {
+			if strings.EqualFold(string(n), name) {
+				return
+			}
+		}
+		buf.Write(line)
+	})
+	raw.Truncate(start)
+	raw.Write(buf.Bytes())
+}
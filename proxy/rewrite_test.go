@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRewriteRule(t *testing.T) {
+	rr, err := parseRewriteRule("Example.com,foo.org reqset User-Agent:  my agent ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.action != rwReqSet || rr.name != "User-Agent" || rr.line != "User-Agent: my agent" ||
+		len(rr.domains) != 2 || rr.domains[0] != "example.com" {
+		t.Errorf("header rule parsed as %+v", rr)
+	}
+
+	rr, err = parseRewriteRule("example.com url /pkg/ https://mirror.lan/dist/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.prefix != "/pkg/" || !rr.targetTLS || rr.host != "mirror.lan" ||
+		rr.target.HostPort != "mirror.lan:443" || rr.target.Path != "/dist/" {
+		t.Errorf("url rule parsed as %+v %+v", rr, rr.target)
+	}
+
+	for _, val := range []string{
+		"example.com reqadd",
+		"example.com foo X-A: b",
+		"example.com reqadd X-A",
+		"example.com reqdel Connection",
+		"example.com url pkg http://mirror.lan/",
+		"example.com url /pkg/ ftp://mirror.lan/",
+	} {
+		if _, err = parseRewriteRule(val); err == nil {
+			t.Errorf("%q should be invalid", val)
+		}
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	saved := config
+	defer func() {
+		config = saved
+		rewriteRules = nil
+	}()
+	config.Rewrite = []string{
+		"example.com reqdel Cookie",
+		"example.com reqadd X-Test: 1",
+		"example.com url /pkg/ http://mirror.lan:8080/dist/",
+		"example.com respset Server: cow",
+		"other.com reqadd X-Other: 1",
+	}
+	config.ForwardedFor = true
+	config.Via = "test"
+	initRewrite()
+
+	const request = "GET http://www.example.com/pkg/a.tgz HTTP/1.1\r\nHost: www.example.com\r\n" +
+		"Cookie: a=b\r\nConnection: keep-alive, X-Hop\r\nX-Hop: 1\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n"
+	c := newClientConn(newFakeConn(request), nil)
+	defer c.releaseBuf()
+	var r Request
+	if err := parseRequest(c, &r); err != nil {
+		t.Fatal(err)
+	}
+	c.rewriteRequest(&r)
+
+	if r.URL.HostPort != "mirror.lan:8080" || r.URL.Path != "/dist/a.tgz" {
+		t.Errorf("rewritten url %s", r.URL)
+	}
+	raw := string(r.rawRequest())
+	if !strings.HasPrefix(raw, "GET /dist/a.tgz HTTP/1.1\r\n") || !strings.HasSuffix(raw, "\r\n\r\n") {
+		t.Errorf("rewritten request %q", raw)
+	}
+	for _, h := range []string{"Host: mirror.lan:8080", "X-Test: 1", "Via: 1.1 test",
+		"X-Forwarded-For: 10.0.0.1, 127.0.0.1"} {
+		if !strings.Contains(raw, "\r\n"+h+"\r\n") {
+			t.Errorf("request should contain %q: %q", h, raw)
+		}
+	}
+	for _, h := range []string{"Cookie", "X-Hop", "X-Other"} {
+		if strings.Contains(raw, h+":") {
+			t.Errorf("request should not contain %s: %q", h, raw)
+		}
+	}
+
+	var rp Response
+	rp.reset()
+	defer rp.releaseBuf()
+	rp.raw.WriteString("HTTP/1.1 200 OK\r\nServer: nginx\r\nContent-Length: 0\r\n")
+	rewriteResponse(&r, &rp)
+	if s := rp.raw.String(); s != "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nServer: cow\r\nVia: 1.1 test\r\n" {
+		t.Errorf("rewritten response %q", s)
+	}
+}
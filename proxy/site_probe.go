@@ -0,0 +1,327 @@
+// Blocked site detection with active probing.
+//
+//	blockProbe = true   # probe temporarily blocked hosts directly, default true
+//
+// When a host is temporarily blocked, it's probed directly in the background
+// (DNS lookup, TCP connect, TLS handshake with server name or HTTP HEAD) to
+// find out how it's blocked:
+//
+//	dns     lookup returns bogus address, e.g. loopback or unspecified
+//	reset   connection or request is reset
+//	sni     TLS handshake with server name fails but succeeds without it
+//	timeout connect, handshake or request times out
+//
+// Probe results, together with errors and successful direct visits seen
+// while serving requests, update a per-host score of how likely the host is
+// blocked. The score decays over time. Hosts with a high score, and new hosts
+// in a domain with a blocked host of high score, try parent proxy first so
+// they don't wait for direct connection to time out.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type blockKind string
+
+const (
+	blockNone    blockKind = ""
+	blockDNS     blockKind = "dns"
+	blockReset   blockKind = "reset"
+	blockSNI     blockKind = "sni"
+	blockTimeout blockKind = "timeout"
+	blockOther   blockKind = "other"
+)
+
+const (
+	blockScoreHalfLife  = 30 * time.Minute
+	blockScoreThreshold = 0.5
+	blockScoreMin       = 0.01 // scores below this are dropped when pruning
+	blockScoreMaxHost   = 10000
+
+	blockProbeInterval = time.Minute // min interval between probes of a host
+	blockProbeTimeout  = 5 * time.Second
+	blockProbeMax      = 4 // max concurrent probes
+)
+
+// blockKindWeight is how much a new evidence counts in the score. Timeout may
+// be caused by bad network, so it's less reliable.
+var blockKindWeight = map[blockKind]float64{
+	blockNone:    0.6,
+	blockDNS:     0.8,
+	blockReset:   0.6,
+	blockSNI:     0.8,
+	blockTimeout: 0.3,
+	blockOther:   0.3,
+}
+
+type blockScore struct {
+	score   float64
+	kind    blockKind // last seen way of blocking
+	updated time.Time
+	probed  time.Time
+	probing bool
+}
+
+// value returns score decayed to now.
+func (bs *blockScore) value(now time.Time) float64 {
+	half := float64(now.Sub(bs.updated)) / float64(blockScoreHalfLife)
+	return bs.score * math.Exp2(-half)
+}
+
+func (bs *blockScore) update(kind blockKind, now time.Time) {
+	target := 1.0
+	if kind == blockNone {
+		target = 0
+	}
+	w := blockKindWeight[kind]
+	bs.score = bs.value(now)*(1-w) + target*w
+	bs.updated = now
+	if kind != blockNone {
+		bs.kind = kind
+	}
+}
+
+type blockDetector struct {
+	sync.Mutex
+	host   map[string]*blockScore
+	domain map[string]*blockScore // only updated by blocked evidence
+	probe  bool
+	sem    chan struct{}
+
+	probeFunc func(url *URL) blockKind
+}
+
+func newBlockDetector() *blockDetector {
+	return &blockDetector{
+		host:      map[string]*blockScore{},
+		domain:    map[string]*blockScore{},
+		sem:       make(chan struct{}, blockProbeMax),
+		probeFunc: probeSite,
+	}
+}
+
+var siteBlock = newBlockDetector()
+
+func initBlockDetect() {
+	siteBlock.probe = config.BlockProbe && !parentProxy.empty()
+}
+
+// classifyBlockErr tells the way of blocking from error of direct connection.
+func classifyBlockErr(err error) blockKind {
+	switch {
+	case isErrConnReset(err), err == io.EOF:
+		return blockReset
+	case isErrTimeout(err):
+		return blockTimeout
+	case isDNSError(err):
+		return blockDNS
+	}
+	return blockOther
+}
+
+// observe updates score of host with an evidence. blockNone means host is
+// visited directly.
+func (bd *blockDetector) observe(host string, kind blockKind) {
+	now := time.Now()
+	bd.Lock()
+	defer bd.Unlock()
+	bs := bd.host[host]
+	if bs == nil {
+		if kind == blockNone {
+			// Don't track all directly visited hosts.
+			return
+		}
+		if len(bd.host) >= blockScoreMaxHost {
+			bd.prune(now)
+		}
+		bs = &blockScore{updated: now}
+		bd.host[host] = bs
+	}
+	bs.update(kind, now)
+	if kind == blockNone {
+		return
+	}
+	domain := host2Domain(host)
+	ds := bd.domain[domain]
+	if ds == nil {
+		ds = &blockScore{updated: now}
+		bd.domain[domain] = ds
+	}
+	ds.update(kind, now)
+}
+
+// prune removes scores that have decayed. Caller should hold lock.
+func (bd *blockDetector) prune(now time.Time) {
+	for h, bs := range bd.host {
+		if !bs.probing && bs.value(now) < blockScoreMin {
+			delete(bd.host, h)
+		}
+	}
+	for d, ds := range bd.domain {
+		if ds.value(now) < blockScoreMin {
+			delete(bd.domain, d)
+		}
+	}
+}
+
+// score returns the current score and last seen way of blocking of host.
+func (bd *blockDetector) score(host string) (float64, blockKind) {
+	bd.Lock()
+	defer bd.Unlock()
+	if bs := bd.host[host]; bs != nil {
+		return bs.value(time.Now()), bs.kind
+	}
+	return 0, blockNone
+}
+
+// likelyBlocked returns true if parent proxy should be tried first though
+// visit count does not consider the site as blocked.
+func (bd *blockDetector) likelyBlocked(url *URL, vc *VisitCnt) bool {
+	if vc.userSpecified() || networkBad() {
+		return false
+	}
+	now := time.Now()
+	bd.Lock()
+	defer bd.Unlock()
+	if bs := bd.host[url.Host]; bs != nil {
+		return bs.value(now) >= blockScoreThreshold
+	}
+	if vc.Direct != 0 || vc.Blocked != 0 {
+		return false
+	}
+	// First visit to the host, use what's known about the domain.
+	if ds := bd.domain[url.Domain]; ds != nil {
+		return ds.value(now) >= blockScoreThreshold
+	}
+	return false
+}
+
+// schedule starts probing url in the background unless it's recently probed.
+func (bd *blockDetector) schedule(url *URL) {
+	if !bd.probe || networkBad() {
+		return
+	}
+	now := time.Now()
+	bd.Lock()
+	bs := bd.host[url.Host]
+	if bs == nil {
+		if len(bd.host) >= blockScoreMaxHost {
+			bd.prune(now)
+			if len(bd.host) >= blockScoreMaxHost {
+				bd.Unlock()
+				return
+			}
+		}
+		bs = &blockScore{updated: now}
+		bd.host[url.Host] = bs
+	}
+	if bs.probing || now.Sub(bs.probed) < blockProbeInterval {
+		bd.Unlock()
+		return
+	}
+	bs.probing = true
+	bd.Unlock()
+
+	u := *url
+	go func() {
+		bd.sem <- struct{}{}
+		kind := bd.probeFunc(&u)
+		<-bd.sem
+
+		debug.Printf("probe %s blocked: %q\n", u.HostPort, kind)
+		bd.Lock()
+		bs.probing = false
+		bs.probed = time.Now()
+		bd.Unlock()
+		if kind == blockTimeout && networkBad() {
+			return
+		}
+		bd.observe(u.Host, kind)
+	}()
+}
+
+// probeSite connects to url directly and returns how it's blocked.
+func probeSite(url *URL) blockKind {
+	addr := url.HostPort
+	if isIP, _ := hostIsIP(url.Host); !isIP {
+		ips, err := net.LookupIP(url.Host)
+		if err != nil {
+			if isErrTimeout(err) {
+				return blockTimeout
+			}
+			// Lookup failure, e.g. no such host for typo, is not a sign
+			// of blocking. Poisoned DNS returns bogus address instead.
+			return blockNone
+		}
+		for _, ip := range ips {
+			if isBogusIP(ip) {
+				return blockDNS
+			}
+		}
+		addr = net.JoinHostPort(ips[0].String(), url.Port)
+	}
+
+	c, err := net.DialTimeout("tcp", addr, blockProbeTimeout)
+	if err != nil {
+		return classifyBlockErr(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(blockProbeTimeout))
+
+	switch url.Port {
+	case "443":
+		tc := tls.Client(c, &tls.Config{ServerName: url.Host, InsecureSkipVerify: true})
+		if err = tc.Handshake(); err != nil {
+			kind := classifyBlockErr(err)
+			if probeTLSNoSNI(addr) {
+				return blockSNI
+			}
+			return kind
+		}
+		return probeHEAD(tc, url.Host)
+	case "80":
+		return probeHEAD(c, url.Host)
+	}
+	return blockNone
+}
+
+// isBogusIP returns true for address that public host never resolves to.
+func isBogusIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast()
+}
+
+// probeTLSNoSNI returns true if TLS handshake without server name succeeds.
+func probeTLSNoSNI(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, blockProbeTimeout)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(blockProbeTimeout))
+	return tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake() == nil
+}
+
+func probeHEAD(c net.Conn, host string) blockKind {
+	req := "HEAD / HTTP/1.1\r\nHost: " + host + "\r\nConnection: close\r\n\r\n"
+	if _, err := c.Write([]byte(req)); err != nil {
+		return classifyBlockErr(err)
+	}
+	buf := make([]byte, 64)
+	n, err := io.ReadAtLeast(c, buf, len("HTTP/"))
+	if err != nil && n == 0 {
+		return classifyBlockErr(err)
+	}
+	if !strings.HasPrefix(string(buf[:n]), "HTTP/") {
+		debug.Printf("probe %s got non HTTP response\n", host)
+	}
+	return blockNone
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlockScore(t *testing.T) {
+	now := time.Now()
+	bs := &blockScore{updated: now}
+	bs.update(blockReset, now)
+	if v := bs.value(now); v < blockScoreThreshold {
+		t.Errorf("score after reset %f should exceed threshold", v)
+	}
+	if bs.kind != blockReset {
+		t.Errorf("kind should be reset, got %q", bs.kind)
+	}
+	if v := bs.value(now.Add(blockScoreHalfLife)); v > bs.score/2+0.001 {
+		t.Errorf("score should halve after half life, got %f", v)
+	}
+
+	bs.update(blockNone, now)
+	if v := bs.value(now); v >= blockScoreThreshold {
+		t.Errorf("score after direct visit %f should be below threshold", v)
+	}
+	if bs.kind != blockReset {
+		t.Error("direct visit should keep kind of blocking")
+	}
+
+	// A single timeout is not enough to consider site as blocked.
+	ts := &blockScore{updated: now}
+	ts.update(blockTimeout, now)
+	if ts.value(now) >= blockScoreThreshold {
+		t.Error("single timeout should not exceed threshold")
+	}
+}
+
+func TestBlockDetectorLikelyBlocked(t *testing.T) {
+	bd := newBlockDetector()
+	blocked, _ := ParseRequestURI("www.blocked.com")
+	other, _ := ParseRequestURI("img.blocked.com")
+	visited, _ := ParseRequestURI("api.blocked.com")
+
+	bd.observe(blocked.Host, blockSNI)
+	if !bd.likelyBlocked(blocked, newVisitCnt(0, 0)) {
+		t.Error("host with sni blocking should be likely blocked")
+	}
+	if !bd.likelyBlocked(other, newVisitCnt(0, 0)) {
+		t.Error("new host in blocked domain should be likely blocked")
+	}
+	if bd.likelyBlocked(visited, newVisitCnt(3, 0)) {
+		t.Error("host with visit history should not use domain score")
+	}
+	if bd.likelyBlocked(blocked, newVisitCnt(userCnt, 0)) {
+		t.Error("user specified direct host should never be likely blocked")
+	}
+
+	bd.observe(blocked.Host, blockNone)
+	if bd.likelyBlocked(blocked, newVisitCnt(1, 0)) {
+		t.Error("directly visited host should not be likely blocked")
+	}
+
+	bd.observe("www.direct.com", blockNone)
+	if _, ok := bd.host["www.direct.com"]; ok {
+		t.Error("directly visited host without blocking should not be tracked")
+	}
+}
+
+func TestBlockDetectorSchedule(t *testing.T) {
+	bd := newBlockDetector()
+	bd.probe = true
+	done := make(chan string, 2)
+	bd.probeFunc = func(url *URL) blockKind {
+		done <- url.Host
+		return blockDNS
+	}
+	u, _ := ParseRequestURI("www.poisoned.com")
+	bd.schedule(u)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("site not probed")
+	}
+	for i := 0; i < 100; i++ {
+		if score, kind := bd.score(u.Host); kind == blockDNS && score > blockScoreThreshold {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, kind := bd.score(u.Host); kind != blockDNS {
+		t.Errorf("probe result not recorded, got %q", kind)
+	}
+
+	bd.schedule(u)
+	select {
+	case <-done:
+		t.Error("recently probed site should not be probed again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBlockDetectorScheduleFull(t *testing.T) {
+	bd := newBlockDetector()
+	bd.probe = true
+	bd.probeFunc = func(url *URL) blockKind { return blockNone }
+	old := time.Now().Add(-100 * blockScoreHalfLife)
+	for i := 0; i < blockScoreMaxHost; i++ {
+		bd.host[fmt.Sprintf("www%d.example.com", i)] = &blockScore{score: 1, updated: old}
+	}
+	u, _ := ParseRequestURI("www.new.com")
+	bd.schedule(u)
+	bd.Lock()
+	n := len(bd.host)
+	bd.Unlock()
+	if n != 1 {
+		t.Errorf("decayed hosts should be pruned before adding probed host, got %d hosts", n)
+	}
+}
+
+func TestBogusIP(t *testing.T) {
+	for _, s := range []string{"127.0.0.1", "0.0.0.0", "::1", "169.254.1.1", "224.0.0.1"} {
+		if !isBogusIP(net.ParseIP(s)) {
+			t.Errorf("%s should be bogus", s)
+		}
+	}
+	for _, s := range []string{"8.8.8.8", "10.0.0.1", "2001:db8::1"} {
+		if isBogusIP(net.ParseIP(s)) {
+			t.Errorf("%s should not be bogus", s)
+		}
+	}
+}
+
+func TestProbeSite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	reset := make(chan bool, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			c.Read(buf)
+			if <-reset {
+				c.(*net.TCPConn).SetLinger(0)
+			} else {
+				c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			}
+			c.Close()
+		}
+	}()
+
+	var u URL
+	u.ParseHostPort(ln.Addr().String())
+	u.Port = "80" // probe with HTTP HEAD
+
+	reset <- false
+	if kind := probeSite(&u); kind != blockNone {
+		t.Errorf("reachable site probed as %q", kind)
+	}
+	reset <- true
+	if kind := probeSite(&u); kind != blockReset {
+		t.Errorf("reset site probed as %q", kind)
+	}
+}
@@ -60,14 +60,15 @@ type VisitCnt struct {
 	Recent    Date      `json:"recent"`
 	rUpdated  bool      // whether Recent is updated, we only need date precision
 	blockedOn time.Time // when is the site last blocked
+	host      string    // key in SiteStat.Vcnt, used to record history
 }
 
 func newVisitCnt(direct, blocked vcntint) *VisitCnt {
-	return &VisitCnt{direct, blocked, Date(time.Now()), true, zeroTime}
+	return &VisitCnt{direct, blocked, Date(time.Now()), true, zeroTime, ""}
 }
 
 func newVisitCntWithTime(direct, blocked vcntint, t time.Time) *VisitCnt {
-	return &VisitCnt{direct, blocked, Date(t), true, zeroTime}
+	return &VisitCnt{direct, blocked, Date(t), true, zeroTime, ""}
 }
 
 func (vc *VisitCnt) userSpecified() bool {
@@ -149,10 +150,16 @@ func (vc *VisitCnt) DirectVisit() {
 	if networkBad() || vc.userSpecified() {
 		return
 	}
+	// Only record when the site changes from blocked to direct, or on the
+	// first visit, so history does not grow with every visit.
+	if vc.Blocked > 0 || vc.Direct == 0 {
+		recordSiteEvent(vc.host, siteEvDirect)
+	}
 	// one successful direct visit probably means the site is not actually
 	// blocked
 	vc.visit(&vc.Direct)
 	vc.Blocked = 0
+	siteBlock.observe(vc.host, blockNone)
 }
 
 func (vc *VisitCnt) BlockedVisit() {
@@ -163,6 +170,9 @@ func (vc *VisitCnt) BlockedVisit() {
 	// this quickly and remove it from the PAC ASAP. So change direct to 0
 	// once there's a single blocked visit, this ensures the site is removed
 	// upon the next PAC update.
+	if vc.Direct > 0 || vc.Blocked == 0 {
+		recordSiteEvent(vc.host, siteEvBlocked)
+	}
 	vc.visit(&vc.Blocked)
 	vc.Direct = 0
 }
@@ -197,6 +207,7 @@ func (ss *SiteStat) get(s string) *VisitCnt {
 
 func (ss *SiteStat) create(s string) (vcnt *VisitCnt) {
 	vcnt = newVisitCnt(0, 0)
+	vcnt.host = s
 	ss.vcLock.Lock()
 	ss.Vcnt[s] = vcnt
 	ss.vcLock.Unlock()
@@ -212,7 +223,11 @@ func (ss *SiteStat) TempBlocked(url *URL) {
 	if vcnt == nil {
 		panic("TempBlocked should always get existing visitCnt")
 	}
+	if !vcnt.AsTempBlocked() {
+		recordSiteEvent(url.Host, siteEvTempBlocked)
+	}
 	vcnt.tempBlocked()
+	siteBlock.schedule(url)
 
 	// Mistakenly consider a partial blocked domain as direct will make that
 	// domain into PAC and never have a chance to correct the error.
@@ -373,6 +388,7 @@ func (ss *SiteStat) load(file string) (err error) {
 		ss.loadUserList()
 		ss.filterSites()
 		for host, vcnt := range ss.Vcnt {
+			vcnt.host = host
 			if vcnt.OnceBlocked() {
 				ss.hasBlockedHost[host2Domain(host)] = true
 			}
@@ -421,21 +437,25 @@ func (ss *SiteStat) GetDirectList() []string {
 	return lst
 }
 
+// GetBlockedList returns sites that are not visited directly.
+func (ss *SiteStat) GetBlockedList() []string {
+	lst := make([]string, 0)
+	ss.vcLock.RLock()
+	for site, vc := range ss.Vcnt {
+		if !vc.AsDirect() {
+			lst = append(lst, site)
+		}
+	}
+	ss.vcLock.RUnlock()
+	return lst
+}
+
 var siteStat = newSiteStat()
 
 func initSiteStat() {
-	err := siteStat.load(config.StatFile)
-	if err != nil {
-		// Simply try to load the stat.back, create a new object to avoid error
-		// in default site list.
-		siteStat = newSiteStat()
-		err = siteStat.load(config.StatFile + ".bak")
-		// After all its not critical , simply re-create a stat object if anything is not ok
-		if err != nil {
-			siteStat = newSiteStat()
-			siteStat.load("") // load default site list
-		}
-	}
+	statStore = newSiteStatStore(config.StatBackend, config.StatFile)
+	siteStat = statStore.load()
+	initSiteSync()
 
 	// Dump site stat while running, so we don't always need to close cow to
 	// get updated stat.
@@ -464,12 +484,28 @@ func storeSiteStat(cont byte) {
 	if siteStatFini {
 		return
 	}
-	siteStat.store(config.StatFile)
+	statStore.store(siteStat)
 	if cont == siteStatExit {
+		siteSync.close()
+		statStore.close()
 		siteStatFini = true
 	}
 }
 
+// releaseSiteStat closes stat store without storing, after the new process
+// started on upgrade has loaded stat files.
+func releaseSiteStat() {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if siteStatFini {
+		return
+	}
+	siteSync.close()
+	statStore.close()
+	siteStatFini = true
+}
+
 func loadSiteList(fpath string) (lst []string, err error) {
 	if fpath == "" {
 		return
@@ -0,0 +1,364 @@
+// Pluggable storage for site stat.
+//
+// The json store is the original stat file. The log store saves the same stat
+// file and additionally appends visit events to an append-only log, so the
+// history of a site changing between direct and blocked is kept even after
+// the site is pruned from the stat file.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyfdecyf/bufio"
+)
+
+const (
+	statBackendJSON = "json"
+	statBackendLog  = "log"
+
+	defaultStatHistoryAge = 90 * 24 * time.Hour
+	statLogSuffix         = ".log"
+)
+
+type siteEventType string
+
+const (
+	siteEvDirect      siteEventType = "direct"
+	siteEvBlocked     siteEventType = "blocked"
+	siteEvTempBlocked siteEventType = "temp_blocked"
+)
+
+func parseSiteEventType(s string) (siteEventType, error) {
+	switch ev := siteEventType(s); ev {
+	case siteEvDirect, siteEvBlocked, siteEvTempBlocked:
+		return ev, nil
+	}
+	return "", fmt.Errorf("invalid site event %q, should be direct, blocked or temp_blocked", s)
+}
+
+// siteEvent records a change of site status. Direct and blocked events are
+// only recorded when the site changes status (or on the first visit), so a
+// blocked event means the site became blocked at that time.
+type siteEvent struct {
+	Time  time.Time     `json:"time"`
+	Host  string        `json:"host"`
+	Event siteEventType `json:"event"`
+}
+
+var errNoStatHistory = errors.New("stat backend has no history, set statBackend = log")
+
+type siteStatStore interface {
+	// load returns site stat loaded from store, never returns nil.
+	load() *SiteStat
+	store(ss *SiteStat) error
+	// record should not block as it's called while serving requests.
+	record(host string, ev siteEventType)
+	history(since time.Time) ([]siteEvent, error)
+	close() error
+}
+
+var statStore siteStatStore = jsonStatStore{}
+
+func newSiteStatStore(backend, statPath string) siteStatStore {
+	switch backend {
+	case "", statBackendJSON:
+		return jsonStatStore{statPath}
+	case statBackendLog:
+		ls, err := newLogStatStore(statPath)
+		if err != nil {
+			errl.Println("open stat log, fallback to json stat:", err)
+			return jsonStatStore{statPath}
+		}
+		return ls
+	}
+	panic("unknown stat backend " + backend)
+}
+
+type jsonStatStore struct {
+	path string
+}
+
+func (js jsonStatStore) load() *SiteStat {
+	ss := newSiteStat()
+	if err := ss.load(js.path); err != nil {
+		// Simply try to load the stat.back, create a new object to avoid error
+		// in default site list.
+		ss = newSiteStat()
+		// After all its not critical , simply re-create a stat object if anything is not ok
+		if err = ss.load(js.path + ".bak"); err != nil {
+			ss = newSiteStat()
+			ss.load("") // load default site list
+		}
+	}
+	return ss
+}
+
+func (js jsonStatStore) store(ss *SiteStat) error {
+	if js.path == "" {
+		return nil
+	}
+	return ss.store(js.path)
+}
+
+func (js jsonStatStore) record(host string, ev siteEventType) {}
+
+func (js jsonStatStore) history(since time.Time) ([]siteEvent, error) {
+	return nil, errNoStatHistory
+}
+
+func (js jsonStatStore) close() error {
+	return nil
+}
+
+type logStatStore struct {
+	jsonStatStore
+	logPath string
+	f       *os.File
+	evCh    chan siteEvent
+	done    chan struct{}
+
+	// Held for reading when sending to evCh, so close won't close evCh
+	// while sending.
+	closeLock sync.RWMutex
+	closed    bool
+}
+
+func newLogStatStore(statPath string) (*logStatStore, error) {
+	ls := &logStatStore{
+		jsonStatStore: jsonStatStore{statPath},
+		logPath:       statPath + statLogSuffix,
+		evCh:          make(chan siteEvent, 256),
+		done:          make(chan struct{}),
+	}
+	if err := ls.compact(time.Now().Add(-config.StatHistoryAge)); err != nil {
+		errl.Println("compact stat log:", err)
+	}
+	f, err := os.OpenFile(ls.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ls.f = f
+	go ls.writeEvents()
+	return ls, nil
+}
+
+func (ls *logStatStore) record(host string, ev siteEventType) {
+	if host == "" {
+		return
+	}
+	ls.closeLock.RLock()
+	defer ls.closeLock.RUnlock()
+	if ls.closed {
+		return
+	}
+	select {
+	case ls.evCh <- siteEvent{time.Now(), host, ev}:
+	default:
+		debug.Println("stat log busy, drop event", host, ev)
+	}
+}
+
+func (ls *logStatStore) writeEvents() {
+	defer close(ls.done)
+	enc := json.NewEncoder(ls.f)
+	for ev := range ls.evCh {
+		if err := enc.Encode(&ev); err != nil {
+			errl.Println("write stat log:", err)
+		}
+	}
+}
+
+func (ls *logStatStore) store(ss *SiteStat) error {
+	if err := ls.jsonStatStore.store(ss); err != nil {
+		return err
+	}
+	return ls.f.Sync()
+}
+
+func (ls *logStatStore) close() error {
+	ls.closeLock.Lock()
+	if ls.closed {
+		ls.closeLock.Unlock()
+		return nil
+	}
+	ls.closed = true
+	close(ls.evCh)
+	ls.closeLock.Unlock()
+	<-ls.done
+	return ls.f.Close()
+}
+
+func (ls *logStatStore) history(since time.Time) ([]siteEvent, error) {
+	return readSiteEvents(ls.logPath, since)
+}
+
+// compact removes events before the given time. Use temp file and rename to
+// avoid damaging the log. Temp file is created in the same directory as log
+// file, as rename can't cross file systems.
+func (ls *logStatStore) compact(before time.Time) error {
+	evs, err := readSiteEvents(ls.logPath, before)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(ls.logPath), "statlog")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range evs {
+		enc.Encode(&evs[i])
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	f.Close()
+	if err = os.Rename(f.Name(), ls.logPath); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// readSiteEvents reads events in the log file happened no earlier than
+// since. Malformed lines (e.g. partially written on crash) are skipped.
+func readSiteEvents(logPath string, since time.Time) ([]siteEvent, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var evs []siteEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ev siteEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			debug.Println("skip malformed stat log line:", err)
+			continue
+		}
+		if ev.Time.Before(since) {
+			continue
+		}
+		evs = append(evs, ev)
+	}
+	return evs, scanner.Err()
+}
+
+// filterSiteEvents returns events with the given type and host, empty value
+// matches all.
+func filterSiteEvents(evs []siteEvent, ev siteEventType, host string) []siteEvent {
+	var res []siteEvent
+	for _, e := range evs {
+		if ev != "" && e.Event != ev {
+			continue
+		}
+		if host != "" && e.Host != host && host2Domain(e.Host) != host {
+			continue
+		}
+		res = append(res, e)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Time.Before(res[j].Time) })
+	return res
+}
+
+const (
+	exportText = "text"
+	exportCSV  = "csv"
+	exportJSON = "json"
+)
+
+func exportSiteEvents(w io.Writer, evs []siteEvent, format string) error {
+	switch format {
+	case "", exportText:
+		for _, e := range evs {
+			if _, err := fmt.Fprintf(w, "%s\t%-12s\t%s\n",
+				e.Time.Format(time.RFC3339), e.Event, e.Host); err != nil {
+				return err
+			}
+		}
+		return nil
+	case exportCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "host", "event"})
+		for _, e := range evs {
+			cw.Write([]string{e.Time.Format(time.RFC3339), e.Host, string(e.Event)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case exportJSON:
+		if evs == nil {
+			evs = []siteEvent{}
+		}
+		b, err := json.MarshalIndent(evs, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	return fmt.Errorf("unknown export format %q, should be text, csv or json", format)
+}
+
+// StatQuery specifies which site events to export.
+type StatQuery struct {
+	RcFile string
+	Since  time.Duration // only events within this duration
+	Event  string        // direct, blocked or temp_blocked, empty for all
+	Host   string        // host or domain, empty for all
+	Format string        // text, csv or json
+}
+
+// QuerySiteStat loads the config file and exports site events recorded by
+// the log stat backend. For example, sites became blocked in the last week:
+// Since = 7 * 24 * time.Hour, Event = "blocked".
+func QuerySiteStat(q StatQuery, w io.Writer) error {
+	var ev siteEventType
+	if q.Event != "" {
+		var err error
+		if ev, err = parseSiteEventType(q.Event); err != nil {
+			return err
+		}
+	}
+	rc := q.RcFile
+	if rc == "" {
+		rc = getDefaultRcFile()
+	} else {
+		rc = expandTilde(rc)
+	}
+	if err := isFileExists(rc); err != nil {
+		return err
+	}
+	initConfig(rc)
+	parseConfig(rc, &Config{RcFile: rc})
+
+	if config.StatBackend != statBackendLog {
+		return errNoStatHistory
+	}
+	evs, err := readSiteEvents(config.StatFile+statLogSuffix, time.Now().Add(-q.Since))
+	if err != nil {
+		return err
+	}
+	return exportSiteEvents(w, filterSiteEvents(evs, ev, q.Host), q.Format)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogStatStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir := config.dir
+	config.dir = path.Join(dir, "config")
+	os.Mkdir(config.dir, 0700)
+	defer func() {
+		config.dir = oldDir
+	}()
+	config.StatHistoryAge = defaultStatHistoryAge
+
+	// Old events should be removed when opening the log. Stat file may be in
+	// other directory than config.
+	statPath := path.Join(dir, "stat")
+	old := siteEvent{time.Now().Add(-2 * defaultStatHistoryAge), "old.com", siteEvBlocked}
+	b, _ := json.Marshal(&old)
+	ioutil.WriteFile(statPath+statLogSuffix, append(b, '\n'), 0600)
+
+	ls, err := newLogStatStore(statPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statStore = ls
+	defer func() {
+		statStore = jsonStatStore{}
+	}()
+
+	ss := newSiteStat()
+	u, _ := ParseRequestURI("www.flip.com")
+	vc := ss.create(u.Host)
+	vc.DirectVisit()
+	vc.DirectVisit() // not recorded, no status change
+	ss.TempBlocked(u)
+	ss.TempBlocked(u) // not recorded, already temp blocked
+	vc.BlockedVisit()
+	vc.BlockedVisit()
+
+	if err = ls.store(ss); err != nil {
+		t.Fatal(err)
+	}
+	if err = ls.close(); err != nil {
+		t.Fatal(err)
+	}
+	// Events after close are dropped, e.g. from connections still draining.
+	ls.record(u.Host, siteEvDirect)
+
+	evs, err := ls.history(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []siteEventType{siteEvDirect, siteEvTempBlocked, siteEvBlocked}
+	if len(evs) != len(want) {
+		t.Fatalf("should have %d events, got %v\n", len(want), evs)
+	}
+	for i, ev := range evs {
+		if ev.Event != want[i] || ev.Host != u.Host {
+			t.Errorf("event %d should be %s %s, got %v\n", i, u.Host, want[i], ev)
+		}
+	}
+
+	if files, _ := ioutil.ReadDir(config.dir); len(files) != 0 {
+		t.Error("log should be compacted in stat dir, not config dir")
+	}
+	all, _ := readSiteEvents(statPath+statLogSuffix, time.Time{})
+	for _, ev := range all {
+		if ev.Host == old.Host {
+			t.Error("event older than statHistoryAge should be compacted")
+		}
+	}
+
+	blocked := filterSiteEvents(evs, siteEvBlocked, "flip.com")
+	if len(blocked) != 1 {
+		t.Errorf("should find 1 blocked event by domain, got %v\n", blocked)
+	}
+	var buf bytes.Buffer
+	if err = exportSiteEvents(&buf, blocked, exportCSV); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], ",www.flip.com,blocked") {
+		t.Errorf("csv export wrong:\n%s", buf.String())
+	}
+}
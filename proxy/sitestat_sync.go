@@ -0,0 +1,448 @@
+// Share site stat among a fleet of proxies.
+//
+// Each node publishes site status changes (direct, blocked, temp blocked) to
+// a key value store with TTL, and merges changes published by other nodes
+// into its own site stat. User specified direct and blocked domains can also
+// be managed centrally in the store.
+//
+// Key layout under the prefix:
+//
+//	event/<host>     {"node": ..., "event": ...}, expires after TTL
+//	direct/<domain>  always direct domain, value ignored
+//	blocked/<domain> always blocked domain, value ignored
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	defaultSiteSyncPrefix = "/xagent/sitestat/"
+	defaultSiteSyncTTL    = 24 * time.Hour
+
+	siteSyncEventDir   = "event/"
+	siteSyncDirectDir  = "direct/"
+	siteSyncBlockedDir = "blocked/"
+
+	siteSyncTimeout = 5 * time.Second
+)
+
+type siteStatSyncer interface {
+	// publish should not block as it's called while serving requests.
+	publish(host string, ev siteEventType)
+	close() error
+}
+
+type noSiteSync struct{}
+
+func (noSiteSync) publish(host string, ev siteEventType) {}
+func (noSiteSync) close() error                          { return nil }
+
+var siteSync siteStatSyncer = noSiteSync{}
+
+// recordSiteEvent saves site status change to history and shares it with
+// other nodes.
+func recordSiteEvent(host string, ev siteEventType) {
+	statStore.record(host, ev)
+	siteSync.publish(host, ev)
+}
+
+func initSiteSync() {
+	if config.SiteSync == "" {
+		return
+	}
+	kv, err := newSyncKV(config.SiteSync)
+	if err != nil {
+		errl.Println("site stat sync disabled:", err)
+		return
+	}
+	siteSync = newSiteStatSync(kv, siteStat, config.SiteSyncPrefix, config.SiteSyncNode)
+	info.Println("site stat sync with", config.SiteSync)
+}
+
+func defaultSiteSyncNode() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// syncKVEvent is a change of key in the store.
+type syncKVEvent struct {
+	key     string
+	val     []byte
+	deleted bool
+}
+
+// syncKV is the key value store used to share site stat. Keys passed to and
+// returned from it are full keys.
+type syncKV interface {
+	put(key string, val []byte, ttl time.Duration) error
+	list(prefix string) (map[string][]byte, error)
+	// watch sends changes of keys with the prefix until close is called.
+	watch(prefix string) <-chan syncKVEvent
+	close() error
+}
+
+func newSyncKV(addr string) (syncKV, error) {
+	if strings.HasPrefix(addr, "etcd://") {
+		return newEtcdKV(strings.Split(addr[len("etcd://"):], ","))
+	}
+	return nil, fmt.Errorf("unsupported site stat sync store %s", addr)
+}
+
+type siteSyncValue struct {
+	Node  string        `json:"node"`
+	Event siteEventType `json:"event"`
+}
+
+type siteStatSync struct {
+	kv     syncKV
+	ss     *SiteStat
+	prefix string
+	node   string
+	evCh   chan siteEvent
+	done   chan struct{}
+
+	// Held for reading when sending to evCh, so close won't close evCh
+	// while sending.
+	closeLock sync.RWMutex
+	closed    bool
+}
+
+func newSiteStatSync(kv syncKV, ss *SiteStat, prefix, node string) *siteStatSync {
+	s := &siteStatSync{
+		kv:     kv,
+		ss:     ss,
+		prefix: prefix,
+		node:   node,
+		evCh:   make(chan siteEvent, 256),
+		done:   make(chan struct{}),
+	}
+	// Start watching before listing existing keys to avoid missing updates in
+	// between. Merging the same value twice is harmless.
+	wch := kv.watch(prefix)
+	if kvs, err := kv.list(prefix); err != nil {
+		errl.Println("site stat sync list:", err)
+	} else {
+		for k, v := range kvs {
+			s.apply(syncKVEvent{key: k, val: v})
+		}
+	}
+	go s.publishEvents()
+	go func() {
+		for ev := range wch {
+			s.apply(ev)
+		}
+	}()
+	return s
+}
+
+func (s *siteStatSync) publish(host string, ev siteEventType) {
+	if host == "" {
+		return
+	}
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.evCh <- siteEvent{time.Now(), host, ev}:
+	default:
+		debug.Println("site stat sync busy, drop event", host, ev)
+	}
+}
+
+func (s *siteStatSync) publishEvents() {
+	defer close(s.done)
+	for ev := range s.evCh {
+		ttl := config.SiteSyncTTL
+		if ev.Event == siteEvTempBlocked {
+			ttl = tmpBlockedTimeout
+		}
+		val, _ := json.Marshal(siteSyncValue{s.node, ev.Event})
+		if err := s.kv.put(s.prefix+siteSyncEventDir+ev.Host, val, ttl); err != nil {
+			errl.Printf("site stat sync publish %s %s: %v\n", ev.Host, ev.Event, err)
+		}
+	}
+}
+
+func (s *siteStatSync) close() error {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.evCh)
+	s.closeLock.Unlock()
+	<-s.done
+	return s.kv.close()
+}
+
+func (s *siteStatSync) apply(ev syncKVEvent) {
+	key := strings.TrimPrefix(ev.key, s.prefix)
+	switch {
+	case strings.HasPrefix(key, siteSyncEventDir):
+		if ev.deleted {
+			// Expired event, local visits will decide the site status.
+			return
+		}
+		var v siteSyncValue
+		if err := json.Unmarshal(ev.val, &v); err != nil {
+			debug.Printf("site stat sync malformed event %s: %v\n", ev.key, err)
+			return
+		}
+		if v.Node == s.node {
+			return
+		}
+		s.ss.mergeRemote(key[len(siteSyncEventDir):], v.Event)
+	case strings.HasPrefix(key, siteSyncDirectDir):
+		s.ss.setUserSite(key[len(siteSyncDirectDir):], userCnt, 0, ev.deleted)
+	case strings.HasPrefix(key, siteSyncBlockedDir):
+		s.ss.setUserSite(key[len(siteSyncBlockedDir):], 0, userCnt, ev.deleted)
+	}
+}
+
+// mergeRemote updates site stat with status discovered by other nodes. The
+// visit count is set just enough to make the site direct or blocked, so
+// local visits can quickly correct it.
+func (ss *SiteStat) mergeRemote(host string, ev siteEventType) {
+	domain := host2Domain(host)
+	if domain != host {
+		if dmcnt := ss.get(domain); dmcnt != nil && dmcnt.userSpecified() {
+			return
+		}
+	}
+	vcnt := ss.get(host)
+	if vcnt == nil {
+		vcnt = ss.create(host)
+	}
+	if vcnt.userSpecified() {
+		return
+	}
+	debug.Printf("site stat sync: %s %s\n", host, ev)
+	switch ev {
+	case siteEvDirect:
+		if vcnt.Direct < directDelta {
+			vcnt.Direct = directDelta
+		}
+		vcnt.Blocked = 0
+		return
+	case siteEvBlocked:
+		if vcnt.Blocked < blockedDelta {
+			vcnt.Blocked = blockedDelta
+		}
+		vcnt.Direct = 0
+	case siteEvTempBlocked:
+		vcnt.tempBlocked()
+	default:
+		return
+	}
+	ss.hbhLock.Lock()
+	ss.hasBlockedHost[domain] = true
+	ss.hbhLock.Unlock()
+}
+
+// setUserSite adds or removes centrally managed user specified domain. Hosts
+// learned under the domain are removed as filterSites does when loading, so
+// the domain takes effect for them.
+func (ss *SiteStat) setUserSite(domain string, direct, blocked vcntint, deleted bool) {
+	if domain == "" {
+		return
+	}
+	ss.vcLock.Lock()
+	defer ss.vcLock.Unlock()
+	if deleted {
+		if vcnt, ok := ss.Vcnt[domain]; ok && vcnt.Direct == direct && vcnt.Blocked == blocked {
+			delete(ss.Vcnt, domain)
+		}
+		return
+	}
+	for site, vcnt := range ss.Vcnt {
+		if site != domain && !vcnt.userSpecified() && host2Domain(site) == domain {
+			delete(ss.Vcnt, site)
+		}
+	}
+	vcnt := newVisitCntWithTime(direct, blocked, zeroTime)
+	vcnt.host = domain
+	ss.Vcnt[domain] = vcnt
+	if blocked > 0 {
+		ss.hbhLock.Lock()
+		ss.hasBlockedHost[domain] = true
+		ss.hbhLock.Unlock()
+	}
+}
+
+type etcdKV struct {
+	cli    *clientv3.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newEtcdKV(endpoints []string) (*etcdKV, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: siteSyncTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdKV{cli, ctx, cancel}, nil
+}
+
+func (e *etcdKV) put(key string, val []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(e.ctx, siteSyncTimeout)
+	defer cancel()
+	lease, err := e.cli.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return err
+	}
+	_, err = e.cli.Put(ctx, key, string(val), clientv3.WithLease(lease.ID))
+	return err
+}
+
+func (e *etcdKV) list(prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, siteSyncTimeout)
+	defer cancel()
+	resp, err := e.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+	return kvs, nil
+}
+
+func (e *etcdKV) watch(prefix string) <-chan syncKVEvent {
+	ch := make(chan syncKVEvent, 64)
+	go func() {
+		defer close(ch)
+		for {
+			for resp := range e.cli.Watch(e.ctx, prefix, clientv3.WithPrefix()) {
+				if err := resp.Err(); err != nil {
+					errl.Println("site stat sync watch:", err)
+					break
+				}
+				for _, ev := range resp.Events {
+					ch <- syncKVEvent{
+						key:     string(ev.Kv.Key),
+						val:     ev.Kv.Value,
+						deleted: ev.Type == clientv3.EventTypeDelete,
+					}
+				}
+			}
+			if e.ctx.Err() != nil {
+				return
+			}
+			// Watch channel closed on error, retry later.
+			time.Sleep(siteSyncTimeout)
+		}
+	}()
+	return ch
+}
+
+func (e *etcdKV) close() error {
+	e.cancel()
+	return e.cli.Close()
+}
+
+// memKV is an in process stand-in for etcd. Syncers sharing the same memKV
+// see each other's updates, which is useful for testing.
+type memKV struct {
+	sync.Mutex
+	kvs      map[string][]byte
+	expire   map[string]*time.Timer
+	watchers []*memWatcher
+}
+
+type memWatcher struct {
+	prefix string
+	ch     chan syncKVEvent
+}
+
+func newMemKV() *memKV {
+	return &memKV{
+		kvs:    make(map[string][]byte),
+		expire: make(map[string]*time.Timer),
+	}
+}
+
+func (m *memKV) notify(ev syncKVEvent) {
+	for _, w := range m.watchers {
+		if strings.HasPrefix(ev.key, w.prefix) {
+			w.ch <- ev
+		}
+	}
+}
+
+func (m *memKV) put(key string, val []byte, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	m.kvs[key] = val
+	if t, ok := m.expire[key]; ok {
+		t.Stop()
+		delete(m.expire, key)
+	}
+	if ttl > 0 {
+		m.expire[key] = time.AfterFunc(ttl, func() { m.delete(key) })
+	}
+	m.notify(syncKVEvent{key: key, val: val})
+	return nil
+}
+
+func (m *memKV) delete(key string) {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.kvs[key]; !ok {
+		return
+	}
+	delete(m.kvs, key)
+	delete(m.expire, key)
+	m.notify(syncKVEvent{key: key, deleted: true})
+}
+
+func (m *memKV) list(prefix string) (map[string][]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	kvs := make(map[string][]byte)
+	for k, v := range m.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs[k] = v
+		}
+	}
+	return kvs, nil
+}
+
+func (m *memKV) watch(prefix string) <-chan syncKVEvent {
+	m.Lock()
+	defer m.Unlock()
+	w := &memWatcher{prefix, make(chan syncKVEvent, 256)}
+	m.watchers = append(m.watchers, w)
+	return w.ch
+}
+
+func (m *memKV) close() error {
+	m.Lock()
+	defer m.Unlock()
+	for _, w := range m.watchers {
+		close(w.ch)
+	}
+	m.watchers = nil
+	for k, t := range m.expire {
+		t.Stop()
+		delete(m.expire, k)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func waitSiteStat(t *testing.T, msg string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error(msg)
+}
+
+func TestSiteStatSync(t *testing.T) {
+	config.SiteSyncTTL = time.Minute
+	kv := newMemKV()
+	defer kv.close()
+
+	ss1, ss2 := newSiteStat(), newSiteStat()
+	s1 := newSiteStatSync(kv, ss1, defaultSiteSyncPrefix, "node1")
+	s2 := newSiteStatSync(kv, ss2, defaultSiteSyncPrefix, "node2")
+
+	s1.publish("www.example.com", siteEvBlocked)
+	waitSiteStat(t, "blocked site should be merged by other node", func() bool {
+		vc := ss2.get("www.example.com")
+		return vc != nil && vc.Blocked >= blockedDelta && vc.Direct == 0
+	})
+	if ss1.get("www.example.com") != nil {
+		t.Error("node should ignore its own event")
+	}
+	ss2.hbhLock.RLock()
+	hbh := ss2.hasBlockedHost["example.com"]
+	ss2.hbhLock.RUnlock()
+	if !hbh {
+		t.Error("merged blocked site should mark domain has blocked host")
+	}
+
+	s2.publish("www.example.com", siteEvDirect)
+	waitSiteStat(t, "direct site should be merged by other node", func() bool {
+		vc := ss1.get("www.example.com")
+		return vc != nil && vc.AsDirect()
+	})
+
+	s1.publish("tmp.example.org", siteEvTempBlocked)
+	waitSiteStat(t, "temp blocked site should be merged by other node", func() bool {
+		vc := ss2.get("tmp.example.org")
+		return vc != nil && vc.AsTempBlocked()
+	})
+
+	// Centrally managed user list.
+	ss1.create("img.blocked.com").DirectVisit()
+	kv.put(defaultSiteSyncPrefix+siteSyncBlockedDir+"blocked.com", nil, 0)
+	waitSiteStat(t, "central blocked domain should be loaded", func() bool {
+		vc := ss1.get("blocked.com")
+		return vc != nil && vc.AlwaysBlocked()
+	})
+	if ss1.get("img.blocked.com") != nil {
+		t.Error("hosts already visited should be removed to use central domain")
+	}
+	ss1.hbhLock.RLock()
+	hbh = ss1.hasBlockedHost["blocked.com"]
+	ss1.hbhLock.RUnlock()
+	if !hbh {
+		t.Error("central blocked domain should mark domain has blocked host")
+	}
+	s2.publish("www.blocked.com", siteEvDirect)
+	kv.delete(defaultSiteSyncPrefix + siteSyncBlockedDir + "blocked.com")
+	waitSiteStat(t, "removed central domain should be deleted", func() bool {
+		return ss1.get("blocked.com") == nil
+	})
+
+	// A new node should get existing status.
+	ss3 := newSiteStat()
+	newSiteStatSync(kv, ss3, defaultSiteSyncPrefix, "node3")
+	if vc := ss3.get("www.example.com"); vc == nil || !vc.AsDirect() {
+		t.Error("new node should load existing site status")
+	}
+
+	s1.close()
+	s2.close()
+	// Events after close are dropped, e.g. from connections still draining.
+	s1.publish("late.example.org", siteEvDirect)
+}
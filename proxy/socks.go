@@ -0,0 +1,444 @@
+package proxy
+
+// SOCKS5 listener. Supports CONNECT and UDP ASSOCIATE, refer to rfc 1928
+// http://www.ietf.org/rfc/rfc1928.txt and rfc 1929 for username/password
+// authentication.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVer5 = 5
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPasswd   = 2
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSucceeded      = 0
+	socksRepGeneralFailure = 1
+	socksRepNotAllowed     = 2
+	socksRepHostUnreach    = 4
+	socksRepCmdNotSupport  = 7
+	socksRepAtypNotSupport = 8
+)
+
+// Socks handshake should finish quickly, otherwise close the client.
+const socksHandshakeTimeout = 10 * time.Second
+
+var errSocksAuth = errors.New("socks authentication failed")
+
+type socksProxy struct {
+	addr string
+}
+
+func newSocksProxy(addr string) *socksProxy {
+	return &socksProxy{addr}
+}
+
+func (sp *socksProxy) genConfig() string {
+	return fmt.Sprintf("listen = socks5://%s", sp.addr)
+}
+
+func (sp *socksProxy) Addr() string {
+	return sp.addr
+}
+
+func (sp *socksProxy) Serve(wg *sync.WaitGroup, quit <-chan struct{}) {
+	defer func() {
+		wg.Done()
+	}()
+
+	ln, err := listen(sp.addr)
+	if err != nil {
+		fmt.Println("listen socks5 failed:", err)
+		return
+	}
+	info.Printf("COW %s socks5 proxy address %s\n", version, sp.addr)
+	var exit bool
+	go func() {
+		<-quit
+		exit = true
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil && !exit {
+			errl.Printf("socks5 proxy(%s) accept %v\n", ln.Addr(), err)
+			if isErrTooManyOpenFd(err) {
+				connPool.CloseAll()
+			}
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		if exit {
+			debug.Println("exiting socks5 listner")
+			break
+		}
+		go serveSocks(conn, authFor(sp))
+	}
+}
+
+// socksAddrLen returns the length of the address (including ATYP and port)
+// at the start of b, or -1 if b is too short or ATYP is not supported.
+func socksAddrLen(b []byte) int {
+	if len(b) < 1 {
+		return -1
+	}
+	var n int
+	switch b[0] {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len + 2
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len + 2
+	case socksAtypDomain:
+		if len(b) < 2 {
+			return -1
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	default:
+		return -1
+	}
+	if len(b) < n {
+		return -1
+	}
+	return n
+}
+
+// parseSocksAddr parses address in socks format (ATYP, DST.ADDR, DST.PORT)
+// and returns host:port and number of bytes consumed. Shadowsocks uses the
+// same address format.
+func parseSocksAddr(b []byte) (hostPort string, n int, err error) {
+	if n = socksAddrLen(b); n == -1 {
+		return "", 0, errors.New("socks address malformed or type not supported")
+	}
+	var host string
+	switch b[0] {
+	case socksAtypIPv4:
+		host = net.IP(b[1 : 1+net.IPv4len]).String()
+	case socksAtypIPv6:
+		host = net.IP(b[1 : 1+net.IPv6len]).String()
+	case socksAtypDomain:
+		host = string(b[2 : 2+int(b[1])])
+	}
+	port := binary.BigEndian.Uint16(b[n-2 : n])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), n, nil
+}
+
+// genSocksAddr encodes host:port in socks address format.
+func genSocksAddr(hostPort string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("socks address %s invalid port", hostPort)
+	}
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks address %s host too long", hostPort)
+		}
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+	return b, nil
+}
+
+// readSocksAddr reads an address in socks format from r.
+func readSocksAddr(r io.Reader) (hostPort string, err error) {
+	buf := make([]byte, 1+1+255+2)
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+	var n int
+	switch buf[0] {
+	case socksAtypIPv4:
+		n = 1 + net.IPv4len + 2
+	case socksAtypIPv6:
+		n = 1 + net.IPv6len + 2
+	case socksAtypDomain:
+		n = 1 + 1 + int(buf[1]) + 2
+	default:
+		return "", errors.New("socks address type not supported")
+	}
+	if _, err = io.ReadFull(r, buf[2:n]); err != nil {
+		return
+	}
+	hostPort, _, err = parseSocksAddr(buf[:n])
+	return
+}
+
+// sendSocksReply sends reply to client. bndAddr could be empty, in which
+// case 0.0.0.0:0 is used.
+func sendSocksReply(w io.Writer, rep byte, bndAddr string) error {
+	addr := []byte{socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if bndAddr != "" {
+		var err error
+		if addr, err = genSocksAddr(bndAddr); err != nil {
+			return err
+		}
+	}
+	b := append([]byte{socksVer5, rep, 0}, addr...)
+	_, err := w.Write(b)
+	return err
+}
+
+// socksAuthenticate does method selection and optional username/password
+// authentication. Returns the authenticated user name, which is empty for
+// clients allowed by ip or when authentication is not required.
+func socksAuthenticate(conn net.Conn, a authenticator) (user string, err error) {
+	buf := make([]byte, 2+255)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		return "", fmt.Errorf("socks version %d not supported", buf[0])
+	}
+	nmethod := int(buf[1])
+	if _, err = io.ReadFull(conn, buf[:nmethod]); err != nil {
+		return
+	}
+	var method byte = socksMethodNoAuth
+	if a != nil {
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !authIP(clientIP) {
+			method = socksMethodUserPasswd
+		}
+	}
+	supported := false
+	for _, m := range buf[:nmethod] {
+		if m == method {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		conn.Write([]byte{socksVer5, socksMethodNoAcceptable})
+		return "", errors.New("socks no acceptable method")
+	}
+	if _, err = conn.Write([]byte{socksVer5, method}); err != nil {
+		return
+	}
+	if method == socksMethodNoAuth {
+		return
+	}
+
+	// Username/password sub negotiation, rfc 1929.
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	ulen := int(buf[1])
+	if _, err = io.ReadFull(conn, buf[:ulen+1]); err != nil {
+		return
+	}
+	user = string(buf[:ulen])
+	plen := int(buf[ulen])
+	if _, err = io.ReadFull(conn, buf[:plen]); err != nil {
+		return
+	}
+	passwd := string(buf[:plen])
+
+	if err = a.checkPasswd(conn, user, passwd); err != nil {
+		if err != errAuthRequired {
+			errl.Printf("socks cli(%s) auth: user %s %v\n", conn.RemoteAddr(), user, err)
+		}
+		conn.Write([]byte{1, 1})
+		return "", errSocksAuth
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return
+}
+
+// authLocalPort checks whether the connection is accepted on the given port.
+func authLocalPort(conn net.Conn, port uint16) bool {
+	_, portStr, _ := net.SplitHostPort(conn.LocalAddr().String())
+	p, _ := strconv.Atoi(portStr)
+	return uint16(p) == port
+}
+
+// serveSocks serves a socks client, a is nil if authentication is not
+// required.
+func serveSocks(conn net.Conn, a authenticator) {
+	defer conn.Close()
+	defer trackConn(conn).done()
+
+	setConnReadTimeout(conn, socksHandshakeTimeout, "socks handshake")
+	user, err := socksAuthenticate(conn, a)
+	if err != nil {
+		debug.Printf("socks cli(%s) %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		debug.Printf("socks cli(%s) read request %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	if buf[0] != socksVer5 {
+		debug.Printf("socks cli(%s) version %d not supported\n", conn.RemoteAddr(), buf[0])
+		return
+	}
+	cmd := buf[1]
+	hostPort, err := readSocksAddr(conn)
+	if err != nil {
+		debug.Printf("socks cli(%s) read address %v\n", conn.RemoteAddr(), err)
+		sendSocksReply(conn, socksRepAtypNotSupport, "")
+		return
+	}
+	unsetConnReadTimeout(conn, "socks handshake")
+
+	// Apply the same accounting and limits as HTTP requests.
+	var uu *userUsage
+	if user != "" {
+		uu = getUserUsage(user)
+		if err = uu.checkQuota(); err == nil {
+			err = uu.acquireConn()
+		}
+		if err != nil {
+			debug.Printf("socks cli(%s) user %s %v\n", conn.RemoteAddr(), user, err)
+			sendSocksReply(conn, socksRepNotAllowed, "")
+			return
+		}
+		defer uu.releaseConn()
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		socksConnect(conn, hostPort, uu)
+	case socksCmdUDPAssociate:
+		socksUDPAssociate(conn, hostPort, uu)
+	default:
+		sendSocksReply(conn, socksRepCmdNotSupport, "")
+	}
+}
+
+// socksConnect serves CONNECT command, uu is nil if user is not
+// authenticated.
+func socksConnect(conn net.Conn, hostPort string, uu *userUsage) {
+	e := &accessEntry{
+		Time:   time.Now(),
+		Client: conn.RemoteAddr().String(),
+		Method: "CONNECT",
+		Host:   hostPort,
+		Route:  routeNone,
+	}
+	if uu != nil {
+		e.User = uu.user
+	}
+	url, err := ParseRequestURI(hostPort)
+	if err != nil {
+		sendSocksReply(conn, socksRepGeneralFailure, "")
+		logTunnelAccess(e, err)
+		return
+	}
+	if !config.TunnelAllowedPort[url.Port] {
+		debug.Printf("socks cli(%s) forbidden tunnel port %s\n", conn.RemoteAddr(), hostPort)
+		sendSocksReply(conn, socksRepNotAllowed, "")
+		logTunnelAccess(e, errors.New("forbidden tunnel port"))
+		return
+	}
+	if name := blockedBy(url.Host); name != "" {
+		debug.Printf("socks cli(%s) blocked by %s: %s\n", conn.RemoteAddr(), name, hostPort)
+		sendSocksReply(conn, socksRepNotAllowed, "")
+		e.Route = routeBlocked
+		logTunnelAccess(e, nil)
+		return
+	}
+	siteInfo := siteStat.GetVisitCnt(url)
+	srvconn, err := connectTunnel(url, siteInfo)
+	if err != nil {
+		debug.Printf("socks cli(%s) connect %s %v\n", conn.RemoteAddr(), hostPort, err)
+		sendSocksReply(conn, socksRepHostUnreach, "")
+		logTunnelAccess(e, err)
+		return
+	}
+	defer srvconn.Close()
+	if _, ok := srvconn.(directConn); ok {
+		e.Route = routeDirect
+	} else {
+		e.Route, e.Parent = routeParent, fmt.Sprint(srvconn)
+	}
+	if err = sendSocksReply(conn, socksRepSucceeded, ""); err != nil {
+		logTunnelAccess(e, err)
+		return
+	}
+	e.Status = 200
+
+	tunnel := srvconn
+	if uu != nil {
+		tunnel = usageConn{srvconn, uu}
+	}
+	done := make(chan struct{})
+	go func() {
+		e.Sent, _ = io.Copy(tunnel, conn)
+		close(done)
+		srvconn.Close()
+	}()
+	n, err := io.Copy(conn, tunnel)
+	e.Recv = n
+	select {
+	case <-done:
+		err = nil // closed by client
+	default:
+	}
+	if n > 0 {
+		if _, ok := srvconn.(directConn); ok {
+			siteInfo.DirectVisit()
+		} else {
+			siteInfo.BlockedVisit()
+		}
+	}
+	conn.Close()
+	<-done
+	logTunnelAccess(e, err)
+}
+
+// connectTunnel creates a tunnel connection to url according to the site's
+// visit count. Unlike clientConn.connect, it has no client to send error
+// pages to, and http/cow parents get a CONNECT request before returning.
+func connectTunnel(url *URL, siteInfo *VisitCnt) (srvconn net.Conn, err error) {
+	if config.AlwaysProxy || siteInfo.AsBlocked() && !parentProxy.empty() {
+		if srvconn, err = parentProxy.connect(url); err == nil {
+			return parentTunnel(srvconn, url)
+		}
+		if config.AlwaysProxy || siteInfo.AlwaysBlocked() || siteInfo.AsTempBlocked() {
+			return
+		}
+		return connectDirect(url, siteInfo)
+	}
+	if srvconn, err = connectDirect(url, siteInfo); err == nil {
+		return
+	}
+	if parentProxy.empty() || siteInfo.AlwaysDirect() {
+		return
+	}
+	var parentErr error
+	if srvconn, parentErr = parentProxy.connect(url); parentErr != nil {
+		return nil, err
+	}
+	siteStat.TempBlocked(url)
+	return parentTunnel(srvconn, url)
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSocksAddr(t *testing.T) {
+	testData := []struct {
+		hostPort string
+		atyp     byte
+		n        int
+	}{
+		{"1.2.3.4:80", socksAtypIPv4, 7},
+		{"[2001:db8::1]:443", socksAtypIPv6, 19},
+		{"www.example.com:53", socksAtypDomain, 1 + 1 + 15 + 2},
+	}
+	for _, td := range testData {
+		b, err := genSocksAddr(td.hostPort)
+		if err != nil {
+			t.Fatalf("gen socks addr %s: %v\n", td.hostPort, err)
+		}
+		if b[0] != td.atyp {
+			t.Errorf("%s atyp should be %d, got %d\n", td.hostPort, td.atyp, b[0])
+		}
+		hostPort, n, err := parseSocksAddr(append(b, "data"...))
+		if err != nil {
+			t.Fatalf("parse socks addr %s: %v\n", td.hostPort, err)
+		}
+		if hostPort != td.hostPort || n != td.n {
+			t.Errorf("parse socks addr %s got %s length %d\n", td.hostPort, hostPort, n)
+		}
+	}
+
+	if _, _, err := parseSocksAddr([]byte{socksAtypIPv4, 1, 2}); err == nil {
+		t.Error("short socks address should return error")
+	}
+}
+
+func TestSocksUDPHeader(t *testing.T) {
+	hdr, err := genSocksUDPHeader("8.8.8.8:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, data, err := parseSocksUDPHeader(append(hdr, "query"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "8.8.8.8:53" || string(data) != "query" {
+		t.Errorf("parse socks udp header got target %s data %q\n", target, data)
+	}
+
+	hdr[2] = 1 // fragment
+	if _, _, err = parseSocksUDPHeader(hdr); err == nil {
+		t.Error("fragmented datagram should return error")
+	}
+}
+
+func TestSocksUDPAssociateDirect(t *testing.T) {
+	config.UDPTimeout = time.Second
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		serveSocks(conn, nil)
+	}()
+
+	ctrl, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	ctrl.Write([]byte{socksVer5, 1, socksMethodNoAuth})
+	rep := make([]byte, 2)
+	if _, err = io.ReadFull(ctrl, rep); err != nil || rep[1] != socksMethodNoAuth {
+		t.Fatalf("method selection reply %v err %v\n", rep, err)
+	}
+	ctrl.Write([]byte{socksVer5, socksCmdUDPAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	if _, err = io.ReadFull(ctrl, rep[:2]); err != nil || rep[1] != socksRepSucceeded {
+		t.Fatalf("udp associate reply %v err %v\n", rep, err)
+	}
+	io.ReadFull(ctrl, rep[:1]) // rsv
+	relayAddr, err := readSocksAddr(ctrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := net.Dial("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	hdr, _ := genSocksUDPHeader(echo.LocalAddr().String())
+	if _, err = cli.Write(append(hdr, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := cli.Read(buf)
+	if err != nil {
+		t.Fatal("read udp reply:", err)
+	}
+	from, data, err := parseSocksUDPHeader(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != echo.LocalAddr().String() || !bytes.Equal(data, []byte("hello")) {
+		t.Errorf("udp reply from %s data %q\n", from, data)
+	}
+}
+
+func TestSocksConnectBlocked(t *testing.T) {
+	saved, savedPort := blockLists, config.TunnelAllowedPort
+	defer func() { blockLists, config.TunnelAllowedPort = saved, savedPort }()
+	config.TunnelAllowedPort = map[string]bool{"443": true}
+	trie := newDomainTrie()
+	trie.insert("ads.example.com")
+	bl := &blockList{name: "ads", block: trie}
+	blockLists = []*blockList{bl}
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		socksConnect(srv, "ads.example.com:443", nil)
+		srv.Close()
+	}()
+	rep := make([]byte, 2)
+	if _, err := io.ReadFull(cli, rep); err != nil || rep[1] != socksRepNotAllowed {
+		t.Errorf("connect to blocked host reply %v err %v\n", rep, err)
+	}
+	io.Copy(ioutil.Discard, cli)
+	if atomic.LoadInt64(&bl.hits) != 1 {
+		t.Error("blocked connect should be counted as hit")
+	}
+
+	ua := newUDPAssociation(nil, nil)
+	if _, err := ua.getSession("ads.example.com:53"); err == nil {
+		t.Error("udp session to blocked host should fail")
+	}
+	if atomic.LoadInt64(&bl.hits) != 2 {
+		t.Error("blocked udp datagram should be counted as hit")
+	}
+}
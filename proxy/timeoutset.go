@@ -8,23 +8,42 @@ import (
 type TimeoutSet struct {
 	sync.RWMutex
 	time    map[string]time.Time
+	value   map[string]string
 	timeout time.Duration
 }
 
 func NewTimeoutSet(timeout time.Duration) *TimeoutSet {
 	ts := &TimeoutSet{time: make(map[string]time.Time),
+		value:   make(map[string]string),
 		timeout: timeout,
 	}
 	return ts
 }
 
 func (ts *TimeoutSet) add(key string) {
+	ts.addValue(key, "")
+}
+
+// addValue adds key with an associated value, which can be retrieved by get.
+func (ts *TimeoutSet) addValue(key, val string) {
 	now := time.Now()
 	ts.Lock()
 	ts.time[key] = now
+	ts.value[key] = val
 	ts.Unlock()
 }
 
+// get returns the value associated with key if key is in the set.
+func (ts *TimeoutSet) get(key string) (string, bool) {
+	if !ts.has(key) {
+		return "", false
+	}
+	ts.RLock()
+	val := ts.value[key]
+	ts.RUnlock()
+	return val, true
+}
+
 func (ts *TimeoutSet) has(key string) bool {
 	ts.RLock()
 	t, ok := ts.time[key]
@@ -42,5 +61,6 @@ func (ts *TimeoutSet) has(key string) bool {
 func (ts *TimeoutSet) del(key string) {
 	ts.Lock()
 	delete(ts.time, key)
+	delete(ts.value, key)
 	ts.Unlock()
 }
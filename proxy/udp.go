@@ -0,0 +1,372 @@
+// UDP relay for SOCKS5 UDP ASSOCIATE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultUDPTimeout = time.Minute
+
+// Large enough to hold any UDP datagram.
+const udpBufSize = 64 * 1024
+
+// packetConn relays UDP datagrams to and from targets given as host:port.
+// Direct UDP socket and parent proxies supporting UDP all implement this.
+type packetConn interface {
+	WriteTo(b []byte, hostPort string) (int, error)
+	ReadFrom(b []byte) (n int, hostPort string, err error)
+	Close() error
+}
+
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (dc directPacketConn) String() string {
+	return "direct udp"
+}
+
+func newDirectPacketConn() (packetConn, error) {
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return directPacketConn{pc}, nil
+}
+
+func (dc directPacketConn) WriteTo(b []byte, hostPort string) (int, error) {
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return 0, err
+	}
+	return dc.PacketConn.WriteTo(b, addr)
+}
+
+func (dc directPacketConn) ReadFrom(b []byte) (int, string, error) {
+	n, addr, err := dc.PacketConn.ReadFrom(b)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, addr.String(), nil
+}
+
+// connectPacket selects direct or parent proxy UDP relay according to the
+// site's visit count. UDP has no reliable way to detect blocking, so only
+// sites considered as blocked use parent proxy.
+func connectPacket(url *URL, siteInfo *VisitCnt) (pc packetConn, direct bool, err error) {
+	if config.AlwaysProxy || siteInfo.AsBlocked() && !parentProxy.empty() {
+		if pc, err = parentProxy.connectPacket(url); err == nil {
+			return pc, false, nil
+		}
+		debug.Printf("udp parent proxy for %s: %v\n", url.HostPort, err)
+		if config.AlwaysProxy || siteInfo.AlwaysBlocked() {
+			return
+		}
+	}
+	pc, err = newDirectPacketConn()
+	return pc, true, err
+}
+
+// udpSession is an entry in the NAT table of an association.
+type udpSession struct {
+	sent       int64 // bytes sent to target, updated atomically
+	recv       int64 // bytes received from target, updated atomically
+	start      time.Time
+	pc         packetConn
+	direct     bool
+	siteInfo   *VisitCnt
+	lastActive int64 // unix nano, updated atomically
+	visited    bool
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Now().Sub(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+// udpAssociation relays UDP datagrams for a single SOCKS5 UDP ASSOCIATE
+// request. Sessions are keyed by target host:port.
+type udpAssociation struct {
+	relay    net.PacketConn // receives datagrams from client
+	clientIP net.IP
+	ctrl     net.Conn   // TCP control connection, closing it ends association
+	usage    *userUsage // nil if user is not authenticated
+
+	sync.Mutex
+	clientAddr net.Addr
+	session    map[string]*udpSession
+	closed     bool
+	err        error // why association is stopped
+}
+
+func newUDPAssociation(relay net.PacketConn, clientIP net.IP) *udpAssociation {
+	return &udpAssociation{
+		relay:    relay,
+		clientIP: clientIP,
+		session:  make(map[string]*udpSession),
+	}
+}
+
+// socksUDPAssociate handles UDP ASSOCIATE command. The association lives
+// until the TCP control connection closes.
+func socksUDPAssociate(conn net.Conn, hostPort string, uu *userUsage) {
+	localHost, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	relay, err := net.ListenPacket("udp", net.JoinHostPort(localHost, "0"))
+	if err != nil {
+		errl.Printf("socks cli(%s) udp associate listen: %v\n", conn.RemoteAddr(), err)
+		sendSocksReply(conn, socksRepGeneralFailure, "")
+		return
+	}
+	_, relayPort, _ := net.SplitHostPort(relay.LocalAddr().String())
+	if err = sendSocksReply(conn, socksRepSucceeded, net.JoinHostPort(localHost, relayPort)); err != nil {
+		relay.Close()
+		return
+	}
+	clientHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ua := newUDPAssociation(relay, net.ParseIP(clientHost))
+	ua.ctrl, ua.usage = conn, uu
+	debug.Printf("socks cli(%s) udp associate %s relay %s\n",
+		conn.RemoteAddr(), hostPort, relay.LocalAddr())
+
+	go ua.serve()
+	go ua.reapIdle()
+
+	// Wait for the control connection to close.
+	buf := make([]byte, 1)
+	for {
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+	}
+	ua.close()
+	debug.Printf("socks cli(%s) udp associate closed\n", conn.RemoteAddr())
+}
+
+func (ua *udpAssociation) close() {
+	ua.Lock()
+	ua.closed = true
+	for hostPort, s := range ua.session {
+		s.pc.Close()
+		delete(ua.session, hostPort)
+	}
+	ua.Unlock()
+	ua.relay.Close()
+}
+
+// serve reads datagrams from client and forwards to target.
+func (ua *udpAssociation) serve() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, addr, err := ua.relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(ua.clientIP) {
+			debug.Printf("udp relay drop datagram from unknown client %s\n", addr)
+			continue
+		}
+		target, data, err := parseSocksUDPHeader(buf[:n])
+		if err != nil {
+			debug.Printf("udp relay from %s: %v\n", addr, err)
+			continue
+		}
+		ua.Lock()
+		ua.clientAddr = addr
+		ua.Unlock()
+
+		s, err := ua.getSession(target)
+		if err != nil {
+			debug.Printf("udp relay to %s: %v\n", target, err)
+			continue
+		}
+		s.touch()
+		if _, err = s.pc.WriteTo(data, target); err != nil {
+			debug.Printf("udp relay write to %s: %v\n", target, err)
+			continue
+		}
+		atomic.AddInt64(&s.sent, int64(len(data)))
+		if err = ua.usage.upload(len(data)); err != nil {
+			ua.stop(err)
+			return
+		}
+	}
+}
+
+func (ua *udpAssociation) getSession(target string) (*udpSession, error) {
+	ua.Lock()
+	s, ok := ua.session[target]
+	ua.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	url, err := ParseRequestURI(target)
+	if err != nil {
+		return nil, err
+	}
+	if name := blockedBy(url.Host); name != "" {
+		e := ua.accessEntry(target)
+		e.Time, e.Route = time.Now(), routeBlocked
+		logTunnelAccess(e, nil)
+		return nil, errors.New("blocked by " + name)
+	}
+	siteInfo := siteStat.GetVisitCnt(url)
+	pc, direct, err := connectPacket(url, siteInfo)
+	if err != nil {
+		e := ua.accessEntry(target)
+		e.Time = time.Now()
+		logTunnelAccess(e, err)
+		return nil, err
+	}
+	s = &udpSession{start: time.Now(), pc: pc, direct: direct, siteInfo: siteInfo}
+	s.touch()
+
+	ua.Lock()
+	if ua.closed {
+		ua.Unlock()
+		pc.Close()
+		return nil, errors.New("udp association closed")
+	}
+	ua.session[target] = s
+	ua.Unlock()
+
+	go ua.serveSession(target, s)
+	return s, nil
+}
+
+// serveSession reads reply from target and sends back to client.
+func (ua *udpAssociation) serveSession(target string, s *udpSession) {
+	defer ua.removeSession(target, s)
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.touch()
+		if !s.visited {
+			s.visited = true
+			if s.direct {
+				s.siteInfo.DirectVisit()
+			} else {
+				s.siteInfo.BlockedVisit()
+			}
+		}
+		b, err := genSocksUDPHeader(from)
+		if err != nil {
+			continue
+		}
+		b = append(b, buf[:n]...)
+
+		ua.Lock()
+		clientAddr := ua.clientAddr
+		ua.Unlock()
+		if _, err = ua.relay.WriteTo(b, clientAddr); err != nil {
+			debug.Printf("udp relay write to client %s: %v\n", clientAddr, err)
+			continue
+		}
+		atomic.AddInt64(&s.recv, int64(n))
+		if err = ua.usage.download(n); err != nil {
+			ua.stop(err)
+			return
+		}
+	}
+}
+
+// stop ends the association by closing the control connection.
+func (ua *udpAssociation) stop(err error) {
+	debug.Printf("udp relay for %s stopped: %v\n", ua.clientIP, err)
+	ua.Lock()
+	ua.err = err
+	ua.Unlock()
+	if ua.ctrl != nil {
+		ua.ctrl.Close()
+	}
+}
+
+// removeSession is called when the session is closed for any reason.
+func (ua *udpAssociation) removeSession(target string, s *udpSession) {
+	ua.Lock()
+	if ua.session[target] == s {
+		delete(ua.session, target)
+	}
+	err := ua.err
+	ua.Unlock()
+	s.pc.Close()
+
+	e := ua.accessEntry(target)
+	e.Time = s.start
+	if s.direct {
+		e.Route = routeDirect
+	} else {
+		e.Route, e.Parent = routeParent, fmt.Sprint(s.pc)
+	}
+	e.Sent, e.Recv = atomic.LoadInt64(&s.sent), atomic.LoadInt64(&s.recv)
+	logTunnelAccess(e, err)
+}
+
+// accessEntry returns access log entry for session to target, route is none.
+func (ua *udpAssociation) accessEntry(target string) *accessEntry {
+	e := &accessEntry{Method: "UDP", Host: target, Route: routeNone}
+	if ua.ctrl != nil {
+		e.Client = ua.ctrl.RemoteAddr().String()
+	}
+	if ua.usage != nil {
+		e.User = ua.usage.user
+	}
+	return e
+}
+
+// reapIdle closes sessions without traffic for config.UDPTimeout.
+func (ua *udpAssociation) reapIdle() {
+	for {
+		time.Sleep(config.UDPTimeout / 2)
+		ua.Lock()
+		if ua.closed {
+			ua.Unlock()
+			return
+		}
+		for target, s := range ua.session {
+			if s.idle() > config.UDPTimeout {
+				debug.Printf("udp relay session %s idle, close\n", target)
+				s.pc.Close()
+				delete(ua.session, target)
+			}
+		}
+		ua.Unlock()
+	}
+}
+
+// SOCKS5 UDP request header: RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+
+func parseSocksUDPHeader(b []byte) (target string, data []byte, err error) {
+	if len(b) < 3 {
+		return "", nil, errors.New("socks udp header too short")
+	}
+	if b[2] != 0 {
+		// Fragmentation is optional for socks server, drop it.
+		return "", nil, errors.New("socks udp fragmentation not supported")
+	}
+	target, n, err := parseSocksAddr(b[3:])
+	if err != nil {
+		return "", nil, err
+	}
+	return target, b[3+n:], nil
+}
+
+func genSocksUDPHeader(hostPort string) ([]byte, error) {
+	addr, err := genSocksAddr(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{0, 0, 0}, addr...), nil
+}
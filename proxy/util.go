@@ -10,7 +10,6 @@ import (
 	"os"
 	"path"
 	"runtime"
-	"strconv"
 	"strings"
 
 	"github.com/cyfdecyf/bufio"
@@ -289,50 +288,58 @@ func md5sum(ss ...string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// Loopback, private, link-local and unique local networks.
+var privateIPNet = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{
+		"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+		"::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
 // hostIsIP determines whether a host address is an IP address and whether
-// it is private. Currenly only handles IPv4 addresses.
+// it is private. IPv6 address may be enclosed in brackets and have zone.
 func hostIsIP(host string) (isIP, isPrivate bool) {
-	part := strings.Split(host, ".")
-	if len(part) != 4 {
-		return false, false
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i != -1 {
+		host = host[:i]
 	}
-	for _, i := range part {
-		if len(i) == 0 || len(i) > 3 {
-			return false, false
-		}
-		n, err := strconv.Atoi(i)
-		if err != nil || n < 0 || n > 255 {
-			return false, false
-		}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, false
 	}
-	if part[0] == "127" || part[0] == "10" || (part[0] == "192" && part[1] == "168") {
+	if ip.IsUnspecified() {
 		return true, true
 	}
-	if part[0] == "172" {
-		n, _ := strconv.Atoi(part[1])
-		if 16 <= n && n <= 31 {
+	for _, n := range privateIPNet {
+		if n.Contains(ip) {
 			return true, true
 		}
 	}
 	return true, false
 }
 
-// NetNbitIPv4Mask returns a IPMask with highest n bit set.
-func NewNbitIPv4Mask(n int) net.IPMask {
-	if n > 32 {
-		panic("NewNbitIPv4Mask: bit number > 32")
-	}
-	mask := []byte{0, 0, 0, 0}
-	for id := 0; id < 4; id++ {
-		if n >= 8 {
-			mask[id] = 0xff
+// parseIPNet parses CIDR or single IP address for both IPv4 and IPv6.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			s += "/128"
 		} else {
-			mask[id] = ^byte(1<<(uint8(8-n)) - 1)
-			break
+			s += "/32"
 		}
-		n -= 8
 	}
-	return net.IPMask(mask)
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// NetNbitIPv4Mask returns a IPMask with highest n bit set. Returns nil if n
+// is larger than 32, use net.CIDRMask for IPv6.
+func NewNbitIPv4Mask(n int) net.IPMask {
+	return net.CIDRMask(n, 32)
 }
 
 var topLevelDomain = map[string]bool{
@@ -260,6 +260,8 @@ func TestHost2Domain(t *testing.T) {
 		{"10.2.1.1", ""},
 		{"123.45.67.89", "123.45.67.89"},
 		{"172.65.43.21", "172.65.43.21"},
+		{"fd00::1", ""},
+		{"2001:db8::1", "2001:db8::1"},
 	}
 
 	for _, td := range testData {
@@ -288,6 +290,16 @@ func TestHostIsIP(t *testing.T) {
 		{"foo.com", false, false},
 		{"www.foo.com", false, false},
 		{"www.bar.foo.com", false, false},
+		{"169.254.1.1", true, true},
+		{"0.0.0.0", true, true},
+		{"::1", true, true},
+		{"[::1]", true, true},
+		{"fd12:3456::1", true, true},
+		{"fe80::1%eth0", true, true},
+		{"::ffff:192.168.1.1", true, true},
+		{"2001:db8::1", true, false},
+		{"::ffff:8.8.8.8", true, false},
+		{"fd.example.com", false, false},
 	}
 
 	for _, td := range testData {